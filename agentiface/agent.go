@@ -31,6 +31,7 @@ type Agent interface {
 	Logger
 	Messaging
 	Cli
+	Lifecycle
 	Config
 	SchemaRegistry
 	TypeRegistry
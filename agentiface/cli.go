@@ -16,9 +16,20 @@ package agentiface
 
 import "github.com/spf13/cobra"
 
+const (
+	// ExitSuccess is the exit status of an agent which ran and stopped successfully.
+	ExitSuccess = 0
+
+	// ExitFailure is the exit status of an agent whose command failed or which did not shut down gracefully.
+	ExitFailure = 1
+)
+
 // Cli is an interface which encapsulates command line argument parsing.
 type Cli interface {
-	ParseCommandLine() error
+	// ParseCommandLine executes the command given on the command line. If the command leaves the agent connected,
+	// it waits until SIGINT or SIGTERM is received or the agent quits, and shuts the agent down gracefully.
+	// It returns the exit status of the agent (see ExitSuccess and ExitFailure).
+	ParseCommandLine() int
 	RegisterCommand(cmd *cobra.Command)
 	RootCommand() *cobra.Command
 }
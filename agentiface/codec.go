@@ -0,0 +1,41 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+// Codec serializes the messages in a wire format, identified by the content type of the envelopes carrying them.
+type Codec interface {
+	// ContentType returns the mime type of the messages serialized by the codec.
+	ContentType() string
+
+	// Supports returns true if the codec can serialize the messages described by the schema.
+	Supports(schema Schema) bool
+
+	// Code serializes a message described by the schema.
+	Code(schema Schema, o interface{}) ([]byte, error)
+
+	// Decode unserializes a message described by the schema into a new instance of the type t.
+	Decode(schema Schema, o []byte, t Type) (interface{}, error)
+}
+
+// ContentTyped wraps a message to send in a given content type, whatever the preferences of its destination.
+type ContentTyped struct {
+	Message     interface{}
+	ContentType string
+}
+
+// WithContentType wraps a message to send it in the given content type (see ContentTyped).
+func WithContentType(msg interface{}, contentType string) *ContentTyped {
+	return &ContentTyped{Message: msg, ContentType: contentType}
+}
@@ -16,6 +16,7 @@ package agentiface
 
 import (
 	"io"
+	"time"
 
 	"github.com/spf13/pflag"
 )
@@ -39,4 +40,8 @@ type Config interface {
 	SetDefaultConfigOption(key string, value interface{})
 	BindConfigPFlag(key string, flag *pflag.Flag) error
 	GetConfigString(key string) string
+	GetConfigBool(key string) bool
+	GetConfigInt(key string) int
+	GetConfigFloat64(key string) float64
+	GetConfigDuration(key string) time.Duration
 }
@@ -0,0 +1,55 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnroutable is the error returned when a mandatory message could not be routed to any queue.
+var ErrUnroutable = errors.New("Unroutable message")
+
+// ErrNacked is the error returned when the broker refused a message.
+var ErrNacked = errors.New("Message refused by the broker")
+
+// ErrAlreadyRegistered is the error returned when registering a schema or a type which conflicts with a registered one.
+var ErrAlreadyRegistered = errors.New("Already registered")
+
+// ErrIncompatibleSchema is the error returned when registering a version of a schema which is not compatible with the
+// registered versions.
+var ErrIncompatibleSchema = errors.New("Incompatible schema")
+
+// ErrUnknownSchemaRevision is the error returned when receiving a message written with a revision of its schema which
+// is not registered.
+var ErrUnknownSchemaRevision = errors.New("Unknown schema revision")
+
+// RequestTimeoutError is the error returned when no reply to a request has been received before its deadline.
+type RequestTimeoutError struct {
+	// To is the destination of the request.
+	To string
+	// MessageID is the id of the request message.
+	MessageID string
+}
+
+// Error returns the description of the error.
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("Request '%s' sent to '%s' timed out", e.MessageID, e.To)
+}
+
+// Timeout reports whether the error is a timeout (always true).
+func (e *RequestTimeoutError) Timeout() bool {
+	return true
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Filter selects the events received by an event callback. A filter is created with one of the By functions,
+// combined with All and Any, and converted by the sdk into the binding arguments of the event queue.
+// An invalid filter keeps the error, which is reported when registering the callback.
+type Filter struct {
+	// disjunction of conjunctions of headers: an event matches the filter if its headers match all the entries
+	// of at least one of the maps
+	bindings []map[string]interface{}
+	err      error
+}
+
+// header returns a filter matching the events having a header set to a value.
+func header(key string, value string, description string) *Filter {
+	if value == "" {
+		return &Filter{err: fmt.Errorf("Invalid filter: empty %s", description)}
+	}
+
+	return &Filter{
+		bindings: []map[string]interface{}{{key: value}},
+	}
+}
+
+// ByMessageType returns a filter matching the events of the given message type (name of the schema).
+func ByMessageType(name MessageName) *Filter {
+	return header(AmqpHeaderType, string(name), "message type")
+}
+
+// ByGoType returns a filter matching the events decoded into the given Go type, which must be registered in
+// the TypeRegistry. v is either a reflect.Type or a value (or a pointer to a value) of the type.
+func ByGoType(registry TypeRegistry, v interface{}) *Filter {
+	t, ok := v.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(v)
+	}
+
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil {
+		return &Filter{err: fmt.Errorf("Invalid filter: no Go type given")}
+	}
+
+	typ, err := registry.TypeGetByType(t)
+
+	if err != nil {
+		return &Filter{err: fmt.Errorf("Invalid filter: %s", err.Error())}
+	}
+
+	return ByMessageType(MessageName(typ.Name()))
+}
+
+// BySender returns a filter matching the events sent by the agent having the given id.
+func BySender(agentID string) *Filter {
+	return header(AmqpHeaderSenderID, agentID, "sender id")
+}
+
+// BySenderName returns a filter matching the events sent by the agents having the given name.
+func BySenderName(name string) *Filter {
+	return header(AmqpHeaderSenderName, name, "sender name")
+}
+
+// ByCorrelationID returns a filter matching the events sent as a consequence of the message having the given id.
+func ByCorrelationID(id string) *Filter {
+	return header(AmqpHeaderCorrelationID, id, "correlation id")
+}
+
+// All returns a filter matching the events matched by all the given filters.
+// Without any filter, it matches all the events.
+func All(filters ...*Filter) *Filter {
+	bindings := []map[string]interface{}{{}}
+
+	for _, f := range filters {
+		if f == nil {
+			return nilFilter()
+		}
+
+		if f.err != nil {
+			return f
+		}
+
+		// distribute the conjunction over the disjunctions
+		product := make([]map[string]interface{}, 0, len(bindings)*len(f.bindings))
+
+		for _, left := range bindings {
+			for _, right := range f.bindings {
+				if merged, ok := merge(left, right); ok {
+					product = append(product, merged)
+				}
+			}
+		}
+
+		if len(product) == 0 {
+			return &Filter{err: fmt.Errorf("Invalid filter: conditions can never be matched together")}
+		}
+
+		bindings = product
+	}
+
+	return &Filter{bindings: bindings}
+}
+
+// Any returns a filter matching the events matched by at least one of the given filters.
+func Any(filters ...*Filter) *Filter {
+	if len(filters) == 0 {
+		return &Filter{err: fmt.Errorf("Invalid filter: no condition given")}
+	}
+
+	var bindings []map[string]interface{}
+
+	for _, f := range filters {
+		if f == nil {
+			return nilFilter()
+		}
+
+		if f.err != nil {
+			return f
+		}
+
+		bindings = append(bindings, f.bindings...)
+	}
+
+	return &Filter{bindings: bindings}
+}
+
+// FromEventFilter returns the filter equivalent to raw binding arguments, where the special key "x-match" sets
+// whether all ("all", default) or any ("any") of the other entries must be matched.
+func FromEventFilter(filter EventFilter) *Filter {
+	match := "all"
+
+	if m, ok := filter["x-match"]; ok {
+		match, _ = m.(string)
+	}
+
+	keys := make([]string, 0, len(filter))
+	for k := range filter {
+		if k != "x-match" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	switch match {
+	case "all":
+		binding := make(map[string]interface{}, len(keys))
+		for _, k := range keys {
+			binding[k] = filter[k]
+		}
+
+		return &Filter{bindings: []map[string]interface{}{binding}}
+	case "any":
+		if len(keys) == 0 {
+			return &Filter{err: fmt.Errorf("Invalid filter: x-match 'any' without any header to match")}
+		}
+
+		filters := make([]*Filter, len(keys))
+		for i, k := range keys {
+			filters[i] = &Filter{bindings: []map[string]interface{}{{k: filter[k]}}}
+		}
+
+		return Any(filters...)
+	default:
+		return &Filter{err: fmt.Errorf("Invalid filter: unknown x-match value '%v'", filter["x-match"])}
+	}
+}
+
+// Bindings returns the binding arguments of the filter (one binding per map, matching all its entries) or
+// the error making it invalid.
+func (f *Filter) Bindings() ([]map[string]interface{}, error) {
+	if f == nil {
+		return nil, nilFilter().err
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return f.bindings, nil
+}
+
+// nilFilter returns the invalid filter standing for a nil filter.
+func nilFilter() *Filter {
+	return &Filter{err: fmt.Errorf("Invalid filter: nil")}
+}
+
+// merge returns the union of two conjunctions, or false if they require different values for the same header.
+func merge(left map[string]interface{}, right map[string]interface{}) (map[string]interface{}, bool) {
+	merged := make(map[string]interface{}, len(left)+len(right))
+
+	for k, v := range left {
+		merged[k] = v
+	}
+
+	for k, v := range right {
+		if existing, ok := merged[k]; ok && !reflect.DeepEqual(existing, v) {
+			return nil, false
+		}
+		merged[k] = v
+	}
+
+	return merged, true
+}
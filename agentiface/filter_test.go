@@ -0,0 +1,176 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"testing"
+)
+
+type build struct{}
+
+// fakeTypeRegistry is a TypeRegistry knowing a single type.
+type fakeTypeRegistry struct {
+	TypeRegistry
+}
+
+type fakeType struct{}
+
+func (t fakeType) Name() string       { return "build" }
+func (t fakeType) Type() reflect.Type { return reflect.TypeOf(build{}) }
+
+func (r fakeTypeRegistry) TypeGetByType(t reflect.Type) (Type, error) {
+	if t == reflect.TypeOf(build{}) {
+		return fakeType{}, nil
+	}
+	return nil, fmt.Errorf("No type found in the registry with type '%s'", t.Name())
+}
+
+func TestFilter(t *testing.T) {
+	Convey("Given filters on a single header", t, func() {
+		Convey("They should produce a single binding", func() {
+			bindings, err := ByMessageType("build").Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderType: "build"}})
+
+			bindings, err = BySender("agent-git@host#1").Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderSenderID: "agent-git@host#1"}})
+
+			bindings, err = BySenderName("agent-git").Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderSenderName: "agent-git"}})
+
+			bindings, err = ByCorrelationID("42").Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderCorrelationID: "42"}})
+		})
+
+		Convey("Empty values should be rejected", func() {
+			_, err := ByMessageType("").Bindings()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given filters on Go types", t, func() {
+		registry := fakeTypeRegistry{}
+
+		Convey("A registered type should be resolved to its message type", func() {
+			for _, v := range []interface{}{build{}, &build{}, reflect.TypeOf(build{})} {
+				bindings, err := ByGoType(registry, v).Bindings()
+				So(err, ShouldBeNil)
+				So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderType: "build"}})
+			}
+		})
+
+		Convey("An unknown type should be rejected", func() {
+			_, err := ByGoType(registry, 42).Bindings()
+			So(err, ShouldNotBeNil)
+
+			_, err = ByGoType(registry, nil).Bindings()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given combinations of filters", t, func() {
+		Convey("All should merge the conditions into a single binding", func() {
+			bindings, err := All(ByMessageType("build"), BySenderName("agent-git")).Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderType: "build", AmqpHeaderSenderName: "agent-git"}})
+		})
+
+		Convey("Any should produce one binding per condition", func() {
+			bindings, err := Any(ByMessageType("build"), ByMessageType("test")).Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{AmqpHeaderType: "build"}, {AmqpHeaderType: "test"}})
+		})
+
+		Convey("All should distribute over Any", func() {
+			bindings, err := All(Any(ByMessageType("build"), ByMessageType("test")), BySenderName("agent-git")).Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{
+				{AmqpHeaderType: "build", AmqpHeaderSenderName: "agent-git"},
+				{AmqpHeaderType: "test", AmqpHeaderSenderName: "agent-git"},
+			})
+		})
+
+		Convey("All without filter should match everything", func() {
+			bindings, err := All().Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{}})
+		})
+
+		Convey("Conditions which cannot be matched together should be rejected", func() {
+			_, err := All(ByMessageType("build"), ByMessageType("test")).Bindings()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Any without filter should be rejected", func() {
+			_, err := Any().Bindings()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Invalid filters should invalidate the combination", func() {
+			_, err := All(ByMessageType("build"), BySender("")).Bindings()
+			So(err, ShouldNotBeNil)
+
+			_, err = Any(ByMessageType("build"), BySender("")).Bindings()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Nil filters should be rejected", func() {
+			var filter *Filter
+
+			_, err := filter.Bindings()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid filter: nil")
+
+			_, err = All(ByMessageType("build"), nil).Bindings()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid filter: nil")
+
+			_, err = Any(nil, ByMessageType("build")).Bindings()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid filter: nil")
+		})
+	})
+
+	Convey("Given raw event filters", t, func() {
+		Convey("A filter without x-match should produce a single binding", func() {
+			bindings, err := FromEventFilter(EventFilter{"type": "build", "SenderName": "agent-git"}).Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{"type": "build", "SenderName": "agent-git"}})
+		})
+
+		Convey("A 'x-match: any' filter should produce one binding per entry", func() {
+			bindings, err := FromEventFilter(EventFilter{"x-match": "any", "type": "build", "SenderName": "agent-git"}).Bindings()
+			So(err, ShouldBeNil)
+			So(bindings, ShouldResemble, []map[string]interface{}{{"SenderName": "agent-git"}, {"type": "build"}})
+		})
+
+		Convey("A 'x-match: any' filter without any other entry should be rejected", func() {
+			_, err := FromEventFilter(EventFilter{"x-match": "any"}).Bindings()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "x-match 'any' without any header")
+		})
+
+		Convey("An unknown x-match value should be rejected", func() {
+			_, err := FromEventFilter(EventFilter{"x-match": "some", "type": "build"}).Bindings()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -12,4 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// The Go types of the messages of an agent and the code registering them can be generated from their schema files
+// with the schemagen command (see agentiface/schemagen), by adding to a file of the package of the messages:
+//
+//	//go:generate go run github.com/crucibuild/sdk-agent-go/agentiface/schemagen -o messages_gen.go schemas
+
 package agentiface
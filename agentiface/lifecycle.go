@@ -0,0 +1,40 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+// Hook is a function called at a stage of the lifecycle of an agent.
+type Hook func(agent Agent) error
+
+// Lifecycle is an interface which encapsulates the running of an agent, from its start to its shutdown.
+type Lifecycle interface {
+	// OnStart registers a hook called when the agent starts, once connected. The hooks are called in their
+	// registration order.
+	OnStart(hook Hook)
+
+	// OnConnected registers a hook called whenever the agent gets connected, including after a reconnection, once
+	// the callbacks registered before connecting are subscribed. An error returned by the hook is only logged.
+	OnConnected(hook Hook)
+
+	// OnStop registers a hook called when the agent is shut down, before it stops consuming messages.
+	// An error returned by the hook is only logged.
+	OnStop(hook Hook)
+
+	// Start connects the agent and calls the start hooks.
+	Start() error
+
+	// Run starts the agent and blocks until SIGINT or SIGTERM is received or the agent quits, then shuts the
+	// agent down gracefully.
+	Run() error
+}
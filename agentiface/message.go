@@ -14,6 +14,11 @@
 
 package agentiface
 
+import (
+	"context"
+	"fmt"
+)
+
 // State represent the current state of the agent state machine.
 type State int
 
@@ -27,17 +32,81 @@ const (
 	// StateDisconnected represent an agent state when disconnected.
 	StateDisconnected
 
+	// StateReconnecting represent an agent state when the connection has been lost and is being restored.
+	StateReconnecting
+
+	// StateConnecting represent an agent state when the connection is being established.
+	StateConnecting
+
+	// StateDraining represent an agent state when it is shutting down: it does not consume messages anymore and
+	// processes the ones in flight.
+	StateDraining
+
+	// StateFailed represent an agent state when the connection failed or has been lost and could not be restored.
+	StateFailed
+
+	// MessageSchemaGet is the name of the command answered by every agent with the definition of one of its schemas.
+	MessageSchemaGet = "schema:get"
+
+	// MessageSchemaDefinition is the name of the reply to MessageSchemaGet.
+	MessageSchemaDefinition = "schema:definition"
+
 	// ExchangeCommand is the name of the AMQP exchange used by the agent to send commands.
 	ExchangeCommand = "crucibuild.command"
 
 	// ExchangeEvent is the name of the AMQP exchange used by the agent to send events.
 	ExchangeEvent = "crucibuild.event"
 
+	// ExchangeDeadLetter is the name of the AMQP exchange receiving the messages which could not be processed.
+	ExchangeDeadLetter = "crucibuild.deadletter"
+
 	// MimeTypeAvro is the mime type used when sending AVRO schemas.
 	MimeTypeAvro = "application/vnd.apache.avro+binary"
 
+	// MimeTypeJSON is the mime type used when sending JSON messages.
+	MimeTypeJSON = "application/json"
+
 	// AmqpHeaderSendTo is the AMQP header SendTo used to force destination of a message.
 	AmqpHeaderSendTo = "SendTo"
+
+	// AmqpHeaderType is the AMQP header holding the type of a message (name of its schema).
+	AmqpHeaderType = "type"
+
+	// AmqpHeaderSchemaVersion is the AMQP header holding the version of the schema a message has been written with,
+	// as numbered by its sender. It is informational only: the writer schema is identified by the fingerprint.
+	AmqpHeaderSchemaVersion = "x-schema-version"
+
+	// AmqpHeaderSchemaFingerprint is the AMQP header holding the fingerprint of the exact revision of the schema a
+	// message has been written with (see FingerprintedSchema).
+	AmqpHeaderSchemaFingerprint = "x-schema-fingerprint"
+
+	// AmqpHeaderSenderID is the AMQP header holding the id of the agent which sent a message.
+	AmqpHeaderSenderID = "SenderId"
+
+	// AmqpHeaderSenderName is the AMQP header holding the name of the agent which sent a message.
+	AmqpHeaderSenderName = "SenderName"
+
+	// AmqpHeaderReplyTo is the AMQP header holding the address (see AmqpHeaderSendTo) the reply to a request is
+	// sent to, which is consumed apart from the commands.
+	AmqpHeaderReplyTo = "x-reply-to"
+
+	// AmqpHeaderCorrelationID is the AMQP header holding the id of the message a message is correlated to.
+	AmqpHeaderCorrelationID = "CorrelationId"
+
+	// AmqpHeaderTraceParent is the AMQP header holding the trace context of a message (W3C traceparent format).
+	AmqpHeaderTraceParent = "traceparent"
+
+	// AmqpHeaderCausationID is the AMQP header holding the id of the message which caused a message to be sent.
+	AmqpHeaderCausationID = "CausationId"
+
+	// AmqpHeaderRetryCount is the AMQP header holding the number of times a message has been retried.
+	AmqpHeaderRetryCount = "x-retry-count"
+
+	// AmqpHeaderError is the AMQP header holding the error of a message sent to the dead-letter exchange.
+	AmqpHeaderError = "x-error"
+
+	// AmqpHeaderQueue is the AMQP header holding the queue of a message sent to the dead-letter exchange.
+	AmqpHeaderQueue = "x-queue"
 )
 
 // MessageName is the type representing a command name.
@@ -46,8 +115,40 @@ type MessageName string
 // EventFilter is a type representing a filter on event messages.
 type EventFilter map[string]interface{}
 
-// StateCallback is a type of callback occurring on state changes.
-type StateCallback func(state State) error
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateConnecting:
+		return "connecting"
+	case StateDraining:
+		return "draining"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Transition is a change of state.
+type Transition struct {
+	// From is the state before the transition.
+	From State
+	// To is the state after the transition.
+	To State
+	// Cause is the error which caused the transition, if any (connection lost, connection failure, etc...).
+	Cause error
+}
+
+// StateCallback is a type of callback occurring on state changes. It is called before the transition takes effect.
+// An error returned on a transition to StateConnecting, StateConnected or StateDraining vetoes it: the connection or
+// the shutdown is aborted and the error is returned. Errors returned on other transitions are only logged.
+type StateCallback func(transition Transition) error
 
 // Ctx denotes a context when receiving a command or an event.
 // From this instance can be retrieved:
@@ -66,6 +167,10 @@ type Ctx interface {
 
 	// Properties returns the properties attached to the message.
 	Properties() map[string]string
+
+	// Context returns the context of the processing of the message, cancelled when the agent disconnects or when
+	// the message expires. It should be given to any long-running operation triggered by the message.
+	Context() context.Context
 }
 
 // EventCtx is a specialized Ctx which can trigger a command after receiving an event.
@@ -93,6 +198,9 @@ type CommandCallback func(ctx CommandCtx) error
 // EventCallback is a type of callback occurring on event reception.
 type EventCallback func(ctx EventCtx) error
 
+// OrderingKey returns the key of a received message: messages sharing the same key are processed in order.
+type OrderingKey func(envelope *Envelope) string
+
 // Messaging interface denotes the capability to send and receive messages and manage connection.
 type Messaging interface {
 	Connect() error
@@ -101,9 +209,48 @@ type Messaging interface {
 
 	RegisterStateCallback(stateCallback StateCallback) string
 
-	RegisterCommandCallback(commandName MessageName, commandCallback CommandCallback) (string, error)
+	// RegisterCommandCallback registers a callback triggered by a command reception. The given middlewares only wrap
+	// this callback, inside the middlewares registered with Use.
+	RegisterCommandCallback(commandName MessageName, commandCallback CommandCallback, middlewares ...Middleware) (string, error)
 
-	RegisterEventCallback(filter EventFilter, eventCallback EventCallback) (string, error)
+	// RegisterEventCallback registers a callback triggered by an event reception. The given middlewares only wrap
+	// this callback, inside the middlewares registered with Use.
+	RegisterEventCallback(filter EventFilter, eventCallback EventCallback, middlewares ...Middleware) (string, error)
+
+	// RegisterFilteredEventCallback registers a callback triggered by the reception of an event matching the filter
+	// (see Filter). The given middlewares only wrap this callback, inside the middlewares registered with Use.
+	// Callbacks can be registered before connecting: the events are subscribed to whenever the agent gets connected.
+	RegisterFilteredEventCallback(filter *Filter, eventCallback EventCallback, middlewares ...Middleware) (string, error)
+
+	// UnregisterCallback unregisters a callback given the id returned when registering it.
+	UnregisterCallback(id string) error
+
+	// PauseEventCallback stops receiving the events of an event callback until it is resumed.
+	PauseEventCallback(id string) error
+
+	// ResumeEventCallback starts receiving again the events of a paused event callback.
+	ResumeEventCallback(id string) error
 
 	SendCommand(to string, command interface{}) error
+
+	// Use adds middlewares wrapping the processing of all the received commands and events.
+	// The first middleware is the outermost one.
+	Use(middlewares ...Middleware)
+
+	// UsePublish adds middlewares wrapping the preparation of all the sent commands and events.
+	// The first middleware is the outermost one.
+	UsePublish(middlewares ...PublishMiddleware)
+
+	// Request sends a command to a specific agent and waits for the reply (a command which correlationId is the id
+	// of the request). A *RequestTimeoutError is returned if the deadline of ctx is exceeded.
+	Request(ctx context.Context, to string, command interface{}) (Ctx, error)
+
+	// RegisterCodec registers a codec serializing the messages in its content type, replacing the codec registered
+	// for the same content type. The messages are received in any content type for which a codec is registered.
+	RegisterCodec(codec Codec)
+
+	// PreferContentType sets the content type of the messages sent to an agent, when the codec of this content type
+	// supports their schema. By default, a message is sent in the content type of the first registered codec
+	// supporting its schema, or in the content type of the message it replies to.
+	PreferContentType(to string, contentType string) error
 }
@@ -0,0 +1,29 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+// Handler is a type of function processing a received message (command or event).
+type Handler func(ctx Ctx) error
+
+// Middleware wraps a Handler in order to add a behaviour around the processing of the received messages
+// (logging, panic recovery, timing, authorization...). It must call next to carry on the processing.
+type Middleware func(next Handler) Handler
+
+// Publisher is a type of function preparing the envelope of a message to send.
+type Publisher func(msg interface{}) (*Envelope, error)
+
+// PublishMiddleware wraps a Publisher in order to add a behaviour around the preparation of the sent messages.
+// It must call next to carry on the preparation.
+type PublishMiddleware func(next Publisher) Publisher
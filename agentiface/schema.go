@@ -14,6 +14,52 @@
 
 package agentiface
 
+import "fmt"
+
+// Compatibility is the level of compatibility required between the versions of a schema.
+type Compatibility int
+
+const (
+	// CompatibilityNone does not require any compatibility between versions.
+	CompatibilityNone Compatibility = iota
+
+	// CompatibilityBackward requires a version to read the data written with the previous version.
+	CompatibilityBackward
+
+	// CompatibilityForward requires the previous version to read the data written with a version.
+	CompatibilityForward
+
+	// CompatibilityFull requires both backward and forward compatibility.
+	CompatibilityFull
+)
+
+// String returns the name of the compatibility level.
+func (c Compatibility) String() string {
+	switch c {
+	case CompatibilityNone:
+		return "none"
+	case CompatibilityBackward:
+		return "backward"
+	case CompatibilityForward:
+		return "forward"
+	case CompatibilityFull:
+		return "full"
+	default:
+		return fmt.Sprintf("Compatibility(%d)", int(c))
+	}
+}
+
+// ParseCompatibility returns the compatibility level given its name (none, backward, forward or full).
+func ParseCompatibility(name string) (Compatibility, error) {
+	for _, c := range []Compatibility{CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+
+	return CompatibilityNone, fmt.Errorf("Unknown compatibility level '%s'", name)
+}
+
 // Schema represent a type of message for a schema based utility like AVRO.
 type Schema interface {
 	// Id returns the Unique identifier used to reference the schema.
@@ -31,15 +77,55 @@ type Schema interface {
 	Code(o interface{}) ([]byte, error)
 }
 
+// EvolvableSchema is implemented by the schemas supporting evolution: the data written with a version of the schema
+// can be read with another compatible version.
+type EvolvableSchema interface {
+	Schema
+
+	// CanRead returns nil if the data written with the writer schema can be read with this schema, or an error
+	// describing why it cannot.
+	CanRead(writer Schema) error
+	// WithWriter returns a schema decoding the data written with the writer schema into the types of this schema.
+	WithWriter(writer Schema) (Schema, error)
+}
+
+// FingerprintedSchema is implemented by the schemas identified by a fingerprint of their canonical form: two schemas
+// reading data the same way have the same fingerprint.
+type FingerprintedSchema interface {
+	Schema
+
+	// Fingerprint returns the fingerprint identifying the exact revision of the schema.
+	Fingerprint() string
+}
+
 // SchemaRegistry permits to register multiple schemas and manage them.
 type SchemaRegistry interface {
-	// SchemaRegister registers a new Schema in the registry.
+	// SchemaRegister registers a new Schema in the registry, unless another schema is registered with the same id,
+	// in which case ErrAlreadyRegistered is returned. Registering the same schema again does nothing.
 	SchemaRegister(schema Schema) (string, error)
-	// SchemaGetByID retrieve the Schema in the registry given its id.
+	// SchemaReplace registers a Schema in the registry, replacing the latest version of the schema registered with the
+	// same id if any.
+	SchemaReplace(schema Schema) (string, error)
+	// SchemaRegisterVersion registers a version of a Schema in the registry. The version must be compatible with the
+	// registered versions of the schema according to the compatibility level of the registry, otherwise
+	// ErrIncompatibleSchema is returned. A different schema already registered with the same version gives
+	// ErrAlreadyRegistered. SchemaRegister registers the version 1 of a schema.
+	SchemaRegisterVersion(schema Schema, version int) (string, error)
+	// SchemaCheckCompatibility checks that the next version of a schema is compatible with the previous one at the
+	// given compatibility level.
+	SchemaCheckCompatibility(previous Schema, next Schema, compatibility Compatibility) error
+	// SchemaGetByID retrieve the latest version of the Schema in the registry given its id.
 	SchemaGetByID(id string) (Schema, error)
+	// SchemaGetVersion retrieve a version of the Schema in the registry given its id.
+	SchemaGetVersion(id string, version int) (Schema, error)
+	// SchemaGetByFingerprint retrieve the Schema in the registry, whatever its version, given its fingerprint (see
+	// FingerprintedSchema).
+	SchemaGetByFingerprint(fingerprint string) (Schema, error)
+	// SchemaVersions lists the registered versions of a Schema, in ascending order.
+	SchemaVersions(id string) []int
 	// SchemaListNames list all the Schemas contained in the registry.
 	SchemaListIds() []string
-	// SchemaUnregister removes the schema from the registry.
+	// SchemaUnregister removes the schema from the registry, with all its versions.
 	SchemaUnregister(id string) error
 	// SchemaExist check if the given schema exists in the registry.
 	SchemaExist(id string) bool
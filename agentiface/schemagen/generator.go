@@ -0,0 +1,471 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/crucibuild/sdk-agent-go/agentimpl"
+)
+
+// goStruct is a Go struct generated from a schema.
+type goStruct struct {
+	Name   string
+	Doc    string
+	Fields []goField
+}
+
+// goField is a field of a generated Go struct.
+type goField struct {
+	Name string
+	Type string
+	Tag  string
+}
+
+// goMessage is a message whose schema and type are registered by the generated code.
+type goMessage struct {
+	// Const is the name of the constant holding the raw schema
+	Const string
+	Raw   string
+	Avro  bool
+	// Type is the name of the Go struct of the message, empty if the schema does not define a struct
+	Type string
+}
+
+// generator generates the Go code of the messages described by schemas.
+type generator struct {
+	pkg      string
+	structs  []goStruct
+	messages []goMessage
+	imports  map[string]bool
+
+	// names of the Go structs, by full name of the Avro named types
+	avroNames map[string]string
+	// names already used in the generated code
+	used map[string]bool
+}
+
+func newGenerator(pkg string) *generator {
+	return &generator{
+		pkg:       pkg,
+		imports:   make(map[string]bool),
+		avroNames: make(map[string]string),
+		used:      make(map[string]bool),
+	}
+}
+
+// add generates the Go structs of a schema. The schemas must be added in dependency order.
+func (g *generator) add(schema agentiface.Schema) error {
+	var definition interface{}
+
+	if err := json.Unmarshal([]byte(schema.Raw()), &definition); err != nil {
+		return err
+	}
+
+	message := goMessage{
+		Const: g.unique("schema" + goName(schema.ID())),
+		Raw:   schema.Raw(),
+	}
+
+	switch schema.MimeType() {
+	case agentimpl.MimeTypeAvroSchema:
+		message.Avro = true
+		t, err := g.avroType(definition, "")
+		if err != nil {
+			return fmt.Errorf("Schema '%s': %s", schema.ID(), err.Error())
+		}
+		if strings.HasPrefix(t, "*") && g.isStruct(t[1:]) {
+			message.Type = t[1:]
+		}
+	case agentimpl.MimeTypeJSONSchema:
+		object, ok := definition.(map[string]interface{})
+		if !ok || object["type"] != "object" {
+			return fmt.Errorf("Schema '%s': only objects are supported", schema.ID())
+		}
+		name := schema.Title()
+		if name == "" {
+			name = schema.ID()
+		}
+		message.Type = g.jsonStruct(goName(name), object)
+	default:
+		return fmt.Errorf("Schema '%s': unsupported mime type %s", schema.ID(), schema.MimeType())
+	}
+
+	g.messages = append(g.messages, message)
+
+	return nil
+}
+
+func (g *generator) isStruct(name string) bool {
+	for _, s := range g.structs {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unique returns a Go name not used yet in the generated code, based on name.
+func (g *generator) unique(name string) string {
+	candidate := name
+	for i := 2; g.used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+	g.used[candidate] = true
+
+	return candidate
+}
+
+// avroPrimitives are the Go types of the Avro primitive types.
+var avroPrimitives = map[string]string{
+	"null":    "interface{}",
+	"boolean": "bool",
+	"int":     "int32",
+	"long":    "int64",
+	"float":   "float32",
+	"double":  "float64",
+	"bytes":   "[]byte",
+	"string":  "string",
+}
+
+// avroType returns the Go type of an Avro type, generating the structs of the records it defines.
+func (g *generator) avroType(definition interface{}, namespace string) (string, error) {
+	switch d := definition.(type) {
+	case string:
+		if t, ok := avroPrimitives[d]; ok {
+			return t, nil
+		}
+		if t, ok := g.avroNames[avroFullName(d, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := g.avroNames[d]; ok {
+			return t, nil
+		}
+		return "", fmt.Errorf("Unknown type name: %s", d)
+	case []interface{}:
+		return g.avroUnion(d, namespace)
+	case map[string]interface{}:
+		switch d["type"] {
+		case "record", "error":
+			return g.avroRecord(d, namespace)
+		case "enum":
+			g.avroNamed(d, namespace, "*avro.GenericEnum")
+			g.imports["github.com/elodina/go-avro"] = true
+			return "*avro.GenericEnum", nil
+		case "fixed":
+			g.avroNamed(d, namespace, "[]byte")
+			return "[]byte", nil
+		case "array":
+			t, err := g.avroType(d["items"], namespace)
+			return "[]" + t, err
+		case "map":
+			t, err := g.avroType(d["values"], namespace)
+			return "map[string]" + t, err
+		default:
+			return g.avroType(d["type"], namespace)
+		}
+	default:
+		return "", fmt.Errorf("Invalid type: %v", definition)
+	}
+}
+
+// avroNamed registers the Go type of a named type (record, enum or fixed) and returns its namespace.
+func (g *generator) avroNamed(d map[string]interface{}, namespace string, t string) string {
+	name, _ := d["name"].(string)
+	if ns, ok := d["namespace"].(string); ok {
+		namespace = ns
+	}
+
+	g.avroNames[avroFullName(name, namespace)] = t
+
+	return namespace
+}
+
+// avroRecord generates the struct of an Avro record and returns its Go type (a pointer to the struct).
+func (g *generator) avroRecord(d map[string]interface{}, namespace string) (string, error) {
+	name, _ := d["name"].(string)
+
+	// the raw Avro schemas inline the records they depend on
+	ns := namespace
+	if n, ok := d["namespace"].(string); ok {
+		ns = n
+	}
+	if t, ok := g.avroNames[avroFullName(name, ns)]; ok {
+		return t, nil
+	}
+
+	s := goStruct{
+		Name: g.unique(goName(name)),
+	}
+	s.Doc, _ = d["doc"].(string)
+
+	// registered first, for the recursive records
+	namespace = g.avroNamed(d, namespace, "*"+s.Name)
+
+	fields, _ := d["fields"].([]interface{})
+	for _, field := range fields {
+		f, ok := field.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("Invalid field in record %s", name)
+		}
+
+		fieldName, _ := f["name"].(string)
+		t, err := g.avroType(f["type"], namespace)
+		if err != nil {
+			return "", err
+		}
+
+		s.Fields = append(s.Fields, goField{
+			Name: goName(fieldName),
+			Type: t,
+			Tag:  fmt.Sprintf("`avro:\"%s\" json:\"%s\"`", fieldName, fieldName),
+		})
+	}
+
+	g.structs = append(g.structs, s)
+
+	return "*" + s.Name, nil
+}
+
+// avroUnion returns the Go type of an Avro union: a pointer if the union is made of null and another type, an
+// empty interface otherwise.
+func (g *generator) avroUnion(types []interface{}, namespace string) (string, error) {
+	var others []string
+
+	for _, t := range types {
+		goType, err := g.avroType(t, namespace)
+		if err != nil {
+			return "", err
+		}
+		if t != "null" {
+			others = append(others, goType)
+		}
+	}
+
+	if len(others) == 1 && len(types) == 2 {
+		t := others[0]
+		if strings.HasPrefix(t, "*") || strings.HasPrefix(t, "[]") || strings.HasPrefix(t, "map[") || t == "interface{}" {
+			return t, nil
+		}
+		return "*" + t, nil
+	}
+
+	return "interface{}", nil
+}
+
+// jsonStruct generates the struct of a JSON schema object and returns its name.
+func (g *generator) jsonStruct(name string, object map[string]interface{}) string {
+	s := goStruct{
+		Name: g.unique(name),
+	}
+	s.Doc, _ = object["description"].(string)
+
+	required := make(map[string]bool)
+	if list, ok := object["required"].([]interface{}); ok {
+		for _, r := range list {
+			if r, ok := r.(string); ok {
+				required[r] = true
+			}
+		}
+	}
+
+	properties, _ := object["properties"].(map[string]interface{})
+
+	names := make([]string, 0, len(properties))
+	for property := range properties {
+		names = append(names, property)
+	}
+	sort.Strings(names)
+
+	for _, property := range names {
+		definition, _ := properties[property].(map[string]interface{})
+
+		tag := property
+		if !required[property] {
+			tag += ",omitempty"
+		}
+
+		s.Fields = append(s.Fields, goField{
+			Name: goName(property),
+			Type: g.jsonType(s.Name+goName(property), definition),
+			Tag:  fmt.Sprintf("`json:\"%s\"`", tag),
+		})
+	}
+
+	g.structs = append(g.structs, s)
+
+	return s.Name
+}
+
+// jsonType returns the Go type of a JSON schema, generating the structs of the objects it defines.
+func (g *generator) jsonType(name string, definition map[string]interface{}) string {
+	switch definition["type"] {
+	case "string":
+		return "string"
+	case "integer":
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		items, _ := definition["items"].(map[string]interface{})
+		return "[]" + g.jsonType(name+"Item", items)
+	case "object":
+		if _, ok := definition["properties"]; ok {
+			return "*" + g.jsonStruct(name, definition)
+		}
+		return "map[string]interface{}"
+	default:
+		return "interface{}"
+	}
+}
+
+// avroFullName returns the full name of an Avro named type given the enclosing namespace.
+func avroFullName(name string, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+
+	return namespace + "." + name
+}
+
+// initialisms are the words written in upper case in Go names.
+var initialisms = map[string]bool{
+	"API": true, "HTTP": true, "ID": true, "JSON": true, "URI": true, "URL": true, "UUID": true,
+}
+
+// goName returns an exported Go name from a schema name: "first_name", "first-name" and "firstName" give
+// "FirstName". The namespace of a full name is dropped.
+func goName(name string) string {
+	name = name[strings.LastIndex(name, ".")+1:]
+
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b bytes.Buffer
+	for _, word := range words {
+		if initialisms[strings.ToUpper(word)] {
+			b.WriteString(strings.ToUpper(word))
+			continue
+		}
+		runes := []rune(word)
+		b.WriteRune(unicode.ToUpper(runes[0]))
+		b.WriteString(string(runes[1:]))
+	}
+
+	if b.Len() == 0 || unicode.IsDigit([]rune(b.String())[0]) {
+		return "X" + b.String()
+	}
+
+	return b.String()
+}
+
+var codeTemplate = template.Must(template.New("code").Parse(`// Code generated by schemagen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+)
+{{range .Structs}}
+// {{.Name}} is a message struct generated from its schema.
+{{- if .Doc}}
+//
+// {{.Doc}}
+{{- end}}
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} {{.Tag}}
+{{- end}}
+}
+{{end}}
+{{range .Messages}}
+const {{.Const}} = {{printf "%q" .Raw}}
+{{end}}
+// RegisterMessages registers the schemas of the messages and their types in the registries of the agent.
+func RegisterMessages(a agentiface.Agent) error {
+	var schema agentiface.Schema
+	var err error
+{{range .Messages}}
+	{{if .Avro}}schema, err = agentimpl.LoadAvroSchema({{.Const}}, a){{else}}schema, err = agentimpl.LoadJSONSchema({{.Const}}){{end}}
+	if err != nil {
+		return err
+	}
+	if err = registerMessage(a, schema, {{if .Type}}{{.Type}}{}{{else}}nil{{end}}); err != nil {
+		return err
+	}
+{{end}}
+	return nil
+}
+
+// registerMessage registers the schema of a message and its type (if any).
+func registerMessage(a agentiface.Agent, schema agentiface.Schema, message interface{}) error {
+	if _, err := a.SchemaRegister(schema); err != nil {
+		return err
+	}
+
+	if message == nil {
+		return nil
+	}
+
+	t, err := agentimpl.NewTypeFromInterface(schema.ID(), message)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.TypeRegister(t)
+
+	return err
+}
+`))
+
+// generate returns the formatted Go code of the added schemas.
+func (g *generator) generate() ([]byte, error) {
+	g.imports["github.com/crucibuild/sdk-agent-go/agentiface"] = true
+	g.imports["github.com/crucibuild/sdk-agent-go/agentimpl"] = true
+
+	imports := make([]string, 0, len(g.imports))
+	for i := range g.imports {
+		imports = append(imports, i)
+	}
+	sort.Strings(imports)
+
+	var b bytes.Buffer
+
+	err := codeTemplate.Execute(&b, map[string]interface{}{
+		"Package":  g.pkg,
+		"Imports":  imports,
+		"Structs":  g.structs,
+		"Messages": g.messages,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var schemaFiles = map[string]string{
+	"order.avsc": `{
+		"type": "record",
+		"name": "Order",
+		"namespace": "shop",
+		"doc": "An order of a customer.",
+		"fields": [
+			{"name": "order_id", "type": "string"},
+			{"name": "customer", "type": "Customer"},
+			{"name": "lines", "type": {"type": "array", "items": {
+				"type": "record", "name": "Line", "fields": [
+					{"name": "quantity", "type": "int"},
+					{"name": "price", "type": "double"}
+				]
+			}}},
+			{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "SHIPPED"]}}
+		]
+	}`,
+	"customer.avsc": `{
+		"type": "record",
+		"name": "Customer",
+		"namespace": "shop",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": ["null", "long"]},
+			{"name": "tags", "type": {"type": "map", "values": "string"}}
+		]
+	}`,
+	"person.json": `{
+		"id": "person",
+		"title": "Person",
+		"type": "object",
+		"properties": {
+			"firstName": {"type": "string"},
+			"age": {"type": "integer"},
+			"address": {"type": "object", "properties": {"city": {"type": "string"}}}
+		},
+		"required": ["firstName"]
+	}`,
+}
+
+// normalize removes the spaces of code, so that it does not depend on its alignment.
+func normalize(code string) string {
+	return strings.Join(strings.Fields(code), " ")
+}
+
+func TestGenerate(t *testing.T) {
+	Convey("Given a directory holding Avro and JSON schema files", t, func() {
+		dir, err := ioutil.TempDir("", "schemagen")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck, temporary directory
+
+		for name, content := range schemaFiles {
+			So(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), ShouldBeNil)
+		}
+
+		Convey("When the code is generated", func() {
+			code, err := generate("messages", []string{dir})
+
+			Convey("Then it is valid Go code", func() {
+				So(err, ShouldBeNil)
+
+				_, err := parser.ParseFile(token.NewFileSet(), "messages_gen.go", code, parser.ParseComments)
+				So(err, ShouldBeNil)
+				So(string(code), ShouldStartWith, "// Code generated by schemagen. DO NOT EDIT.\n\npackage messages\n")
+			})
+
+			Convey("Then the Avro records are generated as tagged structs", func() {
+				source := normalize(string(code))
+
+				So(source, ShouldContainSubstring, "// Order is a message struct generated from its schema. // // An order of a customer. type Order struct {")
+				So(source, ShouldContainSubstring, "OrderID string `avro:\"order_id\" json:\"order_id\"`")
+				So(source, ShouldContainSubstring, "Customer *Customer `avro:\"customer\" json:\"customer\"`")
+				So(source, ShouldContainSubstring, "Lines []*Line `avro:\"lines\" json:\"lines\"`")
+				So(source, ShouldContainSubstring, "Status *avro.GenericEnum `avro:\"status\" json:\"status\"`")
+				So(source, ShouldContainSubstring, "type Line struct { Quantity int32 `avro:\"quantity\" json:\"quantity\"` Price float64")
+				So(source, ShouldContainSubstring, "Age *int64 `avro:\"age\" json:\"age\"`")
+				So(source, ShouldContainSubstring, "Tags map[string]string `avro:\"tags\" json:\"tags\"`")
+			})
+
+			Convey("Then the JSON objects are generated as tagged structs", func() {
+				source := normalize(string(code))
+
+				So(source, ShouldContainSubstring, "Address *PersonAddress `json:\"address,omitempty\"`")
+				So(source, ShouldContainSubstring, "Age int `json:\"age,omitempty\"`")
+				So(source, ShouldContainSubstring, "FirstName string `json:\"firstName\"`")
+				So(source, ShouldContainSubstring, "type PersonAddress struct { City string `json:\"city,omitempty\"` }")
+			})
+
+			Convey("Then the schemas and the types are registered in dependency order", func() {
+				source := normalize(string(code))
+
+				customer := strings.Index(source, "registerMessage(a, schema, Customer{})")
+				order := strings.Index(source, "registerMessage(a, schema, Order{})")
+				So(customer, ShouldBeGreaterThan, 0)
+				So(order, ShouldBeGreaterThan, customer)
+				So(source, ShouldContainSubstring, "registerMessage(a, schema, Person{})")
+				So(source, ShouldContainSubstring, "agentimpl.LoadJSONSchema(schemaPerson)")
+			})
+		})
+
+		Convey("When a schema cannot be loaded", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "broken.avsc"), []byte(`{"type": "record",`), 0644), ShouldBeNil)
+
+			_, err := generate("messages", []string{dir})
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestGoName(t *testing.T) {
+	Convey("Given schema names", t, func() {
+		names := map[string]string{
+			"firstName":   "FirstName",
+			"first_name":  "FirstName",
+			"first-name":  "FirstName",
+			"shop.Order":  "Order",
+			"order_id":    "OrderID",
+			"url":         "URL",
+			"2fa":         "X2fa",
+			"CustomerURL": "CustomerURL",
+		}
+
+		Convey("Then they are converted to exported Go names", func() {
+			for name, expected := range names {
+				So(goName(name), ShouldEqual, expected)
+			}
+		})
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command schemagen generates Go types from Avro (.avsc) and JSON Schema (.json) files, along with a
+// RegisterMessages function registering both the schemas and the types in an agent in one call.
+//
+// It is meant to be run by go generate:
+//
+//	//go:generate go run github.com/crucibuild/sdk-agent-go/agentiface/schemagen -o messages_gen.go schemas
+//
+// The schemas of the given directories are loaded as the agent would load them (see agentimpl.LoadSchemasFromDir),
+// so the references between Avro schemas are resolved whatever the order of the files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/crucibuild/sdk-agent-go/agentimpl"
+)
+
+func main() {
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "name of the package of the generated code (defaults to $GOPACKAGE)")
+	out := flag.String("o", "schemas_gen.go", "file the generated code is written to")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: schemagen [flags] dir...\n") // nolint: errcheck, nothing to do
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *pkg == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	code, err := generate(*pkg, flag.Args())
+	if err == nil {
+		err = ioutil.WriteFile(*out, code, 0644)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schemagen: %s\n", err.Error()) // nolint: errcheck, nothing to do
+		os.Exit(1)
+	}
+}
+
+// generate returns the Go code of the schemas of the given directories.
+func generate(pkg string, dirs []string) ([]byte, error) {
+	registry := agentimpl.NewSchemaRegistry(nil)
+	g := newGenerator(pkg)
+
+	for _, dir := range dirs {
+		schemas, err := agentimpl.LoadSchemasFromDir(dir, registry)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, schema := range schemas {
+			if err := g.add(schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return g.generate()
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+import "time"
+
+// SpanKind denotes the operation traced by a span.
+type SpanKind string
+
+const (
+	// SpanKindPublish is the kind of the spans tracing the sending of a message.
+	SpanKindPublish SpanKind = "publish"
+
+	// SpanKindProcess is the kind of the spans tracing the processing of a received message.
+	SpanKindProcess SpanKind = "process"
+)
+
+// Span is a traced operation of an agent. All the spans triggered, directly or not, by the same message
+// share the same trace id.
+type Span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+
+	Kind SpanKind `json:"kind"`
+	// Name is the type of the message.
+	Name string `json:"name"`
+	// Agent is the id of the agent which performed the operation.
+	Agent string `json:"agent"`
+
+	MessageID     string `json:"messageId"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	CausationID   string `json:"causationId,omitempty"`
+
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// SpanExporter is the abstraction of a backend collecting the spans of an agent.
+type SpanExporter interface {
+	// ExportSpan records a finished span.
+	ExportSpan(span *Span) error
+}
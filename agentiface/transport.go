@@ -0,0 +1,120 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentiface
+
+import "time"
+
+// Destination denotes the bus on which a message is published.
+type Destination int
+
+const (
+	// DestinationCommand is the bus of commands (ExchangeCommand with AMQP).
+	DestinationCommand Destination = iota + 1
+
+	// DestinationEvent is the bus of events (ExchangeEvent with AMQP).
+	DestinationEvent
+
+	// DestinationDeadLetter is the bus of the messages which could not be processed (ExchangeDeadLetter with AMQP).
+	DestinationDeadLetter
+)
+
+// Acknowledger settles an envelope received through a subscription in manual acknowledgement mode.
+type Acknowledger interface {
+	// Ack tells the broker the envelope has been processed.
+	Ack() error
+	// Reject tells the broker the envelope has not been processed. If requeue is true, it is delivered again.
+	Reject(requeue bool) error
+}
+
+// Envelope is a raw message with its properties, as carried by a Transport.
+type Envelope struct {
+	// Destination is the bus the message has been published on.
+	Destination Destination
+
+	ContentType     string
+	ContentEncoding string
+	CorrelationID   string
+	ReplyTo         string
+	Expiration      string
+	MessageID       string
+	Timestamp       time.Time
+	Type            string
+	UserID          string
+	AppID           string
+
+	// Headers are used to route the message (see Subscription).
+	Headers map[string]interface{}
+
+	// Body is the serialized message.
+	Body []byte
+
+	// Mandatory is true if publishing the message must fail with ErrUnroutable when it cannot be routed to any queue.
+	Mandatory bool
+
+	// Queue is the name of the queue the envelope has been received from.
+	Queue string
+
+	// Acknowledger settles the envelope. It is nil if the subscription acknowledges automatically.
+	Acknowledger Acknowledger
+}
+
+// Subscription describes which messages of a bus are received.
+type Subscription struct {
+	// Destination is the bus the subscription listens to.
+	Destination Destination
+
+	// Queue is the name of the queue holding the messages. Subscriptions sharing the same queue
+	// (possibly across agents) compete for the messages. If empty, a private queue is created.
+	Queue string
+
+	// Exclusive is true if the queue is only used by this subscription and is deleted with it.
+	Exclusive bool
+
+	// Filters is a list of header filters: a message is received if its headers match at least one of them.
+	// The special key "x-match" ("all" by default or "any") sets how the headers of a filter are matched.
+	Filters []map[string]interface{}
+
+	// ManualAck is true if the received envelopes must be settled through their Acknowledger.
+	ManualAck bool
+}
+
+// EnvelopeHandler is a type of callback occurring on envelope reception.
+type EnvelopeHandler func(envelope *Envelope)
+
+// Transport is the abstraction of the message broker used by Messaging.
+type Transport interface {
+	// Connect connects to the broker. The transitions of the transport (to StateConnected, StateReconnecting,
+	// StateDisconnected or StateFailed) are reported to stateCallback, whose errors are ignored.
+	Connect(stateCallback StateCallback) error
+	// Disconnect disconnects from the broker and drops all the subscriptions.
+	Disconnect() error
+	// State returns the state of the connection.
+	State() State
+
+	// Subscribe starts receiving the messages described by subscription. It returns the id of the subscription.
+	Subscribe(subscription Subscription, handler EnvelopeHandler) (string, error)
+	// Unsubscribe stops receiving the messages of a subscription. The queue is deleted if exclusive.
+	Unsubscribe(id string) error
+	// Pause stops receiving the messages of a subscription, which are kept in its queue until Resume is called.
+	Pause(id string) error
+	// Resume starts receiving again the messages of a paused subscription.
+	Resume(id string) error
+
+	// Publish sends an envelope on the given bus.
+	Publish(destination Destination, envelope *Envelope) error
+
+	// PublishToQueue sends an envelope directly to a queue, bypassing the routing of the buses.
+	PublishToQueue(queue string, envelope *Envelope) error
+}
@@ -27,8 +27,12 @@ type Type interface {
 // TypeRegistry is a registry for types.
 // It enables us to register multiple Types and manage them with it.
 type TypeRegistry interface {
-	// TypeRegister registers a new Type in the registry.
+	// TypeRegister registers a new Type in the registry, unless its name or its reflection type is already registered
+	// with another Type, in which case ErrAlreadyRegistered is returned. Registering the same Type again does nothing.
 	TypeRegister(t Type) (string, error)
+	// TypeReplace registers a Type in the registry, replacing the Types registered with the same name or the same
+	// reflection type if any.
+	TypeReplace(t Type) (string, error)
 	// TypeGetByName retrieve the Type in the registry given its key.
 	TypeGetByName(key string) (Type, error)
 	// TypeGetByType retrieve the type in the registry given its type.
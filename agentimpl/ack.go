@@ -0,0 +1,191 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// configuration keys of the acknowledgement mode and of the retry policy
+const (
+	configAckMode              = "ack.mode"
+	configRetryMaxAttempts     = "retry.max-attempts"
+	configRetryInitialInterval = "retry.initial-interval"
+	configRetryMaxInterval     = "retry.max-interval"
+	configRetryMultiplier      = "retry.multiplier"
+	configRetryJitter          = "retry.jitter"
+)
+
+// acknowledgement modes
+const (
+	// messages are acknowledged on reception and lost if their processing fails
+	ackModeAuto = "auto"
+	// messages are acknowledged once processed, retried if their processing fails and eventually dead-lettered
+	ackModeManual = "manual"
+)
+
+// setDefaultAckOptions sets the default values of the acknowledgement configuration.
+func setDefaultAckOptions(a *Agent) {
+	a.SetDefaultConfigOption(configAckMode, ackModeAuto)
+	a.SetDefaultConfigOption(configRetryMaxAttempts, 3)
+	a.SetDefaultConfigOption(configRetryInitialInterval, "1s")
+	a.SetDefaultConfigOption(configRetryMaxInterval, "30s")
+	a.SetDefaultConfigOption(configRetryMultiplier, 2.0)
+	a.SetDefaultConfigOption(configRetryJitter, 0.2)
+}
+
+// manualAck returns true if the messages are acknowledged once processed.
+func (m *Messaging) manualAck() bool {
+	return m.agent.GetConfigString(configAckMode) == ackModeManual
+}
+
+// settle acknowledges an envelope according to the result of its processing:
+// - if the processing succeeded, the envelope is acknowledged
+// - if it failed, the envelope is sent again to its queue after a delay, with its retry count header incremented
+// - once the retries are exhausted, the envelope is sent to the dead-letter exchange with the error in a header
+// Nothing is done for envelopes acknowledged automatically and the error of the processing is returned as is.
+// The retries are delivered at least once: a message may be processed again if it is delivered again before its
+// retry is acknowledged, so the callbacks must be idempotent.
+func (m *Messaging) settle(e *agentiface.Envelope, err error) error {
+	if e.Acknowledger == nil {
+		return err
+	}
+
+	if err == nil {
+		return e.Acknowledger.Ack()
+	}
+
+	retries := headerInt(e.Headers, agentiface.AmqpHeaderRetryCount)
+
+	if retries < m.agent.GetConfigInt(configRetryMaxAttempts) {
+		m.agent.Warning("Failed to process message '%s' (attempt %d), retrying: %s", e.MessageID, retries+1, err.Error())
+		m.retry(e, retries)
+		return nil
+	}
+
+	if dlErr := m.deadLetter(e, err); dlErr != nil {
+		// keep the message in its queue rather than losing it
+		e.Acknowledger.Reject(true) // nolint: errcheck, the broker delivers the message again anyway if the channel is broken
+		return errors.Wrapf(dlErr, "Failed to dead-letter message '%s'", e.MessageID)
+	}
+
+	if ackErr := e.Acknowledger.Ack(); ackErr != nil {
+		m.agent.Warning("%s", ackErr.Error())
+	}
+
+	return errors.Wrapf(err, "Message '%s' dead-lettered after %d retries", e.MessageID, retries)
+}
+
+// retry sends the envelope again to its queue once the backoff delay of the given retry has elapsed.
+// The original envelope is only acknowledged when its copy has been sent, so that a message is never lost: if the
+// original cannot be acknowledged anymore (e.g. its channel has been closed meanwhile), the broker delivers it again
+// beside its copy and the message is processed twice.
+func (m *Messaging) retry(e *agentiface.Envelope, retries int) {
+	backoff := &Backoff{
+		InitialInterval: m.agent.GetConfigDuration(configRetryInitialInterval),
+		MaxInterval:     m.agent.GetConfigDuration(configRetryMaxInterval),
+		Multiplier:      m.agent.GetConfigFloat64(configRetryMultiplier),
+		Jitter:          m.agent.GetConfigFloat64(configRetryJitter),
+	}
+
+	var timer *time.Timer
+
+	publish := func() {
+		retry := *e
+		retry.Headers = copyHeaders(e.Headers)
+		retry.Headers[agentiface.AmqpHeaderRetryCount] = retries + 1
+
+		if err := m.transport.PublishToQueue(e.Queue, &retry); err != nil {
+			m.agent.Warning("Failed to retry message '%s': %s", e.MessageID, err.Error())
+			e.Acknowledger.Reject(true) // nolint: errcheck, the broker delivers the message again anyway if the channel is broken
+			return
+		}
+
+		if err := e.Acknowledger.Ack(); err != nil {
+			m.agent.Warning("Message '%s' retried but not acknowledged, it may be processed twice: %s", e.MessageID, err.Error())
+		}
+	}
+
+	// the retry is published either by its timer or by flushRetries, whichever removes it first
+	m.mutex.Lock()
+	timer = time.AfterFunc(backoff.Duration(retries), func() {
+		m.mutex.Lock()
+		_, pending := m.pendingRetries[timer]
+		delete(m.pendingRetries, timer)
+		m.mutex.Unlock()
+
+		if pending {
+			publish()
+		}
+	})
+	m.pendingRetries[timer] = publish
+	m.mutex.Unlock()
+}
+
+// flushRetries publishes immediately the retries still waiting for their backoff delay to elapse.
+func (m *Messaging) flushRetries() {
+	m.mutex.Lock()
+	retries := m.pendingRetries
+	m.pendingRetries = make(map[*time.Timer]func())
+	m.mutex.Unlock()
+
+	for timer, publish := range retries {
+		timer.Stop()
+		publish()
+	}
+}
+
+// deadLetter sends a copy of the envelope to the dead-letter exchange, with the error and the queue in its headers.
+func (m *Messaging) deadLetter(e *agentiface.Envelope, cause error) error {
+	deadLetter := *e
+	deadLetter.Headers = copyHeaders(e.Headers)
+	deadLetter.Headers[agentiface.AmqpHeaderError] = cause.Error()
+	deadLetter.Headers[agentiface.AmqpHeaderQueue] = e.Queue
+
+	return m.transport.Publish(agentiface.DestinationDeadLetter, &deadLetter)
+}
+
+// copyHeaders returns a shallow copy of the headers of a message.
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(headers)+1)
+
+	for k, v := range headers {
+		c[k] = v
+	}
+
+	return c
+}
+
+// headerInt returns the value of an integer header, whatever the size the broker decoded it with, or 0.
+func headerInt(headers map[string]interface{}, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	default:
+		return 0
+	}
+}
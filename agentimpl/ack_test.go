@@ -0,0 +1,143 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeaderInt(t *testing.T) {
+	Convey("Given headers decoded by a broker", t, func() {
+		headers := map[string]interface{}{
+			"int":    3,
+			"int8":   int8(3),
+			"int16":  int16(3),
+			"int32":  int32(3),
+			"int64":  int64(3),
+			"string": "3",
+		}
+
+		Convey("Integer headers should be read whatever their size", func() {
+			for _, key := range []string{"int", "int8", "int16", "int32", "int64"} {
+				So(headerInt(headers, key), ShouldEqual, 3)
+			}
+		})
+
+		Convey("Other headers should be read as 0", func() {
+			So(headerInt(headers, "string"), ShouldEqual, 0)
+			So(headerInt(headers, "missing"), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestManualAck(t *testing.T) {
+	Convey("Given an agent acknowledging commands manually", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+			configAckMode:              ackModeManual,
+			configRetryMaxAttempts:     2,
+			configRetryInitialInterval: "1ms",
+			configRetryJitter:          0,
+		})
+
+		// observes the dead-letter exchange
+		observer := broker.NewTransport()
+		So(observer.Connect(nil), ShouldBeNil)
+
+		deadLetters := make(chan *agentiface.Envelope, 1)
+		_, err := observer.Subscribe(agentiface.Subscription{
+			Destination: agentiface.DestinationDeadLetter,
+			Exclusive:   true,
+			Filters:     []map[string]interface{}{{}},
+		}, func(e *agentiface.Envelope) {
+			deadLetters <- e
+		})
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+			observer.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the callback fails once before succeeding", func() {
+			var calls int32
+			done := make(chan struct{})
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					return fmt.Errorf("temporary failure")
+				}
+				close(done)
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The command should be retried", func() {
+				select {
+				case <-done:
+				case <-time.After(receiveTimeout):
+				}
+				So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+			})
+
+			Convey("The command should not be dead-lettered", func() {
+				select {
+				case <-done:
+				case <-time.After(receiveTimeout):
+				}
+
+				select {
+				case <-deadLetters:
+					So("command dead-lettered", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+			})
+		})
+
+		Convey("When the callback always fails", func() {
+			var calls int32
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				atomic.AddInt32(&calls, 1)
+				return fmt.Errorf("permanent failure")
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The command should be dead-lettered once the retries are exhausted", func() {
+				select {
+				case e := <-deadLetters:
+					So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+					So(e.Type, ShouldEqual, schemaID)
+					So(e.Headers[agentiface.AmqpHeaderError], ShouldEqual, "permanent failure")
+					So(e.Headers[agentiface.AmqpHeaderQueue], ShouldEqual, "receiver")
+					So(headerInt(e.Headers, agentiface.AmqpHeaderRetryCount), ShouldEqual, 2)
+				case <-time.After(receiveTimeout):
+					So("command not dead-lettered", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
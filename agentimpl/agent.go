@@ -16,6 +16,7 @@ package agentimpl
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cespare/wait"
@@ -37,15 +38,35 @@ type Agent struct {
 	*Config
 	*SchemaRegistry
 	*TypeRegistry
-	*AMQP
+	*Messaging
 	*Logger
 
-	id       string
-	manifest agentiface.Manifest
+	id           string
+	manifest     agentiface.Manifest
+	transport    agentiface.Transport
+	orderingKey  agentiface.OrderingKey
+	spanExporter agentiface.SpanExporter
+
+	// hooks called at the stages of the lifecycle of the agent
+	hooksMutex     sync.Mutex
+	startHooks     []agentiface.Hook
+	connectedHooks []agentiface.Hook
+	stopHooks      []agentiface.Hook
+}
+
+// Option is a function customizing an agent when it is created.
+type Option func(agent *Agent) error
+
+// WithTransport makes the agent exchange messages through the given transport instead of AMQP.
+func WithTransport(transport agentiface.Transport) Option {
+	return func(agent *Agent) error {
+		agent.transport = transport
+		return nil
+	}
 }
 
 // NewAgent creates a new Agent instance from a spec.
-func NewAgent(manifest agentiface.Manifest) (agent *Agent, err error) {
+func NewAgent(manifest agentiface.Manifest, options ...Option) (agent *Agent, err error) {
 	agent = &Agent{
 		id: fmt.Sprintf("%s@%s#%d", manifest.Name(), util.Host(), time.Now().UnixNano()),
 	}
@@ -58,13 +79,29 @@ func NewAgent(manifest agentiface.Manifest) (agent *Agent, err error) {
 	agent.Config = NewConfig(agent)
 	agent.SchemaRegistry = NewSchemaRegistry(agent)
 	agent.TypeRegistry = NewTypeRegistry(agent)
-	agent.AMQP = NewAMQP(agent)
+
+	for _, option := range options {
+		if err = option(agent); err != nil {
+			return
+		}
+	}
+
+	if agent.transport == nil {
+		agent.transport = NewAMQP(agent)
+	}
+	agent.Messaging = NewMessaging(agent, agent.transport)
+
+	if err = registerSchemaDiscovery(agent); err != nil {
+		return
+	}
 
 	// register default commands
 	cmd.RegisterCmdConfig(agent)
 	cmd.RegisterCmdAgent(agent)
 	cmd.RegisterCmdManifest(agent)
-	cmd.RegisterCmdSchema(agent)
+	cmd.RegisterCmdSchema(agent, func(file string) (agentiface.Schema, error) {
+		return LoadSchemaFile(file, agent)
+	})
 
 	return
 }
@@ -13,3 +13,521 @@
 // limitations under the License.
 
 package agentimpl
+
+import (
+	"context"
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// receiveTimeout is the maximum time a test waits for a message.
+const receiveTimeout = 5 * time.Second
+
+// newTestAgent creates an agent connected to a loopback broker and knowing the person schema.
+// The given configuration options are set before connecting.
+func newTestAgent(broker *LoopbackBroker, name string, config map[string]interface{}, options ...Option) *Agent {
+	agent := newDisconnectedTestAgent(broker, name, config, options...)
+
+	So(agent.Connect(), ShouldBeNil)
+
+	return agent
+}
+
+func newDisconnectedTestAgent(broker *LoopbackBroker, name string, config map[string]interface{}, options ...Option) *Agent {
+	agent, err := NewAgent(NewManifest(map[string]interface{}{
+		"name":        name,
+		"description": fmt.Sprintf("%s test agent", name),
+		"version":     AgentVersion,
+	}), append([]Option{WithTransport(broker.NewTransport())}, options...)...)
+	So(err, ShouldBeNil)
+
+	schema, err := LoadJSONSchema(personSchema)
+	So(err, ShouldBeNil)
+
+	_, err = agent.SchemaRegister(schema)
+	So(err, ShouldBeNil)
+
+	_, err = agent.TypeRegister(NewTypeFromType(schemaID, personType.Type()))
+	So(err, ShouldBeNil)
+
+	for key, value := range config {
+		agent.SetDefaultConfigOption(key, value)
+	}
+
+	return agent
+}
+
+func TestAgentsOverLoopback(t *testing.T) {
+	Convey("Given two agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the receiver replies to a command with an event", func() {
+			commands := make(chan agentiface.CommandCtx, 1)
+			events := make(chan agentiface.EventCtx, 1)
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				commands <- ctx
+				return ctx.SendEvent(ctx.Message())
+			})
+			So(err, ShouldBeNil)
+
+			_, err = sender.RegisterEventCallback(agentiface.EventFilter{"type": schemaID}, func(ctx agentiface.EventCtx) error {
+				events <- ctx
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			Convey("And the sender sends a command to the receiver", func() {
+				err := sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74})
+				So(err, ShouldBeNil)
+
+				Convey("The receiver should receive the command", func() {
+					select {
+					case ctx := <-commands:
+						So(ctx.Message(), ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 74})
+						So(ctx.Properties()["ReplyTo"], ShouldEqual, sender.ID())
+					case <-time.After(receiveTimeout):
+						So("command not received", ShouldBeEmpty)
+					}
+				})
+
+				Convey("The sender should receive the event correlated to its command", func() {
+					select {
+					case ctx := <-events:
+						So(ctx.Message(), ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 74})
+						So(ctx.Properties()["CorrelationId"], ShouldNotBeEmpty)
+						So(ctx.Properties()["ReplyTo"], ShouldEqual, receiver.ID())
+					case <-time.After(receiveTimeout):
+						So("event not received", ShouldBeEmpty)
+					}
+				})
+			})
+		})
+
+		Convey("When the receiver replies to commands with a command", func() {
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				p := ctx.Message().(*person)
+				p.Age++
+				return ctx.SendCommand("", p)
+			})
+			So(err, ShouldBeNil)
+
+			Convey("And the sender sends a request to the receiver", func() {
+				reply, err := sender.Request(context.Background(), "receiver", &person{FirstName: "john", LastName: "doe", Age: 74})
+
+				Convey("No error should occur", func() {
+					So(err, ShouldBeNil)
+				})
+
+				Convey("The reply should be received", func() {
+					So(reply.Message(), ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 75})
+				})
+			})
+		})
+
+		Convey("When the sender sends a request to an agent which does not answer", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			_, err := sender.Request(ctx, "nobody", &person{FirstName: "john", LastName: "doe", Age: 74})
+
+			Convey("A timeout error should occur", func() {
+				So(err, ShouldHaveSameTypeAs, &agentiface.RequestTimeoutError{})
+			})
+		})
+	})
+}
+
+func TestCallbackUnregistration(t *testing.T) {
+	Convey("Given an agent listening to the events of another agent", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			return ctx.SendEvent(ctx.Message())
+		})
+		So(err, ShouldBeNil)
+
+		events := make(chan agentiface.EventCtx, 2)
+		id, err := sender.RegisterEventCallback(agentiface.EventFilter{"type": schemaID}, func(ctx agentiface.EventCtx) error {
+			events <- ctx
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the event callback is unregistered", func() {
+			So(sender.UnregisterCallback(id), ShouldBeNil)
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("No event should be received", func() {
+				select {
+				case <-events:
+					So("event received", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+			})
+
+			Convey("Unregistering it again should fail", func() {
+				So(sender.UnregisterCallback(id), ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the event callback is paused", func() {
+			So(sender.PauseEventCallback(id), ShouldBeNil)
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("No event should be received", func() {
+				select {
+				case <-events:
+					So("event received", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+			})
+
+			Convey("The event should be received once resumed", func() {
+				So(sender.ResumeEventCallback(id), ShouldBeNil)
+
+				select {
+				case ctx := <-events:
+					So(ctx.Message(), ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 74})
+				case <-time.After(receiveTimeout):
+					So("event not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When a command callback is unregistered", func() {
+			So(receiver.UnregisterCallback(schemaID), ShouldBeNil)
+
+			Convey("A request should not be answered", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+
+				_, err := sender.Request(ctx, "receiver", &person{FirstName: "john", LastName: "doe", Age: 74})
+				So(err, ShouldHaveSameTypeAs, &agentiface.RequestTimeoutError{})
+			})
+		})
+	})
+}
+
+func TestMessageContext(t *testing.T) {
+	Convey("Given two agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		contexts := make(chan context.Context, 1)
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			contexts <- ctx.Context()
+			<-ctx.Context().Done()
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the sender sends a request with a timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			sender.Request(ctx, "receiver", &person{FirstName: "john", LastName: "doe", Age: 74}) // nolint: errcheck
+
+			Convey("The context of the command should expire", func() {
+				select {
+				case c := <-contexts:
+					deadline, ok := c.Deadline()
+					So(ok, ShouldBeTrue)
+					So(deadline, ShouldHappenWithin, 200*time.Millisecond, time.Now())
+
+					select {
+					case <-c.Done():
+						So(c.Err() == context.DeadlineExceeded, ShouldBeTrue)
+					case <-time.After(receiveTimeout):
+						So("context not expired", ShouldBeEmpty)
+					}
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the sender sends a command", func() {
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The context of the command should be cancelled when the receiver disconnects", func() {
+				select {
+				case c := <-contexts:
+					_, ok := c.Deadline()
+					So(ok, ShouldBeFalse)
+
+					So(receiver.Disconnect(), ShouldBeNil)
+
+					select {
+					case <-c.Done():
+						So(c.Err() == context.Canceled, ShouldBeTrue)
+					case <-time.After(receiveTimeout):
+						So("context not cancelled", ShouldBeEmpty)
+					}
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestMandatoryCommands(t *testing.T) {
+	Convey("Given an agent sending mandatory commands", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", map[string]interface{}{
+			configPublishMandatory: true,
+		})
+
+		Reset(func() {
+			sender.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When it sends a command to an agent which does not exist", func() {
+			err := sender.SendCommand("nobody", &person{FirstName: "john", LastName: "doe", Age: 74})
+
+			Convey("The command should be reported as unroutable", func() {
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrUnroutable)
+			})
+		})
+
+		Convey("When it sends a request to an agent which does not exist", func() {
+			_, err := sender.Request(context.Background(), "nobody", &person{FirstName: "john", LastName: "doe", Age: 74})
+
+			Convey("The request should be reported as unroutable without waiting for its timeout", func() {
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrUnroutable)
+			})
+		})
+
+		Convey("When it sends a command to an existing agent", func() {
+			receiver := newTestAgent(broker, "receiver", nil)
+			defer receiver.Disconnect() // nolint: errcheck
+
+			err := sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74})
+
+			Convey("No error should occur", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestFilteredEventCallbacks(t *testing.T) {
+	Convey("Given three agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		listener := newTestAgent(broker, "listener", nil)
+		builder := newTestAgent(broker, "builder", nil)
+		tester := newTestAgent(broker, "tester", nil)
+
+		Reset(func() {
+			listener.Disconnect() // nolint: errcheck
+			builder.Disconnect()  // nolint: errcheck
+			tester.Disconnect()   // nolint: errcheck
+		})
+
+		Convey("When the listener only listens to the person events of the builder", func() {
+			events := make(chan agentiface.EventCtx, 2)
+
+			filter := agentiface.All(agentiface.ByGoType(listener, person{}), agentiface.BySenderName("builder"))
+			_, err := listener.RegisterFilteredEventCallback(filter, func(ctx agentiface.EventCtx) error {
+				events <- ctx
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(tester.publishEvent(mustPrepare(tester, &person{FirstName: "tester"})), ShouldBeNil)
+			So(builder.publishEvent(mustPrepare(builder, &person{FirstName: "builder"})), ShouldBeNil)
+
+			Convey("Only the event of the builder should be received", func() {
+				select {
+				case ctx := <-events:
+					So(ctx.Message().(*person).FirstName, ShouldEqual, "builder")
+				case <-time.After(receiveTimeout):
+					So("event not received", ShouldBeEmpty)
+				}
+
+				select {
+				case <-events:
+					So("unexpected event received", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+			})
+		})
+
+		Convey("When the listener registers an invalid filter", func() {
+			_, err := listener.RegisterFilteredEventCallback(agentiface.BySender(""), func(ctx agentiface.EventCtx) error {
+				return nil
+			})
+
+			Convey("An error should occur", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the listener registers a nil filter", func() {
+			_, err := listener.RegisterFilteredEventCallback(nil, func(ctx agentiface.EventCtx) error {
+				return nil
+			})
+
+			Convey("An error should occur", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+// flakyTransport is a loopback transport whose transitions can be simulated.
+type flakyTransport struct {
+	*LoopbackTransport
+	stateCallback agentiface.StateCallback
+}
+
+func (t *flakyTransport) Connect(stateCallback agentiface.StateCallback) error {
+	t.stateCallback = stateCallback
+	return t.LoopbackTransport.Connect(stateCallback)
+}
+
+func TestStateMachine(t *testing.T) {
+	Convey("Given an agent recording its transitions", t, func() {
+		broker := NewLoopbackBroker()
+		transport := &flakyTransport{LoopbackTransport: broker.NewTransport()}
+		agent := newDisconnectedTestAgent(broker, "agent", nil, WithTransport(transport))
+
+		var transitions []agentiface.Transition
+		var veto agentiface.State
+
+		agent.RegisterStateCallback(func(transition agentiface.Transition) error {
+			if transition.To == veto {
+				return fmt.Errorf("vetoed")
+			}
+			transitions = append(transitions, transition)
+			return nil
+		})
+
+		Reset(func() {
+			agent.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the agent connects and shuts down", func() {
+			So(agent.Connect(), ShouldBeNil)
+			So(agent.State(), ShouldEqual, agentiface.StateConnected)
+			So(agent.Shutdown(context.Background()), ShouldBeNil)
+
+			Convey("All the transitions should be notified", func() {
+				So(transitions, ShouldResemble, []agentiface.Transition{
+					{From: agentiface.StateDisconnected, To: agentiface.StateConnecting},
+					{From: agentiface.StateConnecting, To: agentiface.StateConnected},
+					{From: agentiface.StateConnected, To: agentiface.StateDraining},
+					{From: agentiface.StateDraining, To: agentiface.StateDisconnected},
+				})
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the transition to StateConnecting is vetoed", func() {
+			veto = agentiface.StateConnecting
+			err := agent.Connect()
+
+			Convey("The agent should not connect", func() {
+				So(err, ShouldNotBeNil)
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+				So(transport.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the transition to StateConnected is vetoed", func() {
+			veto = agentiface.StateConnected
+			err := agent.Connect()
+
+			Convey("The connection should be aborted", func() {
+				So(err, ShouldNotBeNil)
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+				So(transport.State(), ShouldEqual, agentiface.StateDisconnected)
+				So(transitions[len(transitions)-1].From, ShouldEqual, agentiface.StateConnecting)
+				So(transitions[len(transitions)-1].Cause, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the transition to StateDraining is vetoed", func() {
+			So(agent.Connect(), ShouldBeNil)
+			veto = agentiface.StateDraining
+			err := agent.Shutdown(context.Background())
+
+			Convey("The agent should stay connected", func() {
+				So(err, ShouldNotBeNil)
+				So(agent.State(), ShouldEqual, agentiface.StateConnected)
+			})
+		})
+
+		Convey("When the connection is lost and restored", func() {
+			connected := make(chan struct{}, 2)
+			agent.OnConnected(func(a agentiface.Agent) error {
+				connected <- struct{}{}
+				return nil
+			})
+
+			So(agent.Connect(), ShouldBeNil)
+
+			lost := errors.New("connection lost")
+			transport.stateCallback(agentiface.Transition{From: agentiface.StateConnected, To: agentiface.StateReconnecting, Cause: lost}) // nolint: errcheck
+			So(agent.State(), ShouldEqual, agentiface.StateReconnecting)
+
+			transport.stateCallback(agentiface.Transition{From: agentiface.StateReconnecting, To: agentiface.StateConnected}) // nolint: errcheck
+
+			Convey("The transitions should carry the cause and the connected hooks should be called again", func() {
+				So(agent.State(), ShouldEqual, agentiface.StateConnected)
+				So(transitions[2], ShouldResemble, agentiface.Transition{From: agentiface.StateConnected, To: agentiface.StateReconnecting, Cause: lost})
+				So(transitions[3], ShouldResemble, agentiface.Transition{From: agentiface.StateReconnecting, To: agentiface.StateConnected})
+				So(len(connected), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the connection is lost for good", func() {
+			So(agent.Connect(), ShouldBeNil)
+
+			lost := errors.New("connection lost")
+			transport.stateCallback(agentiface.Transition{From: agentiface.StateConnected, To: agentiface.StateFailed, Cause: lost}) // nolint: errcheck
+
+			Convey("The agent should have failed and could connect again", func() {
+				So(agent.State(), ShouldEqual, agentiface.StateFailed)
+				So(transitions[len(transitions)-1].Cause, ShouldEqual, lost)
+
+				So(transport.LoopbackTransport.Disconnect(), ShouldBeNil)
+				So(agent.Connect(), ShouldBeNil)
+				So(agent.State(), ShouldEqual, agentiface.StateConnected)
+			})
+		})
+	})
+}
+
+// mustPrepare prepares the envelope of a message sent by an agent.
+func mustPrepare(agent *Agent, msg interface{}) *agentiface.Envelope {
+	envelope, err := agent.preparePublishing(nil, "", msg)
+	So(err, ShouldBeNil)
+
+	return envelope
+}
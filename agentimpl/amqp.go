@@ -0,0 +1,791 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+// configuration keys of the reconnection policy
+const (
+	configReconnectEnabled         = "reconnect.enabled"
+	configReconnectInitialInterval = "reconnect.initial-interval"
+	configReconnectMaxInterval     = "reconnect.max-interval"
+	configReconnectMultiplier      = "reconnect.multiplier"
+	configReconnectJitter          = "reconnect.jitter"
+	configReconnectMaxAttempts     = "reconnect.max-attempts"
+)
+
+// configuration keys of the quality of service: number and size (in bytes) of the messages the broker delivers
+// to the agent before they are acknowledged (0 means unlimited). It only applies to manual acknowledgement mode.
+const (
+	configPrefetchCount = "prefetch.count"
+	configPrefetchSize  = "prefetch.size"
+)
+
+// amqpSubscription is a subscription bound to a queue of the broker.
+// It is kept in order to bind the queue again when the connection is restored.
+// The name of the queue is also the tag of the consumer listening to it.
+type amqpSubscription struct {
+	queue        string
+	subscription agentiface.Subscription
+	handler      agentiface.EnvelopeHandler
+	paused       bool
+}
+
+// amqpConnection is a connection to the AMQP broker (see dialAMQP).
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is a channel of a connection to the AMQP broker (implemented by *amqp.Channel).
+type amqpChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// amqpDialedConnection is a connection dialed with the amqp package.
+type amqpDialedConnection struct {
+	*amqp.Connection
+}
+
+// Channel opens a channel of the connection.
+func (c amqpDialedConnection) Channel() (amqpChannel, error) {
+	channel, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// dialAMQP connects to the AMQP broker at the given endpoint.
+func dialAMQP(endpoint string) (amqpConnection, error) {
+	connection, err := amqp.Dial(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return amqpDialedConnection{connection}, nil
+}
+
+// AMQP is the implementation of a Transport using an AMQP broker.
+// Commands and events are published on two headers exchanges (ExchangeCommand and ExchangeEvent).
+type AMQP struct {
+	agent *Agent
+
+	// connects to the broker (dialAMQP, unless testing)
+	dial func(endpoint string) (amqpConnection, error)
+
+	// protects the state, the connection and the subscriptions
+	mutex         sync.RWMutex
+	state         agentiface.State
+	stateCallback agentiface.StateCallback
+
+	// amqp specifics
+	connection amqpConnection
+	channel    amqpChannel
+	connClosed chan *amqp.Error
+	chanClosed chan *amqp.Error
+
+	// closed when the agent disconnects on purpose
+	stop chan struct{}
+
+	// publisher confirms (see amqpConfirm.go)
+	confirmMutex sync.Mutex
+	deliveryTag  uint64
+	unconfirmed  map[uint64]*amqpUnconfirmed
+
+	// subscriptions
+	// - key is the name of the queue
+	// - value is the subscription
+	subscriptions map[string]*amqpSubscription
+}
+
+// NewAMQP creates a new instance of AMQP
+func NewAMQP(a *Agent) *AMQP {
+	a.SetDefaultConfigOption("endpoint", agentiface.ConfigDefaultEndpoint)
+	a.SetDefaultConfigOption(configReconnectEnabled, true)
+	a.SetDefaultConfigOption(configReconnectInitialInterval, "500ms")
+	a.SetDefaultConfigOption(configReconnectMaxInterval, "30s")
+	a.SetDefaultConfigOption(configReconnectMultiplier, 2.0)
+	a.SetDefaultConfigOption(configReconnectJitter, 0.2)
+	a.SetDefaultConfigOption(configReconnectMaxAttempts, 0) // 0 means forever
+	a.SetDefaultConfigOption(configPrefetchCount, 0)
+	a.SetDefaultConfigOption(configPrefetchSize, 0)
+	a.SetDefaultConfigOption(configPublishConfirm, false)
+	a.SetDefaultConfigOption(configPublishConfirmTimeout, "10s")
+
+	return &AMQP{
+		agent:         a,
+		dial:          dialAMQP,
+		state:         agentiface.StateDisconnected,
+		subscriptions: make(map[string]*amqpSubscription),
+		unconfirmed:   make(map[uint64]*amqpUnconfirmed),
+	}
+}
+
+// Connect actually connects to the AMQP broker and initializes the exchanges.
+func (a *AMQP) Connect(stateCallback agentiface.StateCallback) error {
+	endpoint := a.agent.GetConfigString("endpoint")
+
+	if state := a.State(); state != agentiface.StateDisconnected && state != agentiface.StateFailed {
+		return fmt.Errorf("Already connected to: %s", endpoint)
+	}
+
+	a.agent.Info("Connecting to %s", endpoint)
+
+	stop := make(chan struct{})
+
+	a.mutex.Lock()
+	a.stateCallback = stateCallback
+	a.stop = stop
+	a.mutex.Unlock()
+
+	if err := a.open(); err != nil {
+		close(stop)
+		return err
+	}
+
+	a.agent.Go(func(quit <-chan struct{}) error {
+		return a.watchConnection(stop, quit)
+	})
+
+	a.agent.Info("Connected to: %s as %s", endpoint, a.agent.ID())
+	a.setState(agentiface.StateConnected, nil)
+
+	return nil
+}
+
+// open dials the broker, declares exchanges and binds again all the known subscriptions.
+func (a *AMQP) open() (err error) {
+	connection, err := a.dial(a.agent.GetConfigString("endpoint"))
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.connection = connection
+	a.mutex.Unlock()
+
+	defer func() {
+		if err != nil {
+			a.closeConnection() // silently disconnect and do not report any errors
+		}
+	}()
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = channel.Qos(
+		a.agent.GetConfigInt(configPrefetchCount), // prefetch count
+		a.agent.GetConfigInt(configPrefetchSize),  // prefetch size
+		false,                                     // global
+	)
+	if err != nil {
+		return err
+	}
+
+	if a.agent.GetConfigBool(configPublishConfirm) {
+		if err = a.enableConfirms(channel); err != nil {
+			return err
+		}
+	}
+
+	a.mutex.Lock()
+	a.channel = channel
+	a.connClosed = connection.NotifyClose(make(chan *amqp.Error, 1))
+	a.chanClosed = channel.NotifyClose(make(chan *amqp.Error, 1))
+	subscriptions := make([]*amqpSubscription, 0, len(a.subscriptions))
+	for _, sub := range a.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	a.mutex.Unlock()
+
+	if err = a.declareExchanges(); err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if err = a.bind(sub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forward hands the deliveries of a consumer to the handler of the subscription until the consumer is closed.
+func (a *AMQP) forward(deliveries <-chan amqp.Delivery, sub *amqpSubscription) {
+	a.mutex.RLock()
+	stop := a.stop
+	a.mutex.RUnlock()
+
+	// the deliveries are forwarded when the agent quits until the consumer is cancelled, so that the messages in
+	// flight still receive the replies to their requests (see Messaging.Shutdown)
+	a.agent.Go(func(_ <-chan struct{}) error {
+		for {
+			select {
+			case d, ok := <-deliveries:
+				if !ok {
+					return nil
+				}
+
+				sub.handler(newEnvelope(d, sub))
+			case <-stop:
+				return nil
+			}
+		}
+	})
+}
+
+// watchConnection waits for the connection to the broker to be lost and restores it, until stop is closed by
+// disconnecting.
+func (a *AMQP) watchConnection(stop <-chan struct{}, quit <-chan struct{}) error {
+	for {
+		a.mutex.RLock()
+		connClosed, chanClosed := a.connClosed, a.chanClosed
+		a.mutex.RUnlock()
+
+		var reason *amqp.Error
+
+		select {
+		case reason = <-connClosed:
+		case reason = <-chanClosed:
+		case <-stop:
+			return nil
+		case <-quit:
+			return nil
+		}
+
+		select {
+		case <-stop:
+			// the connection has been closed on purpose
+			return nil
+		case <-quit:
+			return nil
+		default:
+		}
+
+		cause := errors.New("Connection lost")
+		if reason != nil {
+			cause = errors.Wrap(reason, "Connection lost")
+		}
+		a.agent.Warning("%s", cause.Error())
+
+		if !a.agent.GetConfigBool(configReconnectEnabled) {
+			return a.fail(cause)
+		}
+
+		if err := a.reconnect(stop, quit, cause); err != nil {
+			a.agent.Error("%s", err.Error())
+			return a.fail(err)
+		}
+	}
+}
+
+// reconnect tries to restore the connection to the broker, waiting between attempts as configured.
+func (a *AMQP) reconnect(stop <-chan struct{}, quit <-chan struct{}, cause error) error {
+	endpoint := a.agent.GetConfigString("endpoint")
+
+	a.setState(agentiface.StateReconnecting, cause)
+	a.closeConnection()
+
+	backoff := &Backoff{
+		InitialInterval: a.agent.GetConfigDuration(configReconnectInitialInterval),
+		MaxInterval:     a.agent.GetConfigDuration(configReconnectMaxInterval),
+		Multiplier:      a.agent.GetConfigFloat64(configReconnectMultiplier),
+		Jitter:          a.agent.GetConfigFloat64(configReconnectJitter),
+	}
+	maxAttempts := a.agent.GetConfigInt(configReconnectMaxAttempts)
+
+	for attempt := 0; maxAttempts <= 0 || attempt < maxAttempts; attempt++ {
+		delay := backoff.Duration(attempt)
+
+		a.agent.Info("Reconnecting to %s in %s (attempt %d)", endpoint, delay, attempt+1)
+
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return nil
+		case <-quit:
+			return nil
+		}
+
+		err := a.open()
+
+		if err == nil {
+			select {
+			case <-stop:
+				// disconnected while reconnecting
+				a.closeConnection()
+				return nil
+			default:
+			}
+
+			a.agent.Info("Reconnected to: %s as %s", endpoint, a.agent.ID())
+			a.setState(agentiface.StateConnected, nil)
+			return nil
+		}
+
+		a.agent.Warning("Failed to reconnect to %s: %s", endpoint, err.Error())
+	}
+
+	return fmt.Errorf("Failed to reconnect to %s after %d attempts", endpoint, maxAttempts)
+}
+
+// closeConnection releases the current connection (if any).
+func (a *AMQP) closeConnection() {
+	a.mutex.Lock()
+	connection := a.connection
+	a.connection = nil
+	a.channel = nil
+	a.mutex.Unlock()
+
+	if connection != nil {
+		connection.Close() // nolint: errcheck, the connection may already be broken
+	}
+}
+
+// fail disconnects from the broker after the connection failed, and only logs errors.
+func (a *AMQP) fail(cause error) error {
+	if err := a.disconnect(agentiface.StateFailed, cause); err != nil {
+		a.agent.Warning("%s", err.Error())
+	}
+	return nil
+}
+
+// Disconnect disconnect from the broker.
+func (a *AMQP) Disconnect() error {
+	return a.disconnect(agentiface.StateDisconnected, nil)
+}
+
+// disconnect disconnects from the broker, ending in the given state.
+func (a *AMQP) disconnect(state agentiface.State, cause error) error {
+	endpoint := a.agent.GetConfigString("endpoint")
+
+	a.mutex.Lock()
+	if a.state == agentiface.StateDisconnected || a.state == agentiface.StateFailed {
+		a.mutex.Unlock()
+		return fmt.Errorf("Not connected")
+	}
+
+	close(a.stop)
+
+	connection := a.connection
+	a.connection = nil
+	a.channel = nil
+	a.subscriptions = make(map[string]*amqpSubscription)
+	a.mutex.Unlock()
+
+	var err error
+	if connection != nil {
+		err = connection.Close()
+	}
+
+	a.agent.Info("Disconnected from: %s", endpoint)
+	a.setState(state, cause)
+
+	return err
+}
+
+// State returns the state of the connection.
+func (a *AMQP) State() agentiface.State {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.state
+}
+
+// setState changes the state of the connection and reports the transition.
+func (a *AMQP) setState(state agentiface.State, cause error) {
+	a.mutex.Lock()
+	oldState := a.state
+	a.state = state
+	stateCallback := a.stateCallback
+	a.mutex.Unlock()
+
+	if oldState != state && stateCallback != nil {
+		stateCallback(agentiface.Transition{From: oldState, To: state, Cause: cause}) // nolint: errcheck, transitions of the transport cannot be vetoed
+	}
+}
+
+func (a *AMQP) declareExchanges() (err error) {
+	a.mutex.RLock()
+	channel := a.channel
+	a.mutex.RUnlock()
+
+	if channel == nil {
+		return errors.New("Not connected")
+	}
+
+	err = channel.ExchangeDeclare(
+		agentiface.ExchangeCommand, // name
+		"headers",                  // type
+		true,                       // durable
+		false,                      // auto-deleted
+		false,                      // internal
+		false,                      // no-wait
+		nil,                        // arguments
+	) // args Table
+
+	if err != nil {
+		return err
+	}
+
+	err = channel.ExchangeDeclare(
+		agentiface.ExchangeEvent, // name
+		"headers",                // type
+		true,                     // durable
+		false,                    // auto-deleted
+		false,                    // internal
+		false,                    // no-wait
+		nil,                      // arguments
+	) // args Table
+
+	if err != nil {
+		return err
+	}
+
+	err = channel.ExchangeDeclare(
+		agentiface.ExchangeDeadLetter, // name
+		"headers",                     // type
+		true,                          // durable
+		false,                         // auto-deleted
+		false,                         // internal
+		false,                         // no-wait
+		nil,                           // arguments
+	) // args Table
+
+	return err
+}
+
+// Subscribe declares the queue of the subscription (if needed), binds it with the filters of the subscription
+// and listens to it.
+func (a *AMQP) Subscribe(subscription agentiface.Subscription, handler agentiface.EnvelopeHandler) (string, error) {
+	if a.State() != agentiface.StateConnected {
+		return "", fmt.Errorf("Cannot subscribe if not connected")
+	}
+
+	sub := &amqpSubscription{
+		queue:        subscription.Queue,
+		subscription: subscription,
+		handler:      handler,
+	}
+
+	if sub.queue == "" {
+		// name the queue so that it can be declared again after a reconnection
+		sub.queue = fmt.Sprintf("%s/%s", a.agent.ID(), uuid.Must(uuid.NewV4()).String())
+	}
+
+	a.mutex.RLock()
+	_, exists := a.subscriptions[sub.queue]
+	a.mutex.RUnlock()
+
+	if exists {
+		return "", fmt.Errorf("Already subscribed to queue: %s", sub.queue)
+	}
+
+	if err := a.bind(sub); err != nil {
+		return "", err
+	}
+
+	a.mutex.Lock()
+	a.subscriptions[sub.queue] = sub
+	a.mutex.Unlock()
+
+	return sub.queue, nil
+}
+
+// Unsubscribe cancels the consumer of a subscription and deletes its queue if exclusive.
+func (a *AMQP) Unsubscribe(id string) error {
+	a.mutex.Lock()
+	sub, ok := a.subscriptions[id]
+	delete(a.subscriptions, id)
+	channel := a.channel
+	a.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+
+	if channel == nil {
+		// not connected: the subscription will not be bound again
+		return nil
+	}
+
+	if !sub.paused {
+		if err := channel.Cancel(sub.queue, false); err != nil {
+			return err
+		}
+	}
+
+	if sub.subscription.Exclusive {
+		_, err := channel.QueueDelete(
+			sub.queue, // name
+			false,     // if unused
+			false,     // if empty
+			false,     // no-wait
+		)
+		return err
+	}
+
+	return nil
+}
+
+// Pause cancels the consumer of a subscription. Its queue keeps receiving messages.
+func (a *AMQP) Pause(id string) error {
+	a.mutex.Lock()
+	sub, ok := a.subscriptions[id]
+	if !ok {
+		a.mutex.Unlock()
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+	wasPaused := sub.paused
+	sub.paused = true
+	channel := a.channel
+	a.mutex.Unlock()
+
+	if wasPaused || channel == nil {
+		return nil
+	}
+
+	return channel.Cancel(sub.queue, false)
+}
+
+// Resume listens again to the queue of a paused subscription.
+func (a *AMQP) Resume(id string) error {
+	a.mutex.Lock()
+	sub, ok := a.subscriptions[id]
+	if !ok {
+		a.mutex.Unlock()
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+	wasPaused := sub.paused
+	sub.paused = false
+	channel := a.channel
+	a.mutex.Unlock()
+
+	if !wasPaused || channel == nil {
+		// the consumer is created when the connection is restored
+		return nil
+	}
+
+	return a.consume(channel, sub)
+}
+
+// bind declares the queue of a subscription, binds it and listens to it unless the subscription is paused.
+func (a *AMQP) bind(sub *amqpSubscription) error {
+	exchange, err := exchangeOf(sub.subscription.Destination)
+
+	if err != nil {
+		return err
+	}
+
+	a.mutex.RLock()
+	channel := a.channel
+	a.mutex.RUnlock()
+
+	if channel == nil {
+		return errors.New("Not connected")
+	}
+
+	// exclusive queues are not deleted when unused so that a subscription can be paused,
+	// they are deleted with the connection or when unsubscribing
+	queue, err := channel.QueueDeclare(
+		sub.queue,                  // name
+		false,                      // durable
+		false,                      // delete when unused
+		sub.subscription.Exclusive, // exclusive
+		false,                      // no-wait
+		nil,                        // arguments
+	)
+
+	if err != nil {
+		return err
+	}
+
+	for _, filter := range sub.subscription.Filters {
+		err = channel.QueueBind(
+			queue.Name, // queue name
+			"",         // routing key
+			exchange,   // exchange
+			false,      // no-Wait
+			amqp.Table(filter),
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	a.mutex.RLock()
+	paused := sub.paused
+	a.mutex.RUnlock()
+
+	if paused {
+		return nil
+	}
+
+	return a.consume(channel, sub)
+}
+
+// consume listens to the queue of a subscription and forwards the deliveries to its handler.
+func (a *AMQP) consume(channel amqpChannel, sub *amqpSubscription) error {
+	deliveries, err := channel.Consume(
+		sub.queue,                   // queue
+		sub.queue,                   // consumer
+		!sub.subscription.ManualAck, // auto-ack
+		false,                       // exclusive
+		false,                       // no-local
+		false,                       // no-wait
+		nil,                         // args
+	)
+	if err != nil {
+		return err
+	}
+
+	a.forward(deliveries, sub)
+
+	return nil
+}
+
+// Publish publishes an envelope on the exchange matching the destination.
+func (a *AMQP) Publish(destination agentiface.Destination, envelope *agentiface.Envelope) error {
+	exchange, err := exchangeOf(destination)
+
+	if err != nil {
+		return err
+	}
+
+	a.mutex.RLock()
+	channel := a.channel
+	state := a.state
+	a.mutex.RUnlock()
+
+	if state != agentiface.StateConnected || channel == nil {
+		return errors.New("Not connected")
+	}
+
+	return a.publish(channel, exchange, "", envelope)
+}
+
+// PublishToQueue publishes an envelope on the default exchange, which routes it to the given queue.
+func (a *AMQP) PublishToQueue(queue string, envelope *agentiface.Envelope) error {
+	a.mutex.RLock()
+	channel := a.channel
+	state := a.state
+	a.mutex.RUnlock()
+
+	if state != agentiface.StateConnected || channel == nil {
+		return errors.New("Not connected")
+	}
+
+	return a.publish(channel, "", queue, envelope)
+}
+
+// exchangeOf returns the name of the exchange used for a destination.
+func exchangeOf(destination agentiface.Destination) (string, error) {
+	switch destination {
+	case agentiface.DestinationCommand:
+		return agentiface.ExchangeCommand, nil
+	case agentiface.DestinationEvent:
+		return agentiface.ExchangeEvent, nil
+	case agentiface.DestinationDeadLetter:
+		return agentiface.ExchangeDeadLetter, nil
+	default:
+		return "", fmt.Errorf("Unknown destination: %d", destination)
+	}
+}
+
+// amqpAcknowledger settles an AMQP delivery.
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+// Ack acknowledges the delivery.
+func (a *amqpAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+// Reject rejects the delivery.
+func (a *amqpAcknowledger) Reject(requeue bool) error {
+	return a.delivery.Reject(requeue)
+}
+
+// newEnvelope converts an AMQP delivery received through a subscription into an envelope.
+// The destination is the one of the subscription, as deliveries can also come from the default exchange
+// (see PublishToQueue).
+func newEnvelope(d amqp.Delivery, sub *amqpSubscription) *agentiface.Envelope {
+	var acknowledger agentiface.Acknowledger
+
+	if sub.subscription.ManualAck {
+		acknowledger = &amqpAcknowledger{delivery: d}
+	}
+
+	return &agentiface.Envelope{
+		Destination:     sub.subscription.Destination,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		CorrelationID:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageID:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserID:          d.UserId,
+		AppID:           d.AppId,
+		Headers:         d.Headers,
+		Body:            d.Body,
+		Queue:           sub.queue,
+		Acknowledger:    acknowledger,
+	}
+}
+
+// newPublishing converts an envelope into an AMQP publishing.
+func newPublishing(e *agentiface.Envelope) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:     e.ContentType,
+		ContentEncoding: e.ContentEncoding,
+		CorrelationId:   e.CorrelationID,
+		ReplyTo:         e.ReplyTo,
+		Expiration:      e.Expiration,
+		MessageId:       e.MessageID,
+		Timestamp:       e.Timestamp,
+		Type:            e.Type,
+		UserId:          e.UserID,
+		AppId:           e.AppID,
+		Headers:         amqp.Table(e.Headers),
+		Body:            e.Body,
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// configuration keys of the publisher confirms: when enabled, publishing a message waits for the broker to confirm
+// it and fails if it has been refused or, for mandatory messages, if it could not be routed to any queue.
+const (
+	configPublishConfirm        = "publish.confirm"
+	configPublishConfirmTimeout = "publish.confirm-timeout"
+)
+
+// amqpUnconfirmed is a published message waiting for its confirmation.
+type amqpUnconfirmed struct {
+	messageID string
+	exchange  string
+	key       string
+	mandatory bool
+	done      chan error
+}
+
+// isReturnOf tells whether a returned message is this published message.
+func (u *amqpUnconfirmed) isReturnOf(r amqp.Return) bool {
+	return u.mandatory && r.Exchange == u.exchange && r.RoutingKey == u.key && r.MessageId == u.messageID
+}
+
+// enableConfirms puts the channel in confirm mode and listens to the confirmations and the returned messages.
+func (a *AMQP) enableConfirms(channel amqpChannel) error {
+	if err := channel.Confirm(false); err != nil {
+		return err
+	}
+
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	// the delivery tags restart with the channel
+	a.confirmMutex.Lock()
+	a.failUnconfirmed(errors.New("Connection lost while waiting for the confirmation of the message"))
+	a.deliveryTag = 0
+	a.confirmMutex.Unlock()
+
+	// the confirmations are watched until the channel is closed, even once the agent quits, as the messages in
+	// flight can still be published while it shuts down
+	a.agent.Go(func(_ <-chan struct{}) error {
+		a.watchConfirms(confirms, returns)
+		return nil
+	})
+
+	return nil
+}
+
+// publish publishes a message on a channel. In confirm mode, it waits for the broker to confirm the message.
+func (a *AMQP) publish(channel amqpChannel, exchange string, key string, envelope *agentiface.Envelope) error {
+	if !a.agent.GetConfigBool(configPublishConfirm) {
+		return channel.Publish(
+			exchange,
+			key,
+			envelope.Mandatory, // mandatory
+			false,              // immediate
+			newPublishing(envelope))
+	}
+
+	// publish and register the message atomically, so that the delivery tags follow the publishing order
+	a.confirmMutex.Lock()
+
+	err := channel.Publish(
+		exchange,
+		key,
+		envelope.Mandatory, // mandatory
+		false,              // immediate
+		newPublishing(envelope))
+
+	if err != nil {
+		a.confirmMutex.Unlock()
+		return err
+	}
+
+	a.deliveryTag++
+	tag := a.deliveryTag
+	unconfirmed := &amqpUnconfirmed{
+		messageID: envelope.MessageID,
+		exchange:  exchange,
+		key:       key,
+		mandatory: envelope.Mandatory,
+		done:      make(chan error, 1),
+	}
+	a.unconfirmed[tag] = unconfirmed
+
+	a.confirmMutex.Unlock()
+
+	select {
+	case err = <-unconfirmed.done:
+		return err
+	case <-time.After(a.agent.GetConfigDuration(configPublishConfirmTimeout)):
+		// the message stays unconfirmed until the broker confirms it, so that its return is still matched
+		return fmt.Errorf("Timed out waiting for the confirmation of message '%s'", envelope.MessageID)
+	}
+}
+
+// watchConfirms reports the confirmations of a channel to the published messages waiting for them, until the
+// channel is closed.
+func (a *AMQP) watchConfirms(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	// returned messages not confirmed yet, in delivery order
+	var returned []amqp.Return
+
+	for {
+		select {
+		case r, ok := <-returns:
+			if ok {
+				returned = append(returned, r)
+			} else {
+				returns = nil
+			}
+
+		case c, ok := <-confirms:
+			if !ok {
+				a.confirmMutex.Lock()
+				a.failUnconfirmed(errors.New("Connection lost while waiting for the confirmation of the message"))
+				a.confirmMutex.Unlock()
+				return
+			}
+
+			// a message is returned before being confirmed
+		drain:
+			for returns != nil {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						break drain
+					}
+					returned = append(returned, r)
+				default:
+					break drain
+				}
+			}
+
+			a.confirmMutex.Lock()
+			unconfirmed, ok := a.unconfirmed[c.DeliveryTag]
+			delete(a.unconfirmed, c.DeliveryTag)
+			a.confirmMutex.Unlock()
+
+			if !ok {
+				// published on a previous channel
+				continue
+			}
+
+			// the messages are returned in the order they are published and before being confirmed, so the first
+			// pending return belongs to the confirmed message or to a later one
+			if len(returned) > 0 && unconfirmed.isReturnOf(returned[0]) {
+				r := returned[0]
+				returned = returned[1:]
+				unconfirmed.done <- errors.Wrapf(agentiface.ErrUnroutable, "Message '%s' returned (%d %s)", unconfirmed.messageID, r.ReplyCode, r.ReplyText)
+			} else if !c.Ack {
+				unconfirmed.done <- errors.Wrapf(agentiface.ErrNacked, "Message '%s'", unconfirmed.messageID)
+			} else {
+				unconfirmed.done <- nil
+			}
+		}
+	}
+}
+
+// failUnconfirmed reports an error to all the messages waiting for their confirmation.
+// It must be called with confirmMutex locked.
+func (a *AMQP) failUnconfirmed(err error) {
+	for tag, unconfirmed := range a.unconfirmed {
+		unconfirmed.done <- err
+		delete(a.unconfirmed, tag)
+	}
+}
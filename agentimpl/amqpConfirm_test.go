@@ -0,0 +1,262 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/streadway/amqp"
+)
+
+func TestWatchConfirms(t *testing.T) {
+	Convey("Given three published messages waiting for their confirmation", t, func() {
+		a := &AMQP{
+			unconfirmed: make(map[uint64]*amqpUnconfirmed),
+		}
+
+		for tag, id := range map[uint64]string{1: "routed", 2: "returned", 3: "refused"} {
+			a.unconfirmed[tag] = &amqpUnconfirmed{
+				messageID: id,
+				exchange:  "events",
+				key:       "person",
+				mandatory: true,
+				done:      make(chan error, 1),
+			}
+		}
+		waiting := map[string]chan error{
+			"routed":   a.unconfirmed[1].done,
+			"returned": a.unconfirmed[2].done,
+			"refused":  a.unconfirmed[3].done,
+		}
+
+		confirms := make(chan amqp.Confirmation, 3)
+		returns := make(chan amqp.Return, 1)
+		stopped := make(chan struct{})
+
+		var closing sync.Once
+		closeConfirms := func() {
+			closing.Do(func() { close(confirms) })
+		}
+
+		go func() {
+			a.watchConfirms(confirms, returns)
+			close(stopped)
+		}()
+
+		Reset(func() {
+			closeConfirms()
+			<-stopped
+		})
+
+		Convey("When the broker confirms them", func() {
+			returns <- amqp.Return{Exchange: "events", RoutingKey: "person", MessageId: "returned", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+			confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+			confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+
+			results := make(map[string]error)
+			for id, done := range waiting {
+				select {
+				case err := <-done:
+					results[id] = err
+				case <-time.After(receiveTimeout):
+					So("confirmation not reported", ShouldBeEmpty)
+				}
+			}
+
+			Convey("The routed message should be confirmed", func() {
+				So(results["routed"], ShouldBeNil)
+			})
+
+			Convey("The returned message should be reported as unroutable", func() {
+				So(errors.Cause(results["returned"]), ShouldEqual, agentiface.ErrUnroutable)
+			})
+
+			Convey("The refused message should be reported as nacked", func() {
+				So(errors.Cause(results["refused"]), ShouldEqual, agentiface.ErrNacked)
+			})
+		})
+
+		Convey("When messages without id are returned", func() {
+			for _, unconfirmed := range a.unconfirmed {
+				unconfirmed.messageID = ""
+			}
+
+			returns <- amqp.Return{Exchange: "events", RoutingKey: "person", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+
+			Convey("Then the returns should be matched by delivery order", func() {
+				select {
+				case err := <-waiting["routed"]:
+					So(errors.Cause(err), ShouldEqual, agentiface.ErrUnroutable)
+				case <-time.After(receiveTimeout):
+					So("confirmation not reported", ShouldBeEmpty)
+				}
+
+				confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+
+				select {
+				case err := <-waiting["returned"]:
+					So(err, ShouldBeNil)
+				case <-time.After(receiveTimeout):
+					So("confirmation not reported", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the channel is closed", func() {
+			closeConfirms()
+
+			Convey("All the messages should fail", func() {
+				for _, done := range waiting {
+					select {
+					case err := <-done:
+						So(err, ShouldNotBeNil)
+					case <-time.After(receiveTimeout):
+						So("failure not reported", ShouldBeEmpty)
+					}
+				}
+			})
+		})
+	})
+}
+
+func TestConfirmTimeout(t *testing.T) {
+	Convey("Given a mandatory message whose confirmation timed out", t, func() {
+		var a *AMQP
+		newDisconnectedTestAgent(NewLoopbackBroker(), "agent", map[string]interface{}{
+			configPublishConfirm:        true,
+			configPublishConfirmTimeout: "20ms",
+		}, func(agent *Agent) error {
+			a = NewAMQP(agent)
+			return nil
+		})
+
+		// a channel in confirm mode never confirming the messages by itself
+		channel := &fakeAMQPChannel{
+			broker:  &fakeAMQPBroker{},
+			pending: make(chan uint64, 10),
+			stopped: make(chan struct{}),
+		}
+		envelope := &agentiface.Envelope{MessageID: "retried", Mandatory: true}
+
+		So(a.publish(channel, "events", "person", envelope), ShouldNotBeNil)
+
+		confirms := make(chan amqp.Confirmation, 1)
+		returns := make(chan amqp.Return, 1)
+		stopped := make(chan struct{})
+
+		go func() {
+			a.watchConfirms(confirms, returns)
+			close(stopped)
+		}()
+
+		Reset(func() {
+			close(confirms)
+			<-stopped
+		})
+
+		Convey("When the broker eventually returns and confirms it", func() {
+			returns <- amqp.Return{Exchange: "events", RoutingKey: "person", MessageId: "retried", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+
+			Convey("Then a message published again with the same id should not be reported as returned", func() {
+				published := make(chan error, 1)
+				go func() {
+					published <- a.publish(channel, "events", "person", envelope)
+				}()
+
+				// wait for the message to be published
+				<-channel.pending
+				<-channel.pending
+				confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+
+				select {
+				case err := <-published:
+					So(err, ShouldBeNil)
+				case <-time.After(receiveTimeout):
+					So("confirmation not reported", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestPublishConfirmsOnShutdown(t *testing.T) {
+	Convey("Given an agent publishing with confirms and processing a command", t, func() {
+		broker := &fakeAMQPBroker{}
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "agent", map[string]interface{}{
+			configPublishConfirm:        true,
+			configPublishConfirmTimeout: "2s",
+		}, func(agent *Agent) error {
+			agent.transport = newFakeAMQP(agent, broker)
+			return nil
+		})
+		So(agent.Connect(), ShouldBeNil)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		published := make(chan error, 1)
+
+		_, err := agent.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			close(started)
+			<-release
+			published <- ctx.SendEvent(&person{FirstName: "john", LastName: "doe", Age: 75})
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		broker.connection().consumer(agent.ID()) <- amqp.Delivery{
+			ContentType: agentiface.MimeTypeJSON,
+			MessageId:   "command",
+			Type:        schemaID,
+			ReplyTo:     "sender",
+			Headers: amqp.Table{
+				agentiface.AmqpHeaderType:   schemaID,
+				agentiface.AmqpHeaderSendTo: agent.ID(),
+			},
+			Body: []byte(`{"firstName": "john", "lastName": "doe", "age": 74}`),
+		}
+
+		select {
+		case <-started:
+		case <-time.After(receiveTimeout):
+			So("command not received", ShouldBeEmpty)
+		}
+
+		Convey("When the agent quits while the command is processed", func() {
+			agent.Quit()
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+
+			Convey("Then the messages published by the handler are still confirmed", func() {
+				select {
+				case err := <-published:
+					So(err, ShouldBeNil)
+				case <-time.After(time.Second):
+					So("publishing not confirmed", ShouldBeEmpty)
+				}
+
+				So(agent.Wait(), ShouldBeNil)
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+	})
+}
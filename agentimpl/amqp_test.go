@@ -0,0 +1,560 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/streadway/amqp"
+)
+
+// fakeAMQPBroker dials fake connections recording what the transport declares, consumes and publishes.
+type fakeAMQPBroker struct {
+	mutex       sync.Mutex
+	connections []*fakeAMQPConnection
+	declared    []string
+	published   []amqp.Publishing
+	unreachable bool
+}
+
+func (b *fakeAMQPBroker) dial(string) (amqpConnection, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unreachable {
+		return nil, errors.New("dial tcp: connection refused")
+	}
+
+	c := &fakeAMQPConnection{broker: b}
+	b.connections = append(b.connections, c)
+
+	return c, nil
+}
+
+// shutDown makes the broker unreachable and drops its connections: the dials fail from now on.
+func (b *fakeAMQPBroker) shutDown() {
+	b.mutex.Lock()
+	b.unreachable = true
+	connections := append([]*fakeAMQPConnection(nil), b.connections...)
+	b.mutex.Unlock()
+
+	for _, c := range connections {
+		c.drop()
+	}
+}
+
+// dials returns the number of connections dialed.
+func (b *fakeAMQPBroker) dials() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.connections)
+}
+
+// connection returns the last connection dialed.
+func (b *fakeAMQPBroker) connection() *fakeAMQPConnection {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.connections[len(b.connections)-1]
+}
+
+// declarations returns the names of the queues declared so far.
+func (b *fakeAMQPBroker) declarations() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]string(nil), b.declared...)
+}
+
+// publication returns the first message published with the given type, or nil if none.
+func (b *fakeAMQPBroker) publication(messageType string) *amqp.Publishing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, msg := range b.published {
+		if msg.Type == messageType {
+			return &msg
+		}
+	}
+
+	return nil
+}
+
+// fakeAMQPConnection is a connection of a fakeAMQPBroker.
+type fakeAMQPConnection struct {
+	broker   *fakeAMQPBroker
+	mutex    sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	channels []*fakeAMQPChannel
+}
+
+func (c *fakeAMQPConnection) Channel() (amqpChannel, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := &fakeAMQPChannel{
+		broker:    c.broker,
+		consumers: make(map[string]chan amqp.Delivery),
+		pending:   make(chan uint64, 100),
+		done:      make(chan struct{}),
+	}
+	c.channels = append(c.channels, ch)
+
+	return ch, nil
+}
+
+func (c *fakeAMQPConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.notify = append(c.notify, receiver)
+
+	return receiver
+}
+
+func (c *fakeAMQPConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// drop closes the connection as if the broker had been lost.
+func (c *fakeAMQPConnection) drop() {
+	c.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"})
+}
+
+func (c *fakeAMQPConnection) shutdown(reason *amqp.Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	for _, ch := range c.channels {
+		ch.shutdown(reason)
+	}
+
+	for _, receiver := range c.notify {
+		if reason != nil {
+			receiver <- reason
+		}
+		close(receiver)
+	}
+}
+
+// consumer returns the deliveries of the consumer of a queue on the connection, or nil if none.
+func (c *fakeAMQPConnection) consumer(queue string) chan amqp.Delivery {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, ch := range c.channels {
+		ch.mutex.Lock()
+		deliveries := ch.consumers[queue]
+		ch.mutex.Unlock()
+
+		if deliveries != nil {
+			return deliveries
+		}
+	}
+
+	return nil
+}
+
+// fakeAMQPChannel is a channel of a fakeAMQPConnection. In confirm mode, it confirms all the published messages.
+type fakeAMQPChannel struct {
+	broker    *fakeAMQPBroker
+	mutex     sync.Mutex
+	closed    bool
+	notify    []chan *amqp.Error
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+	consumers map[string]chan amqp.Delivery
+
+	// delivery tags of the messages to confirm, confirmed in order until done is closed
+	tag     uint64
+	pending chan uint64
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func (ch *fakeAMQPChannel) Qos(int, int, bool) error {
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Confirm(bool) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.stopped = make(chan struct{})
+	go ch.confirm()
+
+	return nil
+}
+
+// confirm sends the confirmations of the published messages to the listeners.
+func (ch *fakeAMQPChannel) confirm() {
+	defer close(ch.stopped)
+
+	for {
+		select {
+		case tag := <-ch.pending:
+			ch.mutex.Lock()
+			confirms := append([]chan amqp.Confirmation(nil), ch.confirms...)
+			ch.mutex.Unlock()
+
+			for _, c := range confirms {
+				select {
+				case c <- amqp.Confirmation{DeliveryTag: tag, Ack: true}:
+				case <-ch.done:
+					return
+				}
+			}
+		case <-ch.done:
+			return
+		}
+	}
+}
+
+func (ch *fakeAMQPChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.confirms = append(ch.confirms, confirm)
+
+	return confirm
+}
+
+func (ch *fakeAMQPChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.returns = append(ch.returns, c)
+
+	return c
+}
+
+func (ch *fakeAMQPChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.notify = append(ch.notify, c)
+
+	return c
+}
+
+func (ch *fakeAMQPChannel) ExchangeDeclare(string, string, bool, bool, bool, bool, amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeAMQPChannel) QueueDeclare(name string, _, _, _, _ bool, _ amqp.Table) (amqp.Queue, error) {
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+
+	ch.broker.declared = append(ch.broker.declared, name)
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeAMQPChannel) QueueBind(string, string, string, bool, amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeAMQPChannel) QueueDelete(string, bool, bool, bool) (int, error) {
+	return 0, nil
+}
+
+func (ch *fakeAMQPChannel) Consume(queue, consumer string, _, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	deliveries := make(chan amqp.Delivery)
+	ch.consumers[consumer] = deliveries
+
+	return deliveries, nil
+}
+
+func (ch *fakeAMQPChannel) Cancel(consumer string, _ bool) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if deliveries, ok := ch.consumers[consumer]; ok {
+		close(deliveries)
+		delete(ch.consumers, consumer)
+	}
+
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Publish(_, _ string, _, _ bool, msg amqp.Publishing) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.broker.mutex.Lock()
+	ch.broker.published = append(ch.broker.published, msg)
+	ch.broker.mutex.Unlock()
+
+	if ch.stopped != nil {
+		ch.tag++
+		ch.pending <- ch.tag
+	}
+
+	return nil
+}
+
+// shutdown closes the channel: as with the amqp package, all the listeners and consumers are closed.
+func (ch *fakeAMQPChannel) shutdown(reason *amqp.Error) {
+	ch.mutex.Lock()
+	if ch.closed {
+		ch.mutex.Unlock()
+		return
+	}
+	ch.closed = true
+	stopped := ch.stopped
+	ch.mutex.Unlock()
+
+	// the confirmations stop before their listeners are closed
+	close(ch.done)
+	if stopped != nil {
+		<-stopped
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	for _, c := range ch.notify {
+		if reason != nil {
+			c <- reason
+		}
+		close(c)
+	}
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	for _, c := range ch.returns {
+		close(c)
+	}
+	for consumer, deliveries := range ch.consumers {
+		close(deliveries)
+		delete(ch.consumers, consumer)
+	}
+}
+
+// newFakeAMQP creates an AMQP transport connecting to a fake broker, reconnecting without delay.
+func newFakeAMQP(agent *Agent, broker *fakeAMQPBroker) *AMQP {
+	transport := NewAMQP(agent)
+	transport.dial = broker.dial
+
+	agent.SetDefaultConfigOption(configReconnectInitialInterval, "1ms")
+	agent.SetDefaultConfigOption(configReconnectJitter, 0.0)
+
+	return transport
+}
+
+// waitForTransition returns true once the transition to the given state is received.
+func waitForTransition(transitions <-chan agentiface.Transition, state agentiface.State) bool {
+	for {
+		select {
+		case transition := <-transitions:
+			if transition.To == state {
+				return true
+			}
+		case <-time.After(receiveTimeout):
+			return false
+		}
+	}
+}
+
+func TestAMQPReconnection(t *testing.T) {
+	Convey("Given an AMQP transport connected to a broker with a subscription", t, func() {
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "agent", nil)
+		broker := &fakeAMQPBroker{}
+		transport := newFakeAMQP(agent, broker)
+
+		transitions := make(chan agentiface.Transition, 10)
+		So(transport.Connect(func(transition agentiface.Transition) error {
+			transitions <- transition
+			return nil
+		}), ShouldBeNil)
+
+		Reset(func() {
+			transport.Disconnect() // nolint: errcheck
+			agent.Quit()
+			agent.Wait() // nolint: errcheck
+		})
+
+		envelopes := make(chan *agentiface.Envelope, 1)
+		_, err := transport.Subscribe(agentiface.Subscription{
+			Destination: agentiface.DestinationCommand,
+			Queue:       "agent",
+			Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "agent"}},
+		}, func(e *agentiface.Envelope) {
+			envelopes <- e
+		})
+		So(err, ShouldBeNil)
+		So(waitForTransition(transitions, agentiface.StateConnected), ShouldBeTrue)
+
+		Convey("When the connection to the broker is lost", func() {
+			broker.connection().drop()
+
+			Convey("Then the transport reconnects", func() {
+				So(waitForTransition(transitions, agentiface.StateReconnecting), ShouldBeTrue)
+				So(waitForTransition(transitions, agentiface.StateConnected), ShouldBeTrue)
+				So(broker.dials(), ShouldEqual, 2)
+				So(transport.State(), ShouldEqual, agentiface.StateConnected)
+			})
+
+			Convey("Then the subscription is bound and consumed again", func() {
+				So(waitForTransition(transitions, agentiface.StateConnected), ShouldBeTrue)
+				So(broker.declarations(), ShouldResemble, []string{"agent", "agent"})
+
+				deliveries := broker.connection().consumer("agent")
+				So(deliveries, ShouldNotBeNil)
+
+				deliveries <- amqp.Delivery{MessageId: "after reconnection"}
+
+				select {
+				case e := <-envelopes:
+					So(e.MessageID, ShouldEqual, "after reconnection")
+				case <-time.After(receiveTimeout):
+					So("envelope not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the transport is disconnected", func() {
+			So(transport.Disconnect(), ShouldBeNil)
+
+			Convey("Then it does not reconnect", func() {
+				So(waitForTransition(transitions, agentiface.StateDisconnected), ShouldBeTrue)
+				So(broker.dials(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestAMQPRequestOnShutdown(t *testing.T) {
+	Convey("Given an agent connected to an AMQP broker and processing a command which sends a request", t, func() {
+		broker := &fakeAMQPBroker{}
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "agent", nil, func(agent *Agent) error {
+			agent.transport = newFakeAMQP(agent, broker)
+			return nil
+		})
+		So(agent.Connect(), ShouldBeNil)
+
+		Reset(func() {
+			agent.Quit()
+			agent.Wait() // nolint: errcheck
+		})
+
+		draining := make(chan struct{})
+		agent.RegisterStateCallback(func(transition agentiface.Transition) error {
+			if transition.To == agentiface.StateDraining {
+				close(draining)
+			}
+			return nil
+		})
+
+		release := make(chan struct{})
+		replies := make(chan error, 1)
+
+		_, err := agent.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			<-release
+
+			request, cancel := context.WithTimeout(context.Background(), receiveTimeout)
+			defer cancel()
+
+			_, err := ctx.Messaging().Request(request, "other", &person{FirstName: "jane", LastName: "doe", Age: 24})
+			replies <- err
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		broker.connection().consumer(agent.ID()) <- amqp.Delivery{
+			ContentType: agentiface.MimeTypeJSON,
+			MessageId:   "command",
+			Type:        schemaID,
+			ReplyTo:     "sender",
+			Headers: amqp.Table{
+				agentiface.AmqpHeaderType:   schemaID,
+				agentiface.AmqpHeaderSendTo: agent.ID(),
+			},
+			Body: []byte(`{"firstName": "john", "lastName": "doe", "age": 74}`),
+		}
+
+		Convey("When the agent quits and the request is answered while the command is drained", func() {
+			agent.Quit()
+
+			select {
+			case <-draining:
+			case <-time.After(receiveTimeout):
+				So("agent not draining", ShouldBeEmpty)
+			}
+
+			close(release)
+
+			var request *amqp.Publishing
+			for deadline := time.Now().Add(receiveTimeout); request == nil && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+				request = broker.publication(schemaID)
+			}
+			So(request, ShouldNotBeNil)
+
+			select {
+			case broker.connection().consumer(agent.Messaging.replyAddress()) <- amqp.Delivery{
+				ContentType:   agentiface.MimeTypeJSON,
+				MessageId:     "reply",
+				CorrelationId: request.MessageId,
+				Type:          schemaID,
+				ReplyTo:       "other",
+				Headers: amqp.Table{
+					agentiface.AmqpHeaderType:   schemaID,
+					agentiface.AmqpHeaderSendTo: agent.Messaging.replyAddress(),
+				},
+				Body: []byte(`{"firstName": "jane", "lastName": "doe", "age": 25}`),
+			}:
+			case <-time.After(receiveTimeout):
+				So("reply not consumed", ShouldBeEmpty)
+			}
+
+			Convey("Then the command receives the reply", func() {
+				select {
+				case err := <-replies:
+					So(err, ShouldBeNil)
+				case <-time.After(receiveTimeout):
+					So("reply not received", ShouldBeEmpty)
+				}
+
+				So(agent.Wait(), ShouldBeNil)
+			})
+		})
+	})
+}
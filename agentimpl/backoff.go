@@ -0,0 +1,60 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing delays between consecutive attempts of an operation.
+type Backoff struct {
+	// InitialInterval is the delay before the first attempt.
+	InitialInterval time.Duration
+	// MaxInterval caps the delay between two attempts.
+	MaxInterval time.Duration
+	// Multiplier is the factor applied to the delay after each attempt.
+	Multiplier float64
+	// Jitter is the randomization factor (between 0 and 1) applied to each delay.
+	Jitter float64
+}
+
+// Duration returns the delay to wait before the given attempt (starting at 0).
+func (b *Backoff) Duration(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(b.InitialInterval) * math.Pow(multiplier, float64(attempt))
+
+	if b.MaxInterval > 0 && delay > float64(b.MaxInterval) {
+		delay = float64(b.MaxInterval)
+	}
+
+	if b.Jitter > 0 {
+		// pick a random value in [delay - jitter * delay, delay + jitter * delay]
+		delta := b.Jitter * delay
+		delay = delay - delta + rand.Float64()*(2*delta) // nolint: gas, no need for a cryptographically secure random here
+	}
+
+	// without MaxInterval the delay eventually overflows (up to +Inf), which time.Duration cannot hold
+	if delay >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	Convey("Given a backoff without jitter", t, func() {
+		backoff := &Backoff{
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     time.Second,
+			Multiplier:      2,
+		}
+
+		var data = []struct {
+			attempt       int           // attempt number
+			expectedDelay time.Duration // expected delay
+		}{
+			{0, 100 * time.Millisecond},
+			{1, 200 * time.Millisecond},
+			{2, 400 * time.Millisecond},
+			{3, 800 * time.Millisecond},
+			{4, time.Second},
+			{10, time.Second},
+		}
+
+		for _, tt := range data {
+			Convey(fmt.Sprintf("When we compute the delay of the attempt %d", tt.attempt), func() {
+				delay := backoff.Duration(tt.attempt)
+
+				Convey(fmt.Sprintf("The delay should be %s", tt.expectedDelay), func() {
+					So(delay, ShouldEqual, tt.expectedDelay)
+				})
+			})
+		}
+	})
+
+	Convey("Given a backoff with a jitter of 50%", t, func() {
+		backoff := &Backoff{
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     time.Second,
+			Multiplier:      2,
+			Jitter:          0.5,
+		}
+
+		Convey("When we compute the delay of the attempt 1 several times", func() {
+			for i := 0; i < 100; i++ {
+				delay := backoff.Duration(1)
+
+				So(delay, ShouldBeBetweenOrEqual, 100*time.Millisecond, 300*time.Millisecond)
+			}
+		})
+	})
+	Convey("Given a backoff without maximum interval", t, func() {
+		backoff := &Backoff{
+			InitialInterval: 100 * time.Millisecond,
+			Multiplier:      2,
+		}
+
+		Convey("When we compute the delay of a large attempt", func() {
+			delay := backoff.Duration(5000)
+
+			Convey("The delay should be the longest duration", func() {
+				So(delay, ShouldEqual, time.Duration(math.MaxInt64))
+			})
+		})
+	})
+}
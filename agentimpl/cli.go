@@ -19,12 +19,16 @@ import (
 	"github.com/crucibuild/sdk-agent-go/agentiface"
 	"github.com/crucibuild/sdk-agent-go/util"
 	"github.com/spf13/cobra"
+	"os"
 )
 
 // Cli implements command line argument parsing.
 type Cli struct {
 	agent   agentiface.Agent
 	rootCmd *cobra.Command
+
+	// termination signals trapped while the command line is executed, used by Run
+	signals <-chan os.Signal
 }
 
 // NewCli creates an new Command Line Interface for the agent.
@@ -63,15 +67,30 @@ func NewCli(a agentiface.Agent) *Cli {
 	return cli
 }
 
-// ParseCommandLine parse the arguments
-func (cli *Cli) ParseCommandLine() error {
-	err := cli.rootCmd.Execute()
+// ParseCommandLine parse the arguments and executes the command. If the command leaves the agent connected, it
+// waits until SIGINT or SIGTERM is received or the agent quits, then shuts the agent down gracefully.
+// It returns the exit status of the agent.
+func (cli *Cli) ParseCommandLine() int {
+	signals, restore := trapSignals()
+	defer restore()
+
+	return cli.execute(signals)
+}
+
+// execute executes the command, the termination signals being received through signals.
+func (cli *Cli) execute(signals <-chan os.Signal) int {
+	cli.signals = signals
+	defer func() {
+		cli.signals = nil
+	}()
 
-	if err != nil {
+	if err := cli.rootCmd.Execute(); err != nil {
 		cli.agent.Error("Command failed: %s", err.Error())
+		cli.agent.Close() // nolint: errcheck, the command already failed
+		return agentiface.ExitFailure
 	}
 
-	return err
+	return awaitTermination(cli.agent, signals)
 }
 
 // RegisterCommand register additional commands available via the command line.
@@ -15,7 +15,13 @@
 package cmd
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
 	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -31,14 +37,96 @@ func cmdAgentStart(a agentiface.Agent) *cobra.Command {
 	command := &cobra.Command{
 		Use:   "agent:start",
 		Short: "Start the agent",
-		Long:  `Start the agent.`,
+		Long: `Start the agent and run it in the foreground until it receives SIGINT or SIGTERM.
+With --detach, the agent is detached from the terminal and runs in the background.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return a.Connect()
+			foreground, err := cmd.Flags().GetBool("foreground")
+
+			if err != nil {
+				return err
+			}
+
+			background, err := cmd.Flags().GetBool("detach")
+
+			if err != nil {
+				return err
+			}
+
+			if background || !foreground {
+				return detach(a)
+			}
+
+			pidfile, err := cmd.Flags().GetString("pidfile")
+
+			if err != nil {
+				return err
+			}
+
+			if pidfile != "" {
+				if err := writePidfile(pidfile); err != nil {
+					return err
+				}
+				defer removePidfile(a, pidfile)
+			}
+
+			return a.Run()
 		},
 	}
 
 	command.Flags().String("endpoint", "", "endpoint")
 	a.BindConfigPFlag("endpoint", command.Flags().Lookup("endpoint")) // nolint: errcheck, no error can occur here, by construction.
 
+	command.Flags().Bool("foreground", true, "Run the agent in the foreground (--foreground=false is the same as --detach)")
+	command.Flags().Bool("detach", false, "Run the agent in the background, detached from the terminal")
+	command.Flags().String("pidfile", "", "File in which the pid of the agent is written")
+
 	return command
 }
+
+// detach starts the agent again in the background, with the same arguments run in the foreground.
+func detach(a agentiface.Agent) error {
+	executable, err := os.Executable()
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to detach the agent")
+	}
+
+	process := exec.Command(executable, foregroundArgs(os.Args[1:])...)
+	process.SysProcAttr = detachedProcAttr()
+
+	if err := process.Start(); err != nil {
+		return errors.Wrap(err, "Failed to detach the agent")
+	}
+
+	a.Info("Agent started in the background (pid %d)", process.Process.Pid)
+
+	return process.Process.Release()
+}
+
+// foregroundArgs returns the arguments of the command line running the agent in the foreground: the flags are
+// inserted before the terminator of the flags (--), if any.
+func foregroundArgs(args []string) []string {
+	flags := []string{"--detach=false", "--foreground=true"}
+
+	for i, arg := range args {
+		if arg == "--" {
+			return append(append(append([]string(nil), args[:i]...), flags...), args[i:]...)
+		}
+	}
+
+	return append(append([]string(nil), args...), flags...)
+}
+
+// writePidfile writes the pid of the current process in a file.
+func writePidfile(path string) error {
+	err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+
+	return errors.Wrapf(err, "Failed to write pidfile '%s'", path)
+}
+
+// removePidfile removes the file holding the pid of the current process.
+func removePidfile(a agentiface.Agent, path string) {
+	if err := os.Remove(path); err != nil {
+		a.Warning("Failed to remove pidfile: %s", err.Error())
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestForegroundArgs(t *testing.T) {
+	Convey("Given the arguments of an agent started in the background", t, func() {
+		Convey("When they have no terminator", func() {
+			args := foregroundArgs([]string{"agent:start", "--detach", "--pidfile", "agent.pid"})
+
+			Convey("Then the flags running the agent in the foreground are appended", func() {
+				So(args, ShouldResemble, []string{"agent:start", "--detach", "--pidfile", "agent.pid", "--detach=false", "--foreground=true"})
+			})
+		})
+
+		Convey("When they have a terminator", func() {
+			args := foregroundArgs([]string{"agent:start", "--detach", "--", "--foreground=false"})
+
+			Convey("Then the flags running the agent in the foreground are inserted before it", func() {
+				So(args, ShouldResemble, []string{"agent:start", "--detach", "--detach=false", "--foreground=true", "--", "--foreground=false"})
+			})
+		})
+	})
+}
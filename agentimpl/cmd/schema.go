@@ -15,18 +15,24 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/crucibuild/sdk-agent-go/agentiface"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
+// SchemaFileLoader loads the schema held by a file.
+type SchemaFileLoader func(file string) (agentiface.Schema, error)
+
 // RegisterCmdSchema registers command line "schema" command which enables the user to interact with the agent schemas.
-func RegisterCmdSchema(a agentiface.Agent) {
+func RegisterCmdSchema(a agentiface.Agent, load SchemaFileLoader) {
 	// Manage flags:
 
 	// Register commands
 	a.RegisterCommand(cmdSchemaList(a))
 	a.RegisterCommand(cmdSchemaGet(a))
+	a.RegisterCommand(cmdSchemaCheck(a, load))
 }
 
 func cmdSchemaList(a agentiface.Agent) *cobra.Command {
@@ -68,3 +74,59 @@ func cmdSchemaGet(a agentiface.Agent) *cobra.Command {
 
 	return command
 }
+
+func cmdSchemaCheck(a agentiface.Agent, load SchemaFileLoader) *cobra.Command {
+	var compatibility string
+
+	command := &cobra.Command{
+		Use:   "schema:check <file> [previous file]",
+		Short: "Check the compatibility of a new version of a schema",
+		Long: `Check that the schema held by a file is compatible with its previous version: the one held by the
+previous file if given, the latest version registered in the agent otherwise`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 || len(args) > 2 {
+				return errors.New("Expected a schema file and optionally the file of its previous version")
+			}
+
+			level := compatibility
+			if level == "" {
+				level = a.GetConfigString("schema.compatibility")
+			}
+
+			c, err := agentiface.ParseCompatibility(level)
+			if err != nil {
+				return err
+			}
+
+			next, err := load(args[0])
+			if err != nil {
+				return errors.Wrapf(err, "Failed to load schema file '%s'", args[0])
+			}
+
+			var previous agentiface.Schema
+			if len(args) == 2 {
+				previous, err = load(args[1])
+				if err != nil {
+					return errors.Wrapf(err, "Failed to load schema file '%s'", args[1])
+				}
+			} else {
+				previous, err = a.SchemaGetByID(next.ID())
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := a.SchemaCheckCompatibility(previous, next, c); err != nil {
+				return errors.Wrapf(err, "Schema '%s' is not %s compatible", next.ID(), c)
+			}
+
+			println(fmt.Sprintf("Schema '%s' is %s compatible", next.ID(), c))
+
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&compatibility, "compatibility", "", "compatibility level to check: none, backward, forward or full (defaults to the configuration)")
+
+	return command
+}
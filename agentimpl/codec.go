@@ -0,0 +1,473 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/crucibuild/sdk-agent-go/util"
+	"github.com/elodina/go-avro"
+)
+
+// avroCodec serializes the messages described by an Avro schema in the Avro binary encoding.
+type avroCodec struct{}
+
+// ContentType returns agentiface.MimeTypeAvro.
+func (avroCodec) ContentType() string {
+	return agentiface.MimeTypeAvro
+}
+
+// Supports returns true for the Avro schemas only.
+func (avroCodec) Supports(schema agentiface.Schema) bool {
+	return schema.MimeType() == MimeTypeAvroSchema
+}
+
+// Code serializes the message with the schema.
+func (avroCodec) Code(schema agentiface.Schema, o interface{}) ([]byte, error) {
+	return schema.Code(o)
+}
+
+// Decode unserializes the message with the schema, resolving the schema it has been written with if any.
+func (avroCodec) Decode(schema agentiface.Schema, o []byte, t agentiface.Type) (interface{}, error) {
+	return schema.Decode(o, t)
+}
+
+// jsonCodec serializes the messages in JSON, whatever their schema. The messages described by an Avro schema are
+// serialized as JSON objects holding the fields of the schema (see avroJSONValue), so that they can be written without
+// the Go types of the messages.
+type jsonCodec struct{}
+
+// ContentType returns agentiface.MimeTypeJSON.
+func (jsonCodec) ContentType() string {
+	return agentiface.MimeTypeJSON
+}
+
+// Supports returns true for all the schemas.
+func (jsonCodec) Supports(agentiface.Schema) bool {
+	return true
+}
+
+// SelfDescribing returns true: the JSON objects are read by the names of their fields, whatever the revision of the
+// schema they have been written with.
+func (jsonCodec) SelfDescribing() bool {
+	return true
+}
+
+// Code serializes the message in JSON.
+func (jsonCodec) Code(schema agentiface.Schema, o interface{}) ([]byte, error) {
+	s, ok := schema.(*AvroSchema)
+	if !ok {
+		return json.Marshal(o)
+	}
+
+	// the message is written in Avro first, to check it against the schema and to name its fields after the schema
+	b, err := s.Code(o)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := avroJSONValue(s.schema, avro.NewBinaryDecoder(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+// Decode unserializes the message from JSON, checking it against the schema.
+func (jsonCodec) Decode(schema agentiface.Schema, o []byte, t agentiface.Type) (interface{}, error) {
+	switch s := schema.(type) {
+	case *AvroSchema:
+		decoder := json.NewDecoder(bytes.NewReader(o))
+		decoder.UseNumber()
+
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		value, err := avroFromJSON(s.schema, v)
+		if err != nil {
+			return nil, fmt.Errorf("Not Acceptable: Message-type '%s' is invalid: %s", s.ID(), err.Error())
+		}
+
+		buffer := new(bytes.Buffer)
+		if err := avro.NewGenericDatumWriter().SetSchema(s.schema).Write(value, avro.NewBinaryEncoder(buffer)); err != nil {
+			return nil, err
+		}
+
+		return (&AvroSchema{schema: s.schema}).Decode(buffer.Bytes(), t)
+	case *JSONSchema:
+		if err := s.checkRequired(o); err != nil {
+			return nil, fmt.Errorf("Not Acceptable: Message-type '%s' is invalid: %s", s.ID(), err.Error())
+		}
+	}
+
+	decodedRecord := util.New(t.Type())
+
+	err := json.Unmarshal(o, decodedRecord)
+
+	return decodedRecord, err
+}
+
+// selfDescribingCodec is implemented by the codecs whose data can be read whatever the revision of the schema it has
+// been written with: the writer schema of the messages they decode is not resolved (see Messaging.decode).
+type selfDescribingCodec interface {
+	SelfDescribing() bool
+}
+
+// resolvesWriter returns true if the codec decodes the messages with the schema they have been written with.
+func resolvesWriter(codec agentiface.Codec) bool {
+	c, ok := codec.(selfDescribingCodec)
+
+	return !ok || !c.SelfDescribing()
+}
+
+// avroJSONValue reads a value written in Avro with the schema and returns it as a value serialized in JSON: the records
+// and the maps are objects, the unions are their value, the enums are their symbol and the bytes are strings of
+// ISO-8859-1 characters, as the default values of the schema.
+func avroJSONValue(s avro.Schema, dec avro.Decoder) (interface{}, error) {
+	s = actualAvroSchema(s)
+
+	switch s.Type() {
+	case avro.Union:
+		i, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		types := s.(*avro.UnionSchema).Types
+		if i < 0 || int(i) >= len(types) {
+			return nil, fmt.Errorf("Invalid union index %d", i)
+		}
+		return avroJSONValue(types[i], dec)
+	case avro.Null:
+		return nil, nil
+	case avro.Boolean:
+		return dec.ReadBoolean()
+	case avro.Int:
+		return dec.ReadInt()
+	case avro.Long:
+		return dec.ReadLong()
+	case avro.Float:
+		return dec.ReadFloat()
+	case avro.Double:
+		return dec.ReadDouble()
+	case avro.Bytes:
+		b, err := dec.ReadBytes()
+		return avroJSONBytes(b), err
+	case avro.String:
+		return dec.ReadString()
+	case avro.Enum:
+		i, err := dec.ReadEnum()
+		if err != nil {
+			return nil, err
+		}
+		symbols := s.(*avro.EnumSchema).Symbols
+		if i < 0 || int(i) >= len(symbols) {
+			return nil, fmt.Errorf("Invalid enum index %d", i)
+		}
+		return symbols[i], nil
+	case avro.Fixed:
+		b := make([]byte, s.(*avro.FixedSchema).Size)
+		err := dec.ReadFixed(b)
+		return avroJSONBytes(b), err
+	case avro.Array:
+		values := []interface{}{}
+		n, err := dec.ReadArrayStart()
+		for ; n != 0 && err == nil; n, err = dec.ArrayNext() {
+			for j := int64(0); j < n; j++ {
+				v, err := avroJSONValue(s.(*avro.ArraySchema).Items, dec)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		}
+		return values, err
+	case avro.Map:
+		values := make(map[string]interface{})
+		n, err := dec.ReadMapStart()
+		for ; n != 0 && err == nil; n, err = dec.MapNext() {
+			for j := int64(0); j < n; j++ {
+				k, err := dec.ReadString()
+				if err != nil {
+					return nil, err
+				}
+				v, err := avroJSONValue(s.(*avro.MapSchema).Values, dec)
+				if err != nil {
+					return nil, err
+				}
+				values[k] = v
+			}
+		}
+		return values, err
+	case avro.Record:
+		fields := make(map[string]interface{}, len(s.(*avro.RecordSchema).Fields))
+		for _, field := range s.(*avro.RecordSchema).Fields {
+			v, err := avroJSONValue(field.Type, dec)
+			if err != nil {
+				return nil, err
+			}
+			fields[field.Name] = v
+		}
+		return fields, nil
+	default:
+		return nil, fmt.Errorf("Unsupported Avro type %s", s.GetName())
+	}
+}
+
+// avroJSONBytes returns bytes as a string of ISO-8859-1 characters (see avroDefaultBytes).
+func avroJSONBytes(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return string(runes)
+}
+
+// avroFromJSON converts a value parsed from JSON (with json.Number) into a generic value of the schema (see
+// avroJSONValue). The fields of a record missing from the value get their default value, if any.
+func avroFromJSON(s avro.Schema, v interface{}) (interface{}, error) {
+	s = actualAvroSchema(s)
+
+	switch s.Type() {
+	case avro.Union:
+		for _, t := range s.(*avro.UnionSchema).Types {
+			if value, err := avroFromJSON(t, v); err == nil {
+				return value, nil
+			}
+		}
+	case avro.Null:
+		if v == nil {
+			return nil, nil
+		}
+	case avro.Boolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case avro.Int, avro.Long:
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				if s.Type() == avro.Long {
+					return i, nil
+				}
+				if i >= math.MinInt32 && i <= math.MaxInt32 {
+					return int32(i), nil
+				}
+			}
+		}
+	case avro.Float, avro.Double:
+		if n, ok := v.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				if s.Type() == avro.Float {
+					return float32(f), nil
+				}
+				return f, nil
+			}
+		}
+	case avro.String:
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+	case avro.Bytes, avro.Fixed:
+		if str, ok := v.(string); ok {
+			b, err := avroDefaultBytes(str)
+			if err != nil {
+				return nil, err
+			}
+			if s.Type() == avro.Fixed && len(b) != s.(*avro.FixedSchema).Size {
+				return nil, fmt.Errorf("%q is not a valid %s of %d bytes", str, s.GetName(), s.(*avro.FixedSchema).Size)
+			}
+			return b, nil
+		}
+	case avro.Enum:
+		if str, ok := v.(string); ok {
+			return newAvroEnum(s.(*avro.EnumSchema), str)
+		}
+	case avro.Array:
+		if items, ok := v.([]interface{}); ok {
+			values := make([]interface{}, len(items))
+			for i, item := range items {
+				value, err := avroFromJSON(s.(*avro.ArraySchema).Items, item)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = value
+			}
+			return values, nil
+		}
+	case avro.Map:
+		if items, ok := v.(map[string]interface{}); ok {
+			values := make(map[string]interface{}, len(items))
+			for k, item := range items {
+				value, err := avroFromJSON(s.(*avro.MapSchema).Values, item)
+				if err != nil {
+					return nil, err
+				}
+				values[k] = value
+			}
+			return values, nil
+		}
+	case avro.Record:
+		if fields, ok := v.(map[string]interface{}); ok {
+			return avroRecordFromJSON(s.(*avro.RecordSchema), fields)
+		}
+	}
+
+	return nil, fmt.Errorf("%v is not a valid %s", v, s.GetName())
+}
+
+// avroRecordFromJSON converts the fields of a record parsed from JSON into a generic record of the schema.
+func avroRecordFromJSON(s *avro.RecordSchema, fields map[string]interface{}) (interface{}, error) {
+	record := avro.NewGenericRecord(s)
+
+	for _, field := range s.Fields {
+		v, ok := fields[field.Name]
+
+		if !ok {
+			if !avroHasDefault(field) {
+				return nil, fmt.Errorf("Field %s of %s is missing", field.Name, s.GetName())
+			}
+
+			value, err := avroDefaultValue(field.Type, field.Default)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid default value of field %s: %s", field.Name, err.Error())
+			}
+			record.Set(field.Name, value)
+			continue
+		}
+
+		value, err := avroFromJSON(field.Type, v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid field %s of %s: %s", field.Name, s.GetName(), err.Error())
+		}
+		record.Set(field.Name, value)
+	}
+
+	return record, nil
+}
+
+// RegisterCodec registers a codec serializing the messages in its content type, replacing the codec registered for
+// the same content type. The messages are received in any content type for which a codec is registered.
+func (m *Messaging) RegisterCodec(codec agentiface.Codec) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, c := range m.codecs {
+		if c.ContentType() == codec.ContentType() {
+			m.codecs[i] = codec
+			return
+		}
+	}
+
+	m.codecs = append(m.codecs, codec)
+}
+
+// PreferContentType sets the content type of the messages sent to an agent, when the codec of this content type
+// supports their schema. An empty content type removes the preference.
+func (m *Messaging) PreferContentType(to string, contentType string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if contentType == "" {
+		delete(m.preferredContentTypes, to)
+		return nil
+	}
+
+	if m.findCodec(contentType) == nil {
+		return fmt.Errorf("No codec registered for the content type '%s'", contentType)
+	}
+
+	m.preferredContentTypes[to] = contentType
+
+	return nil
+}
+
+// codec returns the codec registered for a content type, or nil if none.
+func (m *Messaging) codec(contentType string) agentiface.Codec {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.findCodec(contentType)
+}
+
+// findCodec returns the codec registered for a content type, ignoring its parameters (e.g. charset), or nil if none.
+// The caller must hold the mutex.
+func (m *Messaging) findCodec(contentType string) agentiface.Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	for _, c := range m.codecs {
+		if c.ContentType() == mediaType {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// encodingCodec returns the codec serializing a message described by the schema: the codec of the content type
+// explicitly requested for the message if any, else of the preferred content type if its codec supports the
+// schema, or else the first registered codec supporting the schema.
+func (m *Messaging) encodingCodec(schema agentiface.Schema, requested string, preferred string) (agentiface.Codec, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if requested != "" {
+		c := m.findCodec(requested)
+		if c == nil || !c.Supports(schema) {
+			return nil, fmt.Errorf("Not Acceptable: Message-type '%s' cannot be sent as %s", schema.ID(), requested)
+		}
+		return c, nil
+	}
+
+	if c := m.findCodec(preferred); c != nil && c.Supports(schema) {
+		return c, nil
+	}
+
+	for _, c := range m.codecs {
+		if c.Supports(schema) {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Not Acceptable: Message-type '%s' is not supported by any codec", schema.ID())
+}
+
+// preferredContentType returns the content type preferred for a message sent to an agent: the one set with
+// PreferContentType, else the content type of the received message (parent) when replying to its sender.
+func (m *Messaging) preferredContentType(parent *Ctx, to string) string {
+	m.mutex.RLock()
+	preferred, ok := m.preferredContentTypes[to]
+	m.mutex.RUnlock()
+
+	if ok {
+		return preferred
+	}
+
+	if parent != nil && to != "" && to == parent.envelope.ReplyTo {
+		return parent.envelope.ContentType
+	}
+
+	return ""
+}
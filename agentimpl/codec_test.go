@@ -0,0 +1,271 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContentType(t *testing.T) {
+	Convey("Given an agent knowing an Avro and a JSON schema", t, func() {
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "sender", nil)
+
+		_, err := agent.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = agent.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		Convey("Then the content type of the messages follows the encoding of their schema", func() {
+			So(mustPrepare(agent, &customerV1{Name: "john"}).ContentType, ShouldEqual, agentiface.MimeTypeAvro)
+			So(mustPrepare(agent, &person{FirstName: "john"}).ContentType, ShouldEqual, agentiface.MimeTypeJSON)
+		})
+
+		Convey("When a message is sent in a given content type", func() {
+			envelope := mustPrepare(agent, agentiface.WithContentType(&customerV1{Name: "john", Age: 42}, agentiface.MimeTypeJSON))
+
+			Convey("Then it is serialized in this content type", func() {
+				var decoded customerV1
+				So(envelope.ContentType, ShouldEqual, agentiface.MimeTypeJSON)
+				So(json.Unmarshal(envelope.Body, &decoded), ShouldBeNil)
+				So(decoded, ShouldResemble, customerV1{Name: "john", Age: 42})
+			})
+		})
+
+		Convey("When a message described by an Avro schema is sent in JSON", func() {
+			envelope := mustPrepare(agent, agentiface.WithContentType(&schemaGet{ID: "Customer"}, agentiface.MimeTypeJSON))
+
+			Convey("Then its fields are named after the schema", func() {
+				So(string(envelope.Body), ShouldEqual, `{"fingerprint":"","id":"Customer"}`)
+			})
+		})
+
+		Convey("When a message is sent in a content type its schema does not support", func() {
+			_, err := agent.preparePublishing(nil, "", agentiface.WithContentType(&person{}, agentiface.MimeTypeAvro))
+
+			Convey("Then it is not sent", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a content type without codec is preferred", func() {
+			err := agent.PreferContentType("receiver", "application/xml")
+
+			Convey("Then the preference is refused", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a content type is preferred for an agent", func() {
+			So(agent.PreferContentType("receiver", agentiface.MimeTypeJSON), ShouldBeNil)
+
+			Convey("Then the messages sent to this agent are serialized in this content type", func() {
+				envelope, err := agent.preparePublishing(nil, "receiver", &customerV1{Name: "john"})
+				So(err, ShouldBeNil)
+				So(envelope.ContentType, ShouldEqual, agentiface.MimeTypeJSON)
+			})
+
+			Convey("Then the messages sent to the other agents are not", func() {
+				envelope, err := agent.preparePublishing(nil, "other", &customerV1{Name: "john"})
+				So(err, ShouldBeNil)
+				So(envelope.ContentType, ShouldEqual, agentiface.MimeTypeAvro)
+			})
+		})
+	})
+}
+
+func TestContentTypeOnTheWire(t *testing.T) {
+	Convey("Given an agent handling an Avro command", t, func() {
+		broker := NewLoopbackBroker()
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := receiver.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = receiver.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		customers := make(chan interface{}, 1)
+		_, err = receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+			customers <- ctx.Message()
+			return ctx.SendCommand("", &customerV1{Name: "jane", Age: 24})
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When another agent prefers to send it in JSON", func() {
+			sender := newTestAgent(broker, "sender", nil)
+			Reset(func() {
+				sender.Disconnect() // nolint: errcheck
+			})
+
+			_, err := sender.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+			So(err, ShouldBeNil)
+			_, err = sender.TypeRegister(customerType(customerV1{}))
+			So(err, ShouldBeNil)
+			So(sender.PreferContentType("receiver", agentiface.MimeTypeJSON), ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+
+			Convey("Then the agent decodes the command", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV1{Name: "john", Age: 42})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When another agent knowing another revision of its schema sends it in JSON", func() {
+			sender := newTestAgent(broker, "sender", nil)
+			Reset(func() {
+				sender.Disconnect() // nolint: errcheck
+			})
+
+			_, err := sender.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+			So(err, ShouldBeNil)
+			_, err = sender.TypeRegister(customerType(customerV2{}))
+			So(err, ShouldBeNil)
+			So(sender.PreferContentType("receiver", agentiface.MimeTypeJSON), ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &customerV2{Name: "john", Age: 42, Email: "john@doe.com"}), ShouldBeNil)
+
+			Convey("Then the agent decodes the command without knowing the revision", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV1{Name: "john", Age: 42})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When a script without schema sends it in JSON", func() {
+			script := broker.NewTransport()
+			So(script.Connect(nil), ShouldBeNil)
+
+			replies := make(chan *agentiface.Envelope, 1)
+			_, err := script.Subscribe(agentiface.Subscription{
+				Destination: agentiface.DestinationCommand,
+				Exclusive:   true,
+				Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "script"}},
+			}, func(e *agentiface.Envelope) {
+				replies <- e
+			})
+			So(err, ShouldBeNil)
+
+			So(script.Publish(agentiface.DestinationCommand, &agentiface.Envelope{
+				ContentType: "application/json; charset=utf-8",
+				MessageID:   "1",
+				Type:        "Customer",
+				ReplyTo:     "script",
+				Headers: map[string]interface{}{
+					agentiface.AmqpHeaderType:   "Customer",
+					agentiface.AmqpHeaderSendTo: "receiver",
+				},
+				Body: []byte(`{"name": "john", "age": 42}`),
+			}), ShouldBeNil)
+
+			Convey("Then the agent decodes the command", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV1{Name: "john", Age: 42})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+
+			Convey("Then the agent replies in JSON", func() {
+				select {
+				case reply := <-replies:
+					var decoded customerV1
+					So(reply.ContentType, ShouldEqual, agentiface.MimeTypeJSON)
+					So(json.Unmarshal(reply.Body, &decoded), ShouldBeNil)
+					So(decoded, ShouldResemble, customerV1{Name: "jane", Age: 24})
+				case <-time.After(receiveTimeout):
+					So("reply not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestJSONCodec(t *testing.T) {
+	Convey("Given the JSON codec", t, func() {
+		codec := jsonCodec{}
+		customerV2Schema := loadCustomerSchema(customerSchemaV2)
+		customerV3Schema := loadCustomerSchema(customerSchemaV3)
+
+		Convey("When a message described by an Avro schema is coded and decoded", func() {
+			nickname := "jo"
+			b, err := codec.Code(loadCustomerSchema(customerSchemaV1), &customerV1{Name: "john", Age: 42, Nickname: &nickname})
+			So(err, ShouldBeNil)
+
+			decoded, err := codec.Decode(loadCustomerSchema(customerSchemaV1), b, customerType(customerV1{}))
+
+			Convey("Then the union is serialized as its value and the message is unchanged", func() {
+				So(string(b), ShouldEqual, `{"age":42,"name":"john","nickname":"jo"}`)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, &customerV1{Name: "john", Age: 42, Nickname: &nickname})
+			})
+		})
+
+		Convey("When a JSON object misses a field with a default value", func() {
+			decoded, err := codec.Decode(customerV2Schema, []byte(`{"name": "john", "age": 42}`), customerType(customerV2{}))
+
+			Convey("Then the field gets its default value", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "unknown"})
+			})
+		})
+
+		Convey("When a JSON object misses a field without default value", func() {
+			_, err := codec.Decode(customerV3Schema, []byte(`{"name": "john", "age": 42}`), customerType(customerV2{}))
+
+			Convey("Then it is refused", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Field vip of Customer is missing")
+			})
+		})
+
+		Convey("When a field of a JSON object does not match its type", func() {
+			_, err := codec.Decode(customerV2Schema, []byte(`{"name": "john", "age": "42"}`), customerType(customerV2{}))
+
+			Convey("Then it is refused", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Invalid field age of Customer")
+			})
+		})
+
+		Convey("When a JSON object misses a property required by its JSON schema", func() {
+			schema, err := LoadJSONSchema(personSchema)
+			So(err, ShouldBeNil)
+
+			_, err = codec.Decode(schema, []byte(`{"firstName": "john", "age": 42}`), personType)
+
+			Convey("Then it is refused", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Property lastName is missing")
+			})
+		})
+	})
+}
@@ -27,6 +27,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Config represents an agent configuration data.
@@ -158,3 +159,23 @@ func (config *Config) PrintConfig(w io.Writer) error {
 func (config *Config) GetConfigString(key string) string {
 	return config.viper.GetString(key)
 }
+
+// GetConfigBool returns the value matching the key in parameter from the configuration file as a boolean.
+func (config *Config) GetConfigBool(key string) bool {
+	return config.viper.GetBool(key)
+}
+
+// GetConfigInt returns the value matching the key in parameter from the configuration file as an integer.
+func (config *Config) GetConfigInt(key string) int {
+	return config.viper.GetInt(key)
+}
+
+// GetConfigFloat64 returns the value matching the key in parameter from the configuration file as a float.
+func (config *Config) GetConfigFloat64(key string) float64 {
+	return config.viper.GetFloat64(key)
+}
+
+// GetConfigDuration returns the value matching the key in parameter from the configuration file as a duration.
+func (config *Config) GetConfigDuration(key string) time.Duration {
+	return config.viper.GetDuration(key)
+}
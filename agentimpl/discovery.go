@@ -0,0 +1,187 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// configSchemaDiscovery enables fetching the unknown revisions of the schemas of the received messages from their
+	// senders.
+	configSchemaDiscovery = "schema.discovery"
+
+	// configSchemaDiscoveryTimeout is the maximum time waited for the schema fetched from a sender.
+	configSchemaDiscoveryTimeout = "schema.discovery.timeout"
+)
+
+// schemaGet is the command agentiface.MessageSchemaGet, requesting a schema given its id and the fingerprint of its
+// revision (the latest version if empty).
+type schemaGet struct {
+	ID          string `avro:"id"`
+	Fingerprint string `avro:"fingerprint"`
+}
+
+// schemaDefinition is the command agentiface.MessageSchemaDefinition, replying to agentiface.MessageSchemaGet. Its
+// raw definition is empty if the schema is unknown.
+type schemaDefinition struct {
+	ID       string `avro:"id"`
+	MimeType string `avro:"mimeType"`
+	Raw      string `avro:"raw"`
+}
+
+const schemaGetSchema = `{
+	"type": "record",
+	"name": "SchemaGet",
+	"namespace": "crucibuild",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "fingerprint", "type": "string"}
+	]
+}`
+
+const schemaDefinitionSchema = `{
+	"type": "record",
+	"name": "SchemaDefinition",
+	"namespace": "crucibuild",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "mimeType", "type": "string"},
+		{"name": "raw", "type": "string"}
+	]
+}`
+
+// registerSchemaDiscovery registers the messages of the schema discovery protocol and makes the agent answer
+// agentiface.MessageSchemaGet.
+func registerSchemaDiscovery(a *Agent) error {
+	messages := []struct {
+		id      string
+		raw     string
+		message interface{}
+	}{
+		{agentiface.MessageSchemaGet, schemaGetSchema, schemaGet{}},
+		{agentiface.MessageSchemaDefinition, schemaDefinitionSchema, schemaDefinition{}},
+	}
+
+	for _, message := range messages {
+		// the messages are identified by their well-known name rather than by the name of their record
+		schema, err := LoadAvroSchemaWithID(message.id, message.raw, NewSchemaRegistry(nil))
+		if err != nil {
+			return err
+		}
+
+		if _, err := a.SchemaRegister(schema); err != nil {
+			return err
+		}
+
+		t, err := NewTypeFromInterface(message.id, message.message)
+		if err != nil {
+			return err
+		}
+
+		if _, err := a.TypeRegister(t); err != nil {
+			return err
+		}
+	}
+
+	_, err := a.RegisterCommandCallback(agentiface.MessageSchemaGet, a.Messaging.answerSchemaGet)
+
+	return err
+}
+
+// answerSchemaGet replies to agentiface.MessageSchemaGet with the definition of the requested schema.
+func (m *Messaging) answerSchemaGet(ctx agentiface.CommandCtx) error {
+	request := ctx.Message().(*schemaGet)
+
+	var schema agentiface.Schema
+	var err error
+
+	if request.Fingerprint != "" {
+		schema, err = m.agent.SchemaGetByFingerprint(request.Fingerprint)
+	} else {
+		schema, err = m.agent.SchemaGetByID(request.ID)
+	}
+
+	definition := &schemaDefinition{ID: request.ID}
+
+	if err == nil && schema.ID() == request.ID {
+		definition.MimeType = schema.MimeType()
+		definition.Raw = schema.Raw()
+	}
+
+	return ctx.SendCommand("", definition)
+}
+
+// discoveryEnabled returns true if the unknown schemas of an envelope can be fetched from its sender.
+func (m *Messaging) discoveryEnabled(e *agentiface.Envelope) bool {
+	return m.agent.GetConfigBool(configSchemaDiscovery) && e.ReplyTo != "" && e.ReplyTo != m.agent.ID()
+}
+
+// fetchSchema fetches the schema an envelope has been written with from its sender, given its id and the fingerprint
+// of its revision. The fetched schemas are cached by fingerprint: they are not registered, to keep the registry
+// holding the schemas of the agent only.
+func (m *Messaging) fetchSchema(e *agentiface.Envelope, id string, fingerprint string) (agentiface.Schema, error) {
+	m.mutex.RLock()
+	schema, ok := m.fetchedSchemas[fingerprint]
+	m.mutex.RUnlock()
+
+	if ok {
+		return schema, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.agent.GetConfigDuration(configSchemaDiscoveryTimeout))
+	defer cancel()
+
+	reply, err := m.Request(ctx, e.ReplyTo, &schemaGet{ID: id, Fingerprint: fingerprint})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch schema '%s' from '%s'", id, e.ReplyTo)
+	}
+
+	definition, ok := reply.Message().(*schemaDefinition)
+	if !ok || definition.Raw == "" {
+		return nil, fmt.Errorf("Schema '%s' is unknown to '%s'", id, e.ReplyTo)
+	}
+
+	switch definition.MimeType {
+	case MimeTypeAvroSchema:
+		schema, err = LoadAvroSchema(definition.Raw, NewSchemaRegistry(nil))
+	case MimeTypeJSONSchema:
+		schema, err = LoadJSONSchema(definition.Raw)
+	default:
+		err = fmt.Errorf("Unsupported mime type %s", definition.MimeType)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load schema '%s' fetched from '%s'", id, e.ReplyTo)
+	}
+
+	if schema.ID() != id {
+		return nil, fmt.Errorf("Schema '%s' fetched from '%s' has the id '%s'", id, e.ReplyTo, schema.ID())
+	}
+
+	if f, ok := schema.(agentiface.FingerprintedSchema); !ok || f.Fingerprint() != fingerprint {
+		return nil, fmt.Errorf("Schema '%s' fetched from '%s' does not have the fingerprint '%s'", id, e.ReplyTo, fingerprint)
+	}
+
+	m.mutex.Lock()
+	m.fetchedSchemas[fingerprint] = schema
+	m.mutex.Unlock()
+
+	return schema, nil
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchemaDiscovery(t *testing.T) {
+	Convey("Given two agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+			configSchemaDiscovery: true,
+		})
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := sender.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = sender.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		customers := make(chan interface{}, 1)
+		_, err = receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+			customers <- ctx.Message()
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When an agent requests one of the schemas of another agent", func() {
+			reply, err := receiver.Request(context.Background(), "sender", &schemaGet{ID: "Customer"})
+
+			Convey("Then the other agent replies with its definition", func() {
+				So(err, ShouldBeNil)
+				So(reply.Message(), ShouldResemble, &schemaDefinition{
+					ID:       "Customer",
+					MimeType: MimeTypeAvroSchema,
+					Raw:      loadCustomerSchema(customerSchemaV1).Raw(),
+				})
+			})
+		})
+
+		Convey("When an agent requests a schema unknown to another agent", func() {
+			reply, err := receiver.Request(context.Background(), "sender", &schemaGet{ID: "Unknown"})
+
+			Convey("Then the other agent replies with an empty definition", func() {
+				So(err, ShouldBeNil)
+				So(reply.Message(), ShouldResemble, &schemaDefinition{ID: "Unknown"})
+			})
+		})
+
+		Convey("When the receiver only knows another revision of the schema of a command", func() {
+			_, err := receiver.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+			So(err, ShouldBeNil)
+			_, err = receiver.TypeRegister(customerType(customerV2{}))
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+
+			Convey("Then it fetches the revision of the sender to decode the command", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "unknown"})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+
+			Convey("Then it caches the fetched revision without registering it", func() {
+				select {
+				case <-customers:
+				case <-time.After(receiveTimeout):
+				}
+
+				receiver.Messaging.mutex.RLock()
+				defer receiver.Messaging.mutex.RUnlock()
+
+				So(receiver.fetchedSchemas, ShouldContainKey, loadCustomerSchema(customerSchemaV1).(*AvroSchema).Fingerprint())
+				So(receiver.SchemaVersions("Customer"), ShouldResemble, []int{1})
+			})
+		})
+
+		Convey("When the sender sends back to back two commands written with a revision unknown to the receiver", func() {
+			_, err := receiver.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+			So(err, ShouldBeNil)
+			_, err = receiver.TypeRegister(customerType(customerV2{}))
+			So(err, ShouldBeNil)
+
+			// sent to the queue receiving the replies to the requests of the receiver as well
+			So(sender.SendCommand(receiver.ID(), &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+			So(sender.SendCommand(receiver.ID(), &customerV1{Name: "jane", Age: 24}), ShouldBeNil)
+
+			Convey("Then the receiver fetches the revision while the second command waits for the worker", func() {
+				for _, expected := range []*customerV2{
+					{Name: "john", Age: 42, Email: "unknown"},
+					{Name: "jane", Age: 24, Email: "unknown"},
+				} {
+					select {
+					case customer := <-customers:
+						So(customer, ShouldResemble, expected)
+					case <-time.After(receiveTimeout):
+						So("command not received", ShouldBeEmpty)
+					}
+				}
+			})
+		})
+
+		Convey("When the receiver requests the sender, which replies with a revision of a schema unknown to the receiver", func() {
+			_, err := receiver.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+			So(err, ShouldBeNil)
+			_, err = receiver.TypeRegister(customerType(customerV2{}))
+			So(err, ShouldBeNil)
+
+			_, err = sender.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				p := ctx.Message().(*person)
+				return ctx.SendCommand("", &customerV1{Name: p.FirstName, Age: int32(p.Age)})
+			})
+			So(err, ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), receiveTimeout)
+			defer cancel()
+
+			reply, err := receiver.Request(ctx, "sender", &person{FirstName: "john", LastName: "doe", Age: 42})
+
+			Convey("Then the receiver fetches the revision of the sender to decode the reply", func() {
+				So(err, ShouldBeNil)
+				So(reply.Message(), ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "unknown"})
+			})
+		})
+	})
+}
+
+func TestSchemaDiscoveryOfUnknownTypes(t *testing.T) {
+	Convey("Given a receiver only knowing the type of a command", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+
+		// observes the dead-letter exchange
+		observer := broker.NewTransport()
+		So(observer.Connect(nil), ShouldBeNil)
+
+		deadLetters := make(chan *agentiface.Envelope, 1)
+		_, err := observer.Subscribe(agentiface.Subscription{
+			Destination: agentiface.DestinationDeadLetter,
+			Exclusive:   true,
+			Filters:     []map[string]interface{}{{}},
+		}, func(e *agentiface.Envelope) {
+			deadLetters <- e
+		})
+		So(err, ShouldBeNil)
+
+		_, err = sender.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = sender.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		for _, discovery := range []bool{false, true} {
+			discovery := discovery
+
+			Convey(fmt.Sprintf("When the sender sends the command to the receiver (discovery: %t)", discovery), func() {
+				receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+					configAckMode:          ackModeManual,
+					configRetryMaxAttempts: 0,
+					configSchemaDiscovery:  discovery,
+				})
+
+				Reset(func() {
+					sender.Disconnect()   // nolint: errcheck
+					receiver.Disconnect() // nolint: errcheck
+				})
+
+				requests := make(chan string, 10)
+				receiver.UsePublish(func(next agentiface.Publisher) agentiface.Publisher {
+					return func(msg interface{}) (*agentiface.Envelope, error) {
+						envelope, err := next(msg)
+						if err == nil {
+							requests <- envelope.Type
+						}
+						return envelope, err
+					}
+				})
+
+				_, err := receiver.TypeRegister(customerType(customerV1{}))
+				So(err, ShouldBeNil)
+
+				_, err = receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+					return nil
+				})
+				So(err, ShouldBeNil)
+
+				So(sender.SendCommand("receiver", &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+
+				Convey("Then the command is refused because its type is unknown, without fetching its schema", func() {
+					select {
+					case e := <-deadLetters:
+						So(e.Headers[agentiface.AmqpHeaderError], ShouldEqual, "Not Acceptable: Message-type 'Customer' is unknown")
+					case <-time.After(receiveTimeout):
+						So("command not dead-lettered", ShouldBeEmpty)
+					}
+
+					So(requests, ShouldBeEmpty)
+
+					receiver.Messaging.mutex.RLock()
+					defer receiver.Messaging.mutex.RUnlock()
+
+					So(receiver.fetchedSchemas, ShouldBeEmpty)
+				})
+			})
+		}
+	})
+}
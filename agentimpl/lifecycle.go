@@ -0,0 +1,271 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+)
+
+// maximum duration of the graceful shutdown of the agent
+const configShutdownTimeout = "shutdown.timeout"
+
+// Shutdown stops the messaging gracefully:
+// - the messaging enters StateDraining, unless a state callback vetoes it
+// - the consumption of the commands and of the events is cancelled (the messages not received yet are kept)
+// - the replies to the requests sent by the messages in flight are still received
+// - the messages in flight are processed, until ctx is done
+// - the retries waiting for their backoff delay are published
+// - the transport is disconnected
+// An error is returned if some messages in flight could not be processed before ctx is done.
+func (m *Messaging) Shutdown(ctx context.Context) error {
+	if isRunning(m.State()) {
+		if err := m.transition(agentiface.StateDraining, nil); err != nil {
+			return err
+		}
+	}
+
+	m.agent.callHooks("stop", m.agent.onStopHooks())
+
+	m.mutex.RLock()
+	ids := append([]string(nil), m.subscriptionsCmd...)
+	m.mutex.RUnlock()
+
+	m.subscriptionsMutex.Lock()
+	for _, callback := range m.callbacksEvent {
+		if callback.subscriptionID != "" {
+			ids = append(ids, callback.subscriptionID)
+		}
+	}
+	m.subscriptionsMutex.Unlock()
+
+	for _, id := range ids {
+		if err := m.transport.Pause(id); err != nil {
+			m.agent.Warning("Failed to stop consuming subscription '%s': %s", id, err.Error())
+		}
+	}
+
+	var err error
+
+	if remaining := m.inflight.wait(ctx); remaining > 0 {
+		err = fmt.Errorf("Shutdown timed out: %d message(s) not processed", remaining)
+	}
+
+	m.flushRetries()
+
+	if isRunning(m.State()) {
+		if dErr := m.Disconnect(); dErr != nil && err == nil {
+			err = dErr
+		}
+	}
+
+	// the workers still processing messages are stopped
+	m.release()
+
+	return err
+}
+
+// Close shuts the agent down gracefully: the agent quits, its messaging is stopped (see Shutdown) within the
+// configured timeout, all its goroutines are waited for and its logs are flushed.
+func (a *Agent) Close() error {
+	a.Quit()
+	err := a.Wait()
+
+	if err != nil {
+		a.Error("%s", err.Error())
+	}
+
+	if lErr := a.Logger.Close(); lErr != nil && err == nil {
+		err = lErr
+	}
+
+	return err
+}
+
+// OnStart registers a hook called when the agent starts, once connected.
+func (a *Agent) OnStart(hook agentiface.Hook) {
+	a.hooksMutex.Lock()
+	defer a.hooksMutex.Unlock()
+
+	a.startHooks = append(a.startHooks, hook)
+}
+
+// OnConnected registers a hook called whenever the agent gets connected.
+func (a *Agent) OnConnected(hook agentiface.Hook) {
+	a.hooksMutex.Lock()
+	defer a.hooksMutex.Unlock()
+
+	a.connectedHooks = append(a.connectedHooks, hook)
+}
+
+// OnStop registers a hook called when the agent is shut down.
+func (a *Agent) OnStop(hook agentiface.Hook) {
+	a.hooksMutex.Lock()
+	defer a.hooksMutex.Unlock()
+
+	a.stopHooks = append(a.stopHooks, hook)
+}
+
+func (a *Agent) onConnectedHooks() []agentiface.Hook {
+	a.hooksMutex.Lock()
+	defer a.hooksMutex.Unlock()
+
+	return append([]agentiface.Hook(nil), a.connectedHooks...)
+}
+
+func (a *Agent) onStopHooks() []agentiface.Hook {
+	a.hooksMutex.Lock()
+	defer a.hooksMutex.Unlock()
+
+	return append([]agentiface.Hook(nil), a.stopHooks...)
+}
+
+// callHooks calls hooks in their registration order, logging their errors.
+func (a *Agent) callHooks(stage string, hooks []agentiface.Hook) {
+	for _, hook := range hooks {
+		if err := hook(a); err != nil {
+			a.Warning("Hook on %s failed: %s", stage, err.Error())
+		}
+	}
+}
+
+// Start connects the agent and calls the start hooks in their registration order.
+// If a hook fails, the agent quits and the error is returned.
+func (a *Agent) Start() error {
+	if err := a.Connect(); err != nil {
+		return err
+	}
+
+	a.hooksMutex.Lock()
+	hooks := append([]agentiface.Hook(nil), a.startHooks...)
+	a.hooksMutex.Unlock()
+
+	for _, hook := range hooks {
+		if err := hook(a); err != nil {
+			a.Quit()
+			a.Wait() // nolint: errcheck, the error of the hook is reported instead
+			return errors.Wrap(err, "Failed to start the agent")
+		}
+	}
+
+	return nil
+}
+
+// Run starts the agent and blocks until SIGINT or SIGTERM is received, the agent quits or its connection fails,
+// then shuts the agent down gracefully. The error which made the agent quit or fail, if any, is returned.
+// When run from the command line, the signals trapped by ParseCommandLine are used.
+func (a *Agent) Run() error {
+	signals := a.Cli.signals
+	if signals == nil {
+		trapped, restore := trapSignals()
+		defer restore()
+		signals = trapped
+	}
+
+	if err := a.Start(); err != nil {
+		return err
+	}
+
+	err := waitForTermination(a, signals)
+	a.Quit()
+
+	if wErr := a.Wait(); err == nil {
+		err = wErr
+	}
+
+	return err
+}
+
+// waitForTermination blocks until a signal is received, the agent quits or its connection fails (the transition to
+// StateFailed, whose cause is returned). It returns immediately if the agent is not connected.
+func waitForTermination(a agentiface.Agent, signals <-chan os.Signal) error {
+	failed := make(chan error, 1)
+
+	id := a.RegisterStateCallback(func(transition agentiface.Transition) error {
+		if transition.To == agentiface.StateFailed {
+			cause := transition.Cause
+			if cause == nil {
+				cause = errors.New("Connection failed")
+			}
+
+			select {
+			case failed <- cause:
+			default:
+			}
+		}
+		return nil
+	})
+	defer a.UnregisterCallback(id) // nolint: errcheck, registered above
+
+	if state := a.State(); !isRunning(state) {
+		if state == agentiface.StateFailed {
+			return errors.New("Connection failed")
+		}
+		return nil
+	}
+
+	quit := make(chan struct{})
+
+	a.Go(func(q <-chan struct{}) error {
+		<-q
+		close(quit)
+		return nil
+	})
+
+	select {
+	case s := <-signals:
+		a.Info("Received signal %s, shutting down", s)
+	case <-quit:
+	case err := <-failed:
+		a.Error("Connection failed, shutting down: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// awaitTermination waits until a signal is received, the agent quits or its connection fails, then closes the agent.
+// It returns the exit status of the agent.
+func awaitTermination(a agentiface.Agent, signals <-chan os.Signal) int {
+	err := waitForTermination(a, signals)
+
+	if cErr := a.Close(); cErr != nil || err != nil {
+		return agentiface.ExitFailure
+	}
+
+	return agentiface.ExitSuccess
+}
+
+// isRunning returns true if the agent is connected or is trying to be.
+func isRunning(state agentiface.State) bool {
+	return state != agentiface.StateDisconnected && state != agentiface.StateFailed
+}
+
+// trapSignals returns a channel receiving the termination signals (SIGINT and SIGTERM) and a function restoring
+// their default behavior.
+func trapSignals() (<-chan os.Signal, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	return signals, func() {
+		signal.Stop(signals)
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShutdown(t *testing.T) {
+	Convey("Given an agent processing a command", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		processed := make(chan struct{})
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			close(started)
+			<-release
+			close(processed)
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+		select {
+		case <-started:
+		case <-time.After(receiveTimeout):
+			So("command not received", ShouldBeEmpty)
+		}
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the agent is shut down", func() {
+			result := make(chan error, 1)
+
+			go func() {
+				result <- receiver.Shutdown(context.Background())
+			}()
+
+			Convey("The shutdown should wait for the command to be processed", func() {
+				select {
+				case <-result:
+					So("shutdown did not wait", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				close(release)
+
+				select {
+				case err := <-result:
+					So(err, ShouldBeNil)
+				case <-time.After(receiveTimeout):
+					So("shutdown not completed", ShouldBeEmpty)
+				}
+
+				select {
+				case <-processed:
+				default:
+					So("command not processed", ShouldBeEmpty)
+				}
+				So(receiver.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the command is not processed before the shutdown times out", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := receiver.Shutdown(ctx)
+			close(release)
+
+			Convey("An error should occur and the agent should be disconnected", func() {
+				So(err, ShouldNotBeNil)
+				So(receiver.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the agent quits", func() {
+			result := make(chan int, 1)
+
+			go func() {
+				result <- awaitTermination(receiver, nil)
+			}()
+
+			receiver.Quit()
+			close(release)
+
+			Convey("The command should be processed and the agent should exit successfully", func() {
+				select {
+				case status := <-result:
+					So(status, ShouldEqual, agentiface.ExitSuccess)
+				case <-time.After(receiveTimeout):
+					So("agent not closed", ShouldBeEmpty)
+				}
+
+				select {
+				case <-processed:
+				default:
+					So("command not processed", ShouldBeEmpty)
+				}
+				So(receiver.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+	})
+
+	Convey("Given an agent waiting for its termination", t, func() {
+		broker := NewLoopbackBroker()
+		agent := newTestAgent(broker, "agent", nil)
+
+		signals := make(chan os.Signal, 1)
+		result := make(chan int, 1)
+
+		go func() {
+			result <- awaitTermination(agent, signals)
+		}()
+
+		Reset(func() {
+			agent.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When SIGTERM is received", func() {
+			signals <- syscall.SIGTERM
+
+			Convey("The agent should be shut down and exit successfully", func() {
+				select {
+				case status := <-result:
+					So(status, ShouldEqual, agentiface.ExitSuccess)
+				case <-time.After(receiveTimeout):
+					So("agent not closed", ShouldBeEmpty)
+				}
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+	})
+
+	Convey("Given an agent retrying a command after a long delay", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+			configAckMode:              ackModeManual,
+			configRetryInitialInterval: "1h",
+		})
+
+		failed := make(chan struct{})
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			close(failed)
+			return fmt.Errorf("temporary failure")
+		})
+		So(err, ShouldBeNil)
+
+		So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+		select {
+		case <-failed:
+		case <-time.After(receiveTimeout):
+			So("command not received", ShouldBeEmpty)
+		}
+
+		Reset(func() {
+			sender.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the agent is shut down", func() {
+			So(receiver.Shutdown(context.Background()), ShouldBeNil)
+
+			Convey("The retry should be sent without waiting for its delay", func() {
+				observer := broker.NewTransport()
+				So(observer.Connect(nil), ShouldBeNil)
+				defer observer.Disconnect() // nolint: errcheck
+
+				retries := make(chan int, 1)
+
+				_, err := observer.Subscribe(agentiface.Subscription{
+					Destination: agentiface.DestinationCommand,
+					Queue:       "receiver",
+					Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "receiver"}},
+				}, func(e *agentiface.Envelope) {
+					retries <- headerInt(e.Headers, agentiface.AmqpHeaderRetryCount)
+				})
+				So(err, ShouldBeNil)
+
+				select {
+				case count := <-retries:
+					So(count, ShouldEqual, 1)
+				case <-time.After(receiveTimeout):
+					So("retry not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestStart(t *testing.T) {
+	Convey("Given an agent which is not started", t, func() {
+		broker := NewLoopbackBroker()
+		agent := newDisconnectedTestAgent(broker, "agent", nil)
+
+		Reset(func() {
+			agent.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When start hooks are registered", func() {
+			var calls []string
+
+			agent.OnStart(func(a agentiface.Agent) error {
+				calls = append(calls, fmt.Sprintf("first (connected: %t)", a.State() == agentiface.StateConnected))
+				return nil
+			})
+			agent.OnStart(func(a agentiface.Agent) error {
+				calls = append(calls, "second")
+				return nil
+			})
+
+			Convey("They should be called in order once the agent is connected", func() {
+				So(agent.Start(), ShouldBeNil)
+				So(calls, ShouldResemble, []string{"first (connected: true)", "second"})
+			})
+		})
+
+		Convey("When a start hook fails", func() {
+			agent.OnStart(func(a agentiface.Agent) error {
+				return fmt.Errorf("no way")
+			})
+
+			Convey("The start should fail and the agent should be disconnected", func() {
+				err := agent.Start()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "no way")
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the agent is started from the command line", func() {
+			dir, err := ioutil.TempDir("", "agent")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir) // nolint: errcheck
+
+			pidfile := filepath.Join(dir, "agent.pid")
+			started := make(chan struct{})
+
+			agent.OnStart(func(a agentiface.Agent) error {
+				close(started)
+				return nil
+			})
+
+			agent.RootCommand().SetArgs([]string{"agent:start", "--pidfile", pidfile})
+
+			result := make(chan int, 1)
+			go func() {
+				result <- agent.ParseCommandLine()
+			}()
+
+			select {
+			case <-started:
+			case <-time.After(receiveTimeout):
+				So("agent not started", ShouldBeEmpty)
+			}
+
+			Convey("It should run until it quits", func() {
+				content, err := ioutil.ReadFile(pidfile)
+				So(err, ShouldBeNil)
+				So(strings.TrimSpace(string(content)), ShouldEqual, strconv.Itoa(os.Getpid()))
+
+				select {
+				case <-result:
+					So("agent stopped", ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				agent.Quit()
+
+				select {
+				case status := <-result:
+					So(status, ShouldEqual, agentiface.ExitSuccess)
+				case <-time.After(receiveTimeout):
+					So("agent not stopped", ShouldBeEmpty)
+				}
+
+				_, err = os.Stat(pidfile)
+				So(os.IsNotExist(err), ShouldBeTrue)
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+
+		Convey("When the agent started from the command line receives SIGTERM", func() {
+			started := make(chan struct{})
+
+			agent.OnStart(func(a agentiface.Agent) error {
+				close(started)
+				return nil
+			})
+
+			agent.RootCommand().SetArgs([]string{"agent:start"})
+
+			signals := make(chan os.Signal, 1)
+			result := make(chan int, 1)
+			go func() {
+				result <- agent.execute(signals)
+			}()
+
+			select {
+			case <-started:
+			case <-time.After(receiveTimeout):
+				So("agent not started", ShouldBeEmpty)
+			}
+
+			signals <- syscall.SIGTERM
+
+			Convey("It should be shut down with the signal trapped by the command line", func() {
+				select {
+				case status := <-result:
+					So(status, ShouldEqual, agentiface.ExitSuccess)
+				case <-time.After(receiveTimeout):
+					So("agent not stopped", ShouldBeEmpty)
+				}
+				So(agent.State(), ShouldEqual, agentiface.StateDisconnected)
+			})
+		})
+	})
+}
+
+func TestHooks(t *testing.T) {
+	Convey("Given an agent whose callbacks are registered before connecting", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newDisconnectedTestAgent(broker, "receiver", nil)
+
+		commands := make(chan struct{}, 1)
+		events := make(chan struct{}, 1)
+		connected := make(chan struct{}, 2)
+		stopped := make(chan struct{}, 1)
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			commands <- struct{}{}
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		_, err = receiver.RegisterFilteredEventCallback(agentiface.BySenderName("sender"), func(ctx agentiface.EventCtx) error {
+			events <- struct{}{}
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		receiver.OnConnected(func(a agentiface.Agent) error {
+			connected <- struct{}{}
+			return nil
+		})
+		receiver.OnStop(func(a agentiface.Agent) error {
+			stopped <- struct{}{}
+			return nil
+		})
+
+		// the events are sent by the sender as a consequence of the commands it receives
+		_, err = sender.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			return ctx.SendEvent(ctx.Message())
+		})
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		expect := func(c <-chan struct{}, what string) {
+			select {
+			case <-c:
+			case <-time.After(receiveTimeout):
+				So(what, ShouldBeEmpty)
+			}
+		}
+
+		Convey("When the agent connects", func() {
+			So(receiver.Connect(), ShouldBeNil)
+
+			Convey("The connected hooks should be called and the callbacks should receive messages", func() {
+				expect(connected, "connected hook not called")
+
+				So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+				expect(commands, "command not received")
+
+				So(receiver.SendCommand("sender", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+				expect(events, "event not received")
+			})
+		})
+
+		Convey("When the agent connects again after a disconnection", func() {
+			So(receiver.Connect(), ShouldBeNil)
+			So(receiver.Disconnect(), ShouldBeNil)
+			So(receiver.Connect(), ShouldBeNil)
+
+			Convey("The connected hooks should be called again and the callbacks should be subscribed again", func() {
+				expect(connected, "connected hook not called")
+				expect(connected, "connected hook not called again")
+
+				So(receiver.SendCommand("sender", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+				expect(events, "event not received")
+			})
+		})
+
+		Convey("When the agent is shut down", func() {
+			So(receiver.Connect(), ShouldBeNil)
+			So(receiver.Shutdown(context.Background()), ShouldBeNil)
+
+			Convey("The stop hooks should be called", func() {
+				expect(stopped, "stop hook not called")
+			})
+		})
+	})
+}
+
+func TestConnectionFailure(t *testing.T) {
+	Convey("Given an agent connected to an AMQP broker which cannot be reached again once lost", t, func() {
+		broker := &fakeAMQPBroker{}
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "agent", map[string]interface{}{
+			configReconnectMaxAttempts: 2,
+		}, func(agent *Agent) error {
+			agent.transport = newFakeAMQP(agent, broker)
+			return nil
+		})
+
+		Convey("When the agent runs and the broker is lost", func() {
+			result := make(chan error, 1)
+
+			go func() {
+				result <- agent.Run()
+			}()
+
+			for deadline := time.Now().Add(receiveTimeout); agent.State() != agentiface.StateConnected && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			So(agent.State(), ShouldEqual, agentiface.StateConnected)
+
+			broker.shutDown()
+
+			Convey("Then the agent stops running and returns the cause of the failure", func() {
+				select {
+				case err := <-result:
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "Failed to reconnect")
+				case <-time.After(receiveTimeout):
+					So("agent still running", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the agent awaits its termination and the broker is lost", func() {
+			So(agent.Connect(), ShouldBeNil)
+
+			result := make(chan int, 1)
+
+			go func() {
+				result <- awaitTermination(agent, nil)
+			}()
+
+			broker.shutDown()
+
+			Convey("Then the agent is closed and exits with a failure", func() {
+				select {
+				case status := <-result:
+					So(status, ShouldEqual, agentiface.ExitFailure)
+				case <-time.After(receiveTimeout):
+					So("agent not closed", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
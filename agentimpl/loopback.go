@@ -0,0 +1,555 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"reflect"
+	"sync"
+)
+
+// LoopbackBroker is an in-process broker reproducing the routing of the AMQP headers exchanges used by the agents.
+// Agents created with a transport of the same broker can talk to each other without any AMQP broker, which is
+// mainly useful for tests.
+type LoopbackBroker struct {
+	mutex sync.Mutex
+
+	// queues
+	// - key is the name of the queue
+	// - value is the queue
+	queues map[string]*loopbackQueue
+}
+
+// loopbackBinding binds a queue to a destination with a header filter.
+type loopbackBinding struct {
+	destination agentiface.Destination
+	filter      map[string]interface{}
+}
+
+// loopbackQueue is a queue of the loopback broker. Envelopes are dispatched to its consumers in a round-robin
+// fashion and kept until a consumer is available.
+type loopbackQueue struct {
+	name      string
+	exclusive bool
+	bindings  []loopbackBinding
+	consumers []*loopbackConsumer
+	next      int
+	pending   []*agentiface.Envelope
+}
+
+// loopbackConsumer delivers the envelopes of a queue, in order, to the handler of a subscription.
+type loopbackConsumer struct {
+	transport   *LoopbackTransport
+	queue       *loopbackQueue
+	destination agentiface.Destination
+	manualAck   bool
+	handler     agentiface.EnvelopeHandler
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	mailbox   []*agentiface.Envelope
+	cancelled bool
+}
+
+// NewLoopbackBroker creates a new in-process broker.
+func NewLoopbackBroker() *LoopbackBroker {
+	return &LoopbackBroker{
+		queues: make(map[string]*loopbackQueue),
+	}
+}
+
+// NewTransport creates a new transport connected to this broker, to be given to an agent (see WithTransport).
+func (b *LoopbackBroker) NewTransport() *LoopbackTransport {
+	return &LoopbackTransport{
+		broker: b,
+		state:  agentiface.StateDisconnected,
+	}
+}
+
+// route delivers an envelope to every queue having a binding matching its headers.
+// It returns the number of queues the envelope has been delivered to.
+func (b *LoopbackBroker) route(destination agentiface.Destination, envelope *agentiface.Envelope) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	routed := 0
+
+	for _, q := range b.queues {
+		for _, binding := range q.bindings {
+			if binding.destination == destination && matchHeaders(binding.filter, envelope.Headers) {
+				q.push(envelope)
+				routed++
+				break
+			}
+		}
+	}
+
+	return routed
+}
+
+// bind adds a binding to the queue, unless an identical one already exists.
+func (q *loopbackQueue) bind(destination agentiface.Destination, filter map[string]interface{}) {
+	for _, binding := range q.bindings {
+		if binding.destination == destination && reflect.DeepEqual(binding.filter, filter) {
+			return
+		}
+	}
+
+	q.bindings = append(q.bindings, loopbackBinding{
+		destination: destination,
+		filter:      filter,
+	})
+}
+
+// addConsumer adds a consumer to the queue and hands it over the envelopes received while the queue had no consumer.
+func (q *loopbackQueue) addConsumer(c *loopbackConsumer) {
+	q.consumers = append(q.consumers, c)
+
+	pending := q.pending
+	q.pending = nil
+	for _, envelope := range pending {
+		q.push(envelope)
+	}
+}
+
+// removeConsumer removes a consumer from the queue.
+func (q *loopbackQueue) removeConsumer(c *loopbackConsumer) {
+	for i, consumer := range q.consumers {
+		if consumer == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// requeue puts back the envelopes of a cancelled consumer, in order, ahead of the ones kept by the queue.
+func (q *loopbackQueue) requeue(envelopes []*agentiface.Envelope) {
+	if len(q.consumers) == 0 {
+		q.pending = append(append([]*agentiface.Envelope(nil), envelopes...), q.pending...)
+		return
+	}
+
+	for _, envelope := range envelopes {
+		q.push(envelope)
+	}
+}
+
+// push gives the envelope to the next consumer of the queue, or keeps it if there is none.
+func (q *loopbackQueue) push(envelope *agentiface.Envelope) {
+	if len(q.consumers) == 0 {
+		q.pending = append(q.pending, envelope)
+		return
+	}
+
+	q.next = q.next % len(q.consumers)
+	q.consumers[q.next].post(envelope)
+	q.next++
+}
+
+// matchHeaders reports whether the headers of a message match a binding filter, following the rules
+// of the AMQP headers exchanges: with "x-match" set to "any", at least one of the entries of the filter must
+// be present in the headers, otherwise ("all", the default) all of them must be.
+// Entries of the filter whose key starts with "x-" are ignored.
+func matchHeaders(filter map[string]interface{}, headers map[string]interface{}) bool {
+	matchAny := filter["x-match"] == "any"
+	matched := 0
+	expected := 0
+
+	for k, v := range filter {
+		if len(k) >= 2 && k[:2] == "x-" {
+			continue
+		}
+
+		expected++
+
+		if h, ok := headers[k]; ok && reflect.DeepEqual(h, v) {
+			if matchAny {
+				return true
+			}
+			matched++
+		}
+	}
+
+	if matchAny {
+		return false
+	}
+
+	return matched == expected
+}
+
+func (c *loopbackConsumer) start() {
+	c.cond = sync.NewCond(&c.mutex)
+
+	go func() {
+		for {
+			c.mutex.Lock()
+			for len(c.mailbox) == 0 && !c.cancelled {
+				c.cond.Wait()
+			}
+
+			if c.cancelled {
+				c.mutex.Unlock()
+				return
+			}
+
+			envelope := c.mailbox[0]
+			c.mailbox = c.mailbox[1:]
+			c.mutex.Unlock()
+
+			c.handler(c.deliver(envelope))
+		}
+	}()
+}
+
+// deliver returns the copy of an envelope handed to the handler of the consumer.
+// The destination is the one of the subscription, as envelopes can also be pushed to the queue directly
+// (see PublishToQueue).
+func (c *loopbackConsumer) deliver(envelope *agentiface.Envelope) *agentiface.Envelope {
+	e := *envelope
+	e.Destination = c.destination
+	e.Queue = c.queue.name
+
+	if c.manualAck {
+		e.Acknowledger = &loopbackAcknowledger{
+			broker:   c.transport.broker,
+			queue:    c.queue,
+			envelope: envelope,
+		}
+	}
+
+	return &e
+}
+
+func (c *loopbackConsumer) post(envelope *agentiface.Envelope) {
+	c.mutex.Lock()
+	c.mailbox = append(c.mailbox, envelope)
+	c.mutex.Unlock()
+
+	c.cond.Signal()
+}
+
+// cancel stops the consumer and returns the envelopes it has not handed to its handler yet.
+func (c *loopbackConsumer) cancel() []*agentiface.Envelope {
+	c.mutex.Lock()
+	c.cancelled = true
+	undelivered := c.mailbox
+	c.mailbox = nil
+	c.mutex.Unlock()
+
+	c.cond.Signal()
+
+	return undelivered
+}
+
+// loopbackAcknowledger settles an envelope delivered by a consumer in manual acknowledgement mode.
+// Unlike AMQP, the envelopes which are not settled when the consumer is cancelled are lost.
+type loopbackAcknowledger struct {
+	broker   *LoopbackBroker
+	queue    *loopbackQueue
+	envelope *agentiface.Envelope
+	settled  bool
+}
+
+// Ack acknowledges the envelope.
+func (a *loopbackAcknowledger) Ack() error {
+	return a.settle(false)
+}
+
+// Reject rejects the envelope, pushing it back to its queue if requeue is true.
+func (a *loopbackAcknowledger) Reject(requeue bool) error {
+	return a.settle(requeue)
+}
+
+func (a *loopbackAcknowledger) settle(requeue bool) error {
+	a.broker.mutex.Lock()
+	defer a.broker.mutex.Unlock()
+
+	if a.settled {
+		return errors.New("Envelope already settled")
+	}
+	a.settled = true
+
+	if requeue {
+		a.queue.push(a.envelope)
+	}
+
+	return nil
+}
+
+// loopbackSubscription is a subscription of a transport to a queue of the broker.
+type loopbackSubscription struct {
+	queue        *loopbackQueue
+	subscription agentiface.Subscription
+	handler      agentiface.EnvelopeHandler
+
+	// nil when the subscription is paused
+	consumer *loopbackConsumer
+}
+
+// LoopbackTransport is the implementation of a Transport exchanging messages through a LoopbackBroker.
+type LoopbackTransport struct {
+	broker *LoopbackBroker
+
+	// protects the state and the subscriptions
+	mutex         sync.RWMutex
+	state         agentiface.State
+	stateCallback agentiface.StateCallback
+
+	// subscriptions
+	// - key is the name of the queue
+	// - value is the subscription
+	subscriptions map[string]*loopbackSubscription
+}
+
+// Connect connects the transport to the broker.
+func (t *LoopbackTransport) Connect(stateCallback agentiface.StateCallback) error {
+	t.mutex.Lock()
+	if t.state != agentiface.StateDisconnected {
+		t.mutex.Unlock()
+		return fmt.Errorf("Already connected to the loopback broker")
+	}
+	t.state = agentiface.StateConnected
+	t.stateCallback = stateCallback
+	t.subscriptions = make(map[string]*loopbackSubscription)
+	t.mutex.Unlock()
+
+	if stateCallback != nil {
+		stateCallback(agentiface.Transition{From: agentiface.StateDisconnected, To: agentiface.StateConnected}) // nolint: errcheck, transitions of the transport cannot be vetoed
+	}
+
+	return nil
+}
+
+// Disconnect cancels the subscriptions of the transport and deletes its exclusive queues.
+func (t *LoopbackTransport) Disconnect() error {
+	t.mutex.Lock()
+	if t.state == agentiface.StateDisconnected {
+		t.mutex.Unlock()
+		return fmt.Errorf("Not connected")
+	}
+	t.state = agentiface.StateDisconnected
+	stateCallback := t.stateCallback
+	subscriptions := t.subscriptions
+	t.subscriptions = nil
+	t.mutex.Unlock()
+
+	for _, sub := range subscriptions {
+		t.unsubscribe(sub)
+	}
+
+	if stateCallback != nil {
+		stateCallback(agentiface.Transition{From: agentiface.StateConnected, To: agentiface.StateDisconnected}) // nolint: errcheck, transitions of the transport cannot be vetoed
+	}
+
+	return nil
+}
+
+// State returns the state of the transport.
+func (t *LoopbackTransport) State() agentiface.State {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.state
+}
+
+// Subscribe declares the queue of the subscription (if needed), binds it with the filters of the subscription
+// and listens to it.
+func (t *LoopbackTransport) Subscribe(subscription agentiface.Subscription, handler agentiface.EnvelopeHandler) (string, error) {
+	if t.State() != agentiface.StateConnected {
+		return "", fmt.Errorf("Cannot subscribe if not connected")
+	}
+
+	name := subscription.Queue
+	if name == "" {
+		name = uuid.Must(uuid.NewV4()).String()
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, exists := t.subscriptions[name]; exists {
+		return "", fmt.Errorf("Already subscribed to queue: %s", name)
+	}
+
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	q, ok := t.broker.queues[name]
+	if !ok {
+		q = &loopbackQueue{
+			name:      name,
+			exclusive: subscription.Exclusive,
+		}
+		t.broker.queues[name] = q
+	}
+
+	for _, filter := range subscription.Filters {
+		q.bind(subscription.Destination, filter)
+	}
+
+	sub := &loopbackSubscription{
+		queue:        q,
+		subscription: subscription,
+		handler:      handler,
+	}
+	sub.consumer = t.newConsumer(sub)
+	q.addConsumer(sub.consumer)
+
+	t.subscriptions[name] = sub
+
+	return name, nil
+}
+
+// newConsumer creates and starts a consumer for a subscription.
+func (t *LoopbackTransport) newConsumer(sub *loopbackSubscription) *loopbackConsumer {
+	c := &loopbackConsumer{
+		transport:   t,
+		queue:       sub.queue,
+		destination: sub.subscription.Destination,
+		manualAck:   sub.subscription.ManualAck,
+		handler:     sub.handler,
+	}
+	c.start()
+
+	return c
+}
+
+// Unsubscribe cancels the consumer of a subscription and deletes its queue if exclusive.
+func (t *LoopbackTransport) Unsubscribe(id string) error {
+	t.mutex.Lock()
+	sub, ok := t.subscriptions[id]
+	delete(t.subscriptions, id)
+	t.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+
+	t.unsubscribe(sub)
+
+	return nil
+}
+
+// unsubscribe cancels the consumer of a subscription and deletes its queue if exclusive.
+func (t *LoopbackTransport) unsubscribe(sub *loopbackSubscription) {
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	if sub.consumer != nil {
+		sub.queue.removeConsumer(sub.consumer)
+		sub.queue.requeue(sub.consumer.cancel())
+		sub.consumer = nil
+	}
+
+	if sub.subscription.Exclusive {
+		delete(t.broker.queues, sub.queue.name)
+	}
+}
+
+// Pause cancels the consumer of a subscription. Its queue keeps receiving messages, and gets back the ones not
+// handed to the handler of the subscription yet.
+func (t *LoopbackTransport) Pause(id string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sub, ok := t.subscriptions[id]
+	if !ok {
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	if sub.consumer != nil {
+		sub.queue.removeConsumer(sub.consumer)
+		sub.queue.requeue(sub.consumer.cancel())
+		sub.consumer = nil
+	}
+
+	return nil
+}
+
+// Resume listens again to the queue of a paused subscription.
+func (t *LoopbackTransport) Resume(id string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sub, ok := t.subscriptions[id]
+	if !ok {
+		return fmt.Errorf("Unknown subscription: %s", id)
+	}
+
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	if sub.consumer == nil {
+		sub.consumer = t.newConsumer(sub)
+		sub.queue.addConsumer(sub.consumer)
+	}
+
+	return nil
+}
+
+// Publish routes a copy of the envelope to the queues bound to the destination.
+// Mandatory envelopes which cannot be routed are reported with ErrUnroutable.
+func (t *LoopbackTransport) Publish(destination agentiface.Destination, envelope *agentiface.Envelope) error {
+	if t.State() != agentiface.StateConnected {
+		return errors.New("Not connected")
+	}
+
+	e := *envelope
+	e.Destination = destination
+	e.Queue = ""
+	e.Acknowledger = nil
+	e.Headers = copyHeaders(envelope.Headers)
+
+	if t.broker.route(destination, &e) == 0 && e.Mandatory {
+		return errors.Wrapf(agentiface.ErrUnroutable, "Message '%s'", e.MessageID)
+	}
+
+	return nil
+}
+
+// PublishToQueue pushes a copy of the envelope to the given queue. The envelope is dropped if the queue does not exist,
+// unless it is mandatory, in which case ErrUnroutable is returned.
+func (t *LoopbackTransport) PublishToQueue(queue string, envelope *agentiface.Envelope) error {
+	if t.State() != agentiface.StateConnected {
+		return errors.New("Not connected")
+	}
+
+	e := *envelope
+	e.Queue = ""
+	e.Acknowledger = nil
+	e.Headers = copyHeaders(envelope.Headers)
+
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	q, ok := t.broker.queues[queue]
+
+	if !ok {
+		if e.Mandatory {
+			return errors.Wrapf(agentiface.ErrUnroutable, "Message '%s'", e.MessageID)
+		}
+		return nil
+	}
+
+	q.push(&e)
+
+	return nil
+}
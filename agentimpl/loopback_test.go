@@ -0,0 +1,194 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestMatchHeaders(t *testing.T) {
+	Convey("Given the headers of a message", t, func() {
+		headers := map[string]interface{}{
+			"type":   "person",
+			"SendTo": "agent-git",
+		}
+
+		var data = []struct {
+			name           string
+			filter         map[string]interface{} // binding filter
+			expectedResult bool                   // expected match
+		}{
+			{"an empty filter", map[string]interface{}{}, true},
+			{"a filter on the type", map[string]interface{}{"type": "person"}, true},
+			{"a filter on another type", map[string]interface{}{"type": "build"}, false},
+			{"a filter matching all the headers", map[string]interface{}{"type": "person", "SendTo": "agent-git"}, true},
+			{"a filter matching some of the headers", map[string]interface{}{"type": "person", "SendTo": "*"}, false},
+			{"a 'x-match: any' filter matching some of the headers", map[string]interface{}{"x-match": "any", "type": "person", "SendTo": "*"}, true},
+			{"a 'x-match: any' filter matching none of the headers", map[string]interface{}{"x-match": "any", "type": "build", "SendTo": "*"}, false},
+			{"a 'x-match: all' filter matching all the headers", map[string]interface{}{"x-match": "all", "type": "person"}, true},
+		}
+
+		for _, tt := range data {
+			Convey(fmt.Sprintf("When we match the headers against %s", tt.name), func() {
+				result := matchHeaders(tt.filter, headers)
+
+				Convey(fmt.Sprintf("The result should be '%t'", tt.expectedResult), func() {
+					So(result, ShouldEqual, tt.expectedResult)
+				})
+			})
+		}
+	})
+}
+
+func TestLoopbackRouting(t *testing.T) {
+	Convey("Given a loopback broker and a transport connected to it", t, func() {
+		broker := NewLoopbackBroker()
+		transport := broker.NewTransport()
+
+		So(transport.Connect(nil), ShouldBeNil)
+
+		Reset(func() {
+			transport.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When two transports subscribe to the same queue", func() {
+			other := broker.NewTransport()
+			So(other.Connect(nil), ShouldBeNil)
+
+			Reset(func() {
+				other.Disconnect() // nolint: errcheck
+			})
+
+			received := make(chan string, 2)
+			subscription := agentiface.Subscription{
+				Destination: agentiface.DestinationCommand,
+				Queue:       "agent-git",
+				Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "agent-git"}},
+			}
+
+			_, err := transport.Subscribe(subscription, func(e *agentiface.Envelope) { received <- "first" })
+			So(err, ShouldBeNil)
+			_, err = other.Subscribe(subscription, func(e *agentiface.Envelope) { received <- "second" })
+			So(err, ShouldBeNil)
+
+			Convey("Subscribing again to the queue should fail", func() {
+				_, err := transport.Subscribe(subscription, func(e *agentiface.Envelope) {})
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Two commands sent to the queue should be received once by each subscription", func() {
+				for i := 0; i < 2; i++ {
+					err := transport.Publish(agentiface.DestinationCommand, &agentiface.Envelope{
+						Headers: map[string]interface{}{agentiface.AmqpHeaderSendTo: "agent-git"},
+					})
+					So(err, ShouldBeNil)
+				}
+
+				receivers := []string{<-received, <-received}
+
+				So(receivers, ShouldContain, "first")
+				So(receivers, ShouldContain, "second")
+			})
+		})
+
+		Convey("When an event then a command are published to a queue bound to the commands only", func() {
+			received := make(chan *agentiface.Envelope, 2)
+
+			_, err := transport.Subscribe(agentiface.Subscription{
+				Destination: agentiface.DestinationCommand,
+				Exclusive:   true,
+				Filters:     []map[string]interface{}{{}},
+			}, func(e *agentiface.Envelope) { received <- e })
+			So(err, ShouldBeNil)
+
+			So(transport.Publish(agentiface.DestinationEvent, &agentiface.Envelope{MessageID: "event"}), ShouldBeNil)
+			So(transport.Publish(agentiface.DestinationCommand, &agentiface.Envelope{MessageID: "command"}), ShouldBeNil)
+
+			Convey("Only the command should be received", func() {
+				e := <-received
+
+				So(e.MessageID, ShouldEqual, "command")
+				So(e.Destination, ShouldEqual, agentiface.DestinationCommand)
+				So(len(received), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When an envelope is pushed directly to the queue of a subscription", func() {
+			received := make(chan *agentiface.Envelope, 1)
+
+			_, err := transport.Subscribe(agentiface.Subscription{
+				Destination: agentiface.DestinationCommand,
+				Queue:       "agent-git",
+				Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "agent-git"}},
+			}, func(e *agentiface.Envelope) { received <- e })
+			So(err, ShouldBeNil)
+
+			So(transport.PublishToQueue("agent-git", &agentiface.Envelope{
+				Destination: agentiface.DestinationEvent,
+				MessageID:   "retried",
+			}), ShouldBeNil)
+
+			Convey("It should be received with the destination of the subscription", func() {
+				e := <-received
+
+				So(e.MessageID, ShouldEqual, "retried")
+				So(e.Destination, ShouldEqual, agentiface.DestinationCommand)
+			})
+		})
+
+		Convey("When a subscription is paused while envelopes wait to be handled", func() {
+			received := make(chan string, 3)
+			release := make(chan struct{})
+
+			id, err := transport.Subscribe(agentiface.Subscription{
+				Destination: agentiface.DestinationCommand,
+				Queue:       "agent-git",
+				Filters:     []map[string]interface{}{{agentiface.AmqpHeaderSendTo: "agent-git"}},
+			}, func(e *agentiface.Envelope) {
+				received <- e.MessageID
+				<-release
+			})
+			So(err, ShouldBeNil)
+
+			for _, messageID := range []string{"1", "2", "3"} {
+				So(transport.Publish(agentiface.DestinationCommand, &agentiface.Envelope{
+					MessageID: messageID,
+					Headers:   map[string]interface{}{agentiface.AmqpHeaderSendTo: "agent-git"},
+				}), ShouldBeNil)
+			}
+
+			// the first envelope is being handled, the others wait in the consumer
+			So(<-received, ShouldEqual, "1")
+			So(transport.Pause(id), ShouldBeNil)
+			close(release)
+
+			Convey("They should be kept by the queue and received once resumed", func() {
+				select {
+				case messageID := <-received:
+					So(messageID, ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				So(transport.Resume(id), ShouldBeNil)
+
+				So([]string{<-received, <-received}, ShouldResemble, []string{"2", "3"})
+			})
+		})
+	})
+}
@@ -15,31 +15,51 @@
 package agentimpl
 
 import (
+	"context"
 	"fmt"
 	"github.com/crucibuild/sdk-agent-go/agentiface"
 	"github.com/crucibuild/sdk-agent-go/util"
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
-	"github.com/streadway/amqp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// default timeout of a request when its context has no deadline
+const configRequestTimeout = "request.timeout"
+
+// if true, sending a command which cannot be routed to any agent fails with ErrUnroutable
+// (with AMQP, only when publisher confirms are enabled: see publish.confirm)
+const configPublishMandatory = "publish.mandatory"
+
 // Ctx denotes a context when receiving a command or an event.
 // From this instance can be retrieved:
 // - the message (command or event)
 // - the schema
 // - the properties attached to the message
 type Ctx struct {
-	amqp   *AMQP
-	data   amqp.Delivery
-	schema agentiface.Schema
-	msg    interface{}
+	messaging *Messaging
+	context   context.Context
+	envelope  *agentiface.Envelope
+	schema    agentiface.Schema
+	msg       interface{}
+
+	// trace context of the processing of the message
+	traceID string
+	spanID  string
+}
+
+// Context returns the context of the processing of the message. It is cancelled when the agent disconnects or
+// when the message expires.
+func (ctx *Ctx) Context() context.Context {
+	return ctx.context
 }
 
 // Messaging returns the instance of Messaging.
 func (ctx *Ctx) Messaging() agentiface.Messaging {
-	return ctx.amqp
+	return ctx.messaging
 }
 
 // Message returns the concrete instance of the deserialized message.
@@ -51,18 +71,18 @@ func (ctx *Ctx) Message() interface{} {
 func (ctx *Ctx) Properties() map[string]string {
 	p := make(map[string]string)
 
-	p["ContentType"] = ctx.data.ContentType
-	p["ContentEncoding"] = ctx.data.ContentEncoding
-	//p["DeliveryMode"] = ctx.data.DeliveryMode
-	//p["Priority"] = ctx.data.Priority
-	p["CorrelationId"] = ctx.data.CorrelationId
-	p["ReplyTo"] = ctx.data.ReplyTo
-	p["Expiration"] = ctx.data.Expiration
-	p["MessageId"] = ctx.data.MessageId
-	//p["Timestamp"] = ctx.data.Timestamp
-	p["Type"] = ctx.data.Type
-	p["UserId"] = ctx.data.UserId
-	p["AppId"] = ctx.data.AppId
+	p["ContentType"] = ctx.envelope.ContentType
+	p["ContentEncoding"] = ctx.envelope.ContentEncoding
+	p["CorrelationId"] = ctx.envelope.CorrelationID
+	p["ReplyTo"] = ctx.envelope.ReplyTo
+	p["Expiration"] = ctx.envelope.Expiration
+	p["MessageId"] = ctx.envelope.MessageID
+	//p["Timestamp"] = ctx.envelope.Timestamp
+	p["Type"] = ctx.envelope.Type
+	p["UserId"] = ctx.envelope.UserID
+	p["AppId"] = ctx.envelope.AppID
+	p["CausationId"] = headerString(ctx.envelope.Headers, agentiface.AmqpHeaderCausationID)
+	p["TraceParent"] = headerString(ctx.envelope.Headers, agentiface.AmqpHeaderTraceParent)
 
 	return p
 }
@@ -74,433 +94,509 @@ func (ctx *Ctx) Schema() agentiface.Schema {
 
 // SendCommand sends a command as a consequence of this event (correlationId is set)
 func (ctx *Ctx) SendCommand(to string, command interface{}) error {
-	publishing, err := ctx.amqp.preparePublishing(command)
+	sendTo := to
+	if to == "" {
+		to = ctx.envelope.ReplyTo
+		sendTo = to
 
-	if err != nil {
-		return err
+		// the reply to a request is sent to the address it is waited at (see Messaging.Request)
+		if address := headerString(ctx.envelope.Headers, agentiface.AmqpHeaderReplyTo); address != "" {
+			sendTo = address
+		}
 	}
 
-	if to == "" {
-		to = ctx.data.ReplyTo
+	envelope, err := ctx.messaging.preparePublishing(ctx, to, command)
+
+	if err != nil {
+		return err
 	}
 
-	publishing.Headers[agentiface.AmqpHeaderSendTo] = to
-	publishing.CorrelationId = ctx.data.MessageId
+	envelope.Headers[agentiface.AmqpHeaderSendTo] = sendTo
 
-	return ctx.amqp.publishCommand(publishing)
+	return ctx.messaging.publishCommand(envelope)
 }
 
 // SendEvent sends an event as a consequence of this message (correlationId is set)
 func (ctx *Ctx) SendEvent(event interface{}) error {
-	publishing, err := ctx.amqp.preparePublishing(event)
+	envelope, err := ctx.messaging.preparePublishing(ctx, "", event)
 
 	if err != nil {
 		return err
 	}
 
-	publishing.Headers[agentiface.AmqpHeaderSendTo] = ctx.data.ReplyTo
-	publishing.CorrelationId = ctx.data.MessageId
+	envelope.Headers[agentiface.AmqpHeaderSendTo] = ctx.envelope.ReplyTo
 
-	return ctx.amqp.publishEvent(publishing)
+	return ctx.messaging.publishEvent(envelope)
 }
 
-// AMQP is a low level handler of the AMQP connectionns, events and callbacks.
-type AMQP struct {
-	agent *Agent
+// Messaging dispatches the messages received through a transport to the registered callbacks
+// and sends messages through it.
+type Messaging struct {
+	agent     *Agent
+	transport agentiface.Transport
+
+	// protects the channels, the callbacks and the pending requests
+	mutex sync.RWMutex
+
+	// closed when the transport gets disconnected
+	stop chan struct{}
 
-	// amqp specifics
-	connection  *amqp.Connection
-	channel     *amqp.Channel
-	cmdQueues   [3]amqp.Queue
-	cmdChannels [3]<-chan amqp.Delivery
+	// context of the connection, cancelled when the transport gets disconnected
+	context context.Context
+	cancel  context.CancelFunc
 
 	// callbacks on state changes
 	callbacksState map[string]agentiface.StateCallback
 
 	// callbacks for commands
 	// - key is the typename of the message (name of the schema)
-	// - value is the pointer to the callback function
-	callbacksCmd map[agentiface.MessageName]agentiface.CommandCallback
+	// - value is the callback function wrapped by its middlewares
+	callbacksCmd map[agentiface.MessageName]agentiface.Handler
 
-	// callbacks for events
-	// - key is the name of the queue
-	// - value is the pointer to the callback function
-	callbacksEvt map[string]agentiface.EventCallback
+	// serializes the subscriptions of the event callbacks to the transport and protects them
+	subscriptionsMutex sync.Mutex
 
-	// aggregation channel
-	aggregationChannel chan func() error
-}
+	// callbacks for events, subscribed to the transport whenever it is connected
+	// - key is the id of the callback
+	// - value is the callback and its subscription
+	callbacksEvent map[string]*eventRegistration
 
-// NewAMQP creates a new instance of AMQP
-func NewAMQP(a *Agent) *AMQP {
-	a.SetDefaultConfigOption("endpoint", agentiface.ConfigDefaultEndpoint)
+	// state of the messaging
+	state agentiface.State
 
-	return &AMQP{
-		agent:              a,
-		callbacksState:     make(map[string]agentiface.StateCallback),
-		callbacksCmd:       make(map[agentiface.MessageName]agentiface.CommandCallback),
-		callbacksEvt:       make(map[string]agentiface.EventCallback),
-		aggregationChannel: nil, /* opened when connecting */
-	}
-}
+	// middlewares wrapping the processing of all the received messages
+	middlewares []agentiface.Middleware
 
-// Connect actually connects to the AMQP broker and initializes all the exchanges and queues.
-func (a *AMQP) Connect() (err error) {
-	oldState := a.State()
+	// middlewares wrapping the preparation of all the sent messages
+	publishMiddlewares []agentiface.PublishMiddleware
 
-	defer func() {
-		if oldState != a.State() {
-			a.notifyState()
-		}
-	}()
+	// requests waiting for a reply
+	// - key is the id of the request message
+	// - value is the channel on which the reply is delivered
+	pendingRequests map[string]chan *Ctx
 
-	endpoint := a.agent.GetConfigString("endpoint")
+	// codecs serializing the messages, by order of preference
+	codecs []agentiface.Codec
 
-	if a.State() == agentiface.StateConnected {
-		err = fmt.Errorf("Already connected to: %s", endpoint)
-		return
-	}
+	// content types of the messages sent to the agents (see PreferContentType)
+	// - key is the id of the agent
+	// - value is the content type
+	preferredContentTypes map[string]string
 
-	a.agent.Info("Connecting to %s", endpoint)
+	// writer schemas fetched from the senders of the messages (see fetchSchema)
+	// - key is the fingerprint of the schema
+	fetchedSchemas map[string]agentiface.Schema
 
-	a.connection, err = amqp.Dial(endpoint)
-	if err != nil {
-		a.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
-		return
-	}
+	// workers processing the incoming messages
+	pool *workerPool
 
-	a.channel, err = a.connection.Channel()
+	// messages received and not processed yet
+	inflight *inflight
 
-	if err != nil {
-		a.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
-		return
+	// ids of the subscriptions to the commands sent to the agent
+	subscriptionsCmd []string
+
+	// retries waiting for their backoff delay to elapse
+	// - key is the timer of the retry
+	// - value is the function publishing the retry
+	pendingRetries map[*time.Timer]func()
+}
+
+// NewMessaging creates a new instance of Messaging using the given transport.
+func NewMessaging(a *Agent, transport agentiface.Transport) *Messaging {
+	a.SetDefaultConfigOption(configRequestTimeout, "30s")
+	a.SetDefaultConfigOption(configPublishMandatory, false)
+	a.SetDefaultConfigOption(configWorkersSize, 1)
+	a.SetDefaultConfigOption(configWorkersOrdering, orderingNone)
+	a.SetDefaultConfigOption(configShutdownTimeout, "30s")
+	a.SetDefaultConfigOption(configSchemaDiscovery, false)
+	a.SetDefaultConfigOption(configSchemaDiscoveryTimeout, "5s")
+	setDefaultAckOptions(a)
+
+	return &Messaging{
+		agent:                 a,
+		transport:             transport,
+		state:                 agentiface.StateDisconnected,
+		callbacksState:        make(map[string]agentiface.StateCallback),
+		callbacksCmd:          make(map[agentiface.MessageName]agentiface.Handler),
+		callbacksEvent:        make(map[string]*eventRegistration),
+		middlewares:           []agentiface.Middleware{RecoveryMiddleware()},
+		pendingRequests:       make(map[string]chan *Ctx),
+		codecs:                []agentiface.Codec{avroCodec{}, jsonCodec{}},
+		preferredContentTypes: make(map[string]string),
+		fetchedSchemas:        make(map[string]agentiface.Schema),
+		pool:                  nil, /* created when connecting */
+		inflight:              newInflight(),
+		pendingRetries:        make(map[*time.Timer]func()),
 	}
+}
 
-	err = a.declareExchanges()
-	if err != nil {
-		a.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
-		return
+// Connect connects the transport and subscribes to the commands sent to the agent.
+// The connection can be vetoed by the state callbacks, on the transition to StateConnecting or to StateConnected.
+func (m *Messaging) Connect() error {
+	if isRunning(m.State()) {
+		return fmt.Errorf("Already connected")
 	}
 
-	err = a.declareQueues()
-	if err != nil {
-		a.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
-		return
+	if err := m.transition(agentiface.StateConnecting, nil); err != nil {
+		return err
 	}
 
-	a.agent.Go(a.readMessages)
+	// create the pool of workers which process all incoming messages
+	m.mutex.Lock()
+	m.stop = make(chan struct{})
+	m.context, m.cancel = context.WithCancel(context.Background())
+	m.pool = newWorkerPool(m.agent.GetConfigInt(configWorkersSize))
+	stop, pool := m.stop, m.pool
+	m.mutex.Unlock()
+
+	if err := m.transport.Connect(m.onTransportState); err != nil {
+		m.release()
+		m.transition(agentiface.StateFailed, err) // nolint: errcheck, cannot be vetoed
+		return err
+	}
 
-	return
-}
+	m.startWorkers(pool, stop)
 
-func (a *AMQP) readMessages(quit <-chan struct{}) error {
-	endpoint := a.agent.GetConfigString("endpoint")
-	a.agent.Info("Connected to: %s as %s", endpoint, a.agent.ID())
+	if err := m.subscribeCommands(); err != nil {
+		m.abortConnection(agentiface.StateFailed, err)
+		return err
+	}
 
-	// create an aggregation channel which gathers all incoming messages
-	a.aggregationChannel = make(chan func() error)
+	if err := m.transition(agentiface.StateConnected, nil); err != nil {
+		m.abortConnection(agentiface.StateDisconnected, err)
+		return err
+	}
 
-	defer func() {
-		close(a.aggregationChannel)
-	}()
+	m.agent.Go(func(quit <-chan struct{}) error {
+		return m.watchQuit(stop, quit)
+	})
 
-	a.agent.Go(a.processMessages)
+	m.connected()
 
-	for {
-		select {
-		case d, ok := <-a.cmdChannels[0]:
-			if !ok {
-				return nil
-			}
+	return nil
+}
 
-			a.aggregationChannel <- func() error {
-				return a.handleCommand(d)
-			}
-			continue
-		case d, ok := <-a.cmdChannels[1]:
-			if !ok {
-				return nil
-			}
+// abortConnection disconnects the transport while connecting, ending in the given state.
+func (m *Messaging) abortConnection(state agentiface.State, cause error) {
+	m.transport.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
+	m.release()
+	m.transition(state, cause) // nolint: errcheck, cannot be vetoed
+}
 
-			a.aggregationChannel <- func() error {
-				return a.handleCommand(d)
-			}
-			continue
-		case d, ok := <-a.cmdChannels[2]:
-			if !ok {
-				return nil
-			}
-			a.aggregationChannel <- func() error {
-				return a.handleCommand(d)
-			}
+// connected subscribes the event callbacks which are not subscribed yet and calls the hooks of the agent,
+// whenever the transport gets connected.
+func (m *Messaging) connected() {
+	m.subscriptionsMutex.Lock()
+	for id, callback := range m.callbacksEvent {
+		if callback.subscriptionID != "" {
 			continue
-		case <-quit:
-			return nil
 		}
-	}
-}
 
-func (a *AMQP) processMessages(quit <-chan struct{}) error {
-	defer func() {
-		err := a.Disconnect()
-		if err != nil {
-			a.agent.Warning("%s", err.Error())
+		if err := m.subscribeEvents(callback); err != nil {
+			m.agent.Warning("Failed to subscribe event callback '%s': %s", id, err.Error())
 		}
-	}()
-	for {
-		select {
-		case f, ok := <-a.aggregationChannel:
-			if !ok {
-				return nil
-			}
-			// call process function
-			err := f()
+	}
+	m.subscriptionsMutex.Unlock()
 
-			if err != nil {
-				a.agent.Error("%s", err.Error())
-			}
+	m.agent.callHooks("connected", m.agent.onConnectedHooks())
+}
 
-		case <-quit:
-			return nil
-		}
+// subscribeCommands subscribes to the commands sent to the agent.
+// For commands (and requests) the following queues are used:
+// - crucibuild/agent-git@localhost#352 (also receives the commands sent to "*")
+// - crucibuild/agent-git@192.168.4.2
+// - crucibuild/agent-git
+// The replies to the requests are consumed apart, so that they are not queued behind the commands waiting for a worker:
+// - crucibuild/agent-git@localhost#352/replies
+func (m *Messaging) subscribeCommands() error {
+	id := m.agent.ID()
+	nameAtHost := fmt.Sprintf("%s@%s", m.agent.Manifest().Name(), util.Host())
+	name := m.agent.Manifest().Name()
+
+	subscriptions := []agentiface.Subscription{
+		{
+			Destination: agentiface.DestinationCommand,
+			Queue:       id,
+			Exclusive:   true,
+			Filters: []map[string]interface{}{
+				{agentiface.AmqpHeaderSendTo: id},
+				{agentiface.AmqpHeaderSendTo: "*"},
+			},
+		},
+		{
+			Destination: agentiface.DestinationCommand,
+			Queue:       nameAtHost,
+			Filters: []map[string]interface{}{
+				{agentiface.AmqpHeaderSendTo: nameAtHost},
+			},
+		},
+		{
+			Destination: agentiface.DestinationCommand,
+			Queue:       name,
+			Filters: []map[string]interface{}{
+				{agentiface.AmqpHeaderSendTo: name},
+			},
+		},
 	}
-}
 
-// Disconnect disconnect from the broker.
-func (a *AMQP) Disconnect() error {
-	oldState := a.State()
+	handler := m.receive(m.handleCommand)
 
-	endpoint := a.agent.GetConfigString("endpoint")
+	for _, subscription := range subscriptions {
+		subscription.ManualAck = m.manualAck()
 
-	defer func() {
-		a.connection = nil
-		a.channel = nil
-		a.aggregationChannel = nil
+		id, err := m.transport.Subscribe(subscription, handler)
 
-		if oldState != a.State() {
-			a.notifyState()
+		if err != nil {
+			return err
 		}
-	}()
 
-	if a.State() == agentiface.StateDisconnected {
-		return fmt.Errorf("Not connected")
+		m.mutex.Lock()
+		m.subscriptionsCmd = append(m.subscriptionsCmd, id)
+		m.mutex.Unlock()
 	}
 
-	err := a.connection.Close()
-
-	a.agent.Info("Disconnected from: %s", endpoint)
+	// not paused when shutting down: the messages in flight may wait for replies
+	_, err := m.transport.Subscribe(agentiface.Subscription{
+		Destination: agentiface.DestinationCommand,
+		Queue:       m.replyAddress(),
+		Exclusive:   true,
+		ManualAck:   m.manualAck(),
+		Filters: []map[string]interface{}{
+			{agentiface.AmqpHeaderSendTo: m.replyAddress()},
+		},
+	}, handler)
 
 	return err
 }
 
-// State returns the state of the connection.
-func (a *AMQP) State() agentiface.State {
-	if a.connection == nil {
-		return agentiface.StateDisconnected
-	}
-
-	return agentiface.StateConnected
+// replyAddress returns the address the replies to the requests of the agent are sent to.
+func (m *Messaging) replyAddress() string {
+	return fmt.Sprintf("%s/replies", m.agent.ID())
 }
 
-func (a *AMQP) notifyState() {
-	s := a.State()
-	for _, f := range a.callbacksState {
-		f(s) // nolint: errcheck, error returned by callback function is not currently used in the sdk
+// receive returns an envelope handler which hands the processing of the envelopes to the workers.
+func (m *Messaging) receive(process func(envelope *agentiface.Envelope) error) agentiface.EnvelopeHandler {
+	m.mutex.RLock()
+	stop := m.stop
+	pool := m.pool
+	m.mutex.RUnlock()
+
+	return func(envelope *agentiface.Envelope) {
+		if reply, ok := m.pendingReply(envelope); ok {
+			// replies are not queued so that a callback can wait for them, and are decoded aside: decoding may fetch
+			// a schema (see fetchSchema), whose reply is received by this very handler
+			m.inflight.add()
+			m.agent.Go(func(_ <-chan struct{}) error {
+				defer m.inflight.done()
+
+				m.deliverReply(envelope, reply)
+
+				if err := m.settle(envelope, nil); err != nil {
+					m.agent.Warning("%s", err.Error())
+				}
+				return nil
+			})
+			return
+		}
+
+		m.inflight.add()
+
+		select {
+		case pool.channel(m.orderingKeyOf(envelope)) <- func() error {
+			defer m.inflight.done()
+			return m.settle(envelope, process(envelope))
+		}:
+		case <-stop:
+			m.inflight.done()
+		}
 	}
 }
 
-func (a *AMQP) declareExchanges() (err error) {
-	err = a.channel.ExchangeDeclare(
-		agentiface.ExchangeCommand, // name
-		"headers",                  // type
-		true,                       // durable
-		false,                      // auto-deleted
-		false,                      // internal
-		false,                      // no-wait
-		nil,                        // arguments
-	) // args Table
+// watchQuit shuts the messaging down gracefully when the agent quits (see Shutdown).
+func (m *Messaging) watchQuit(stop <-chan struct{}, quit <-chan struct{}) error {
+	select {
+	case <-stop:
+		return nil
+	case <-quit:
+		ctx, cancel := context.WithTimeout(context.Background(), m.agent.GetConfigDuration(configShutdownTimeout))
+		defer cancel()
+
+		err := m.Shutdown(ctx)
+
+		// the agent quits anyway: the messaging is stopped even if the shutdown has been vetoed
+		if isRunning(m.State()) {
+			m.Disconnect() // nolint: errcheck, the error of the shutdown is reported instead
+		}
+		m.release()
 
-	if err != nil {
 		return err
 	}
+}
 
-	err = a.channel.ExchangeDeclare(
-		agentiface.ExchangeEvent, // name
-		"headers",                // type
-		true,                     // durable
-		false,                    // auto-deleted
-		false,                    // internal
-		false,                    // no-wait
-		nil,                      // arguments
-	) // args Table
-
-	return err
+// Disconnect disconnect from the broker.
+func (m *Messaging) Disconnect() error {
+	return m.transport.Disconnect()
 }
 
-// declareQueues perform the declaration and binding of common queues for the agent.
-// For commands (and requests) the following queues are created (if needed)
-// - crucibuild/agent-git@localhost#352
-// - crucibuild/agent-git@192.168.4.2
-// - crucibuild/agent-git*/
-func (a *AMQP) declareQueues() (err error) {
-	// FIXME: find a better way to code this - ugly code
-	// ## Declare queues for commands
-	a.cmdQueues[0], err = a.channel.QueueDeclare(
-		a.agent.ID(),
-		false, // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+// release stops the processing of the incoming messages.
+func (m *Messaging) release() {
+	m.mutex.Lock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
 
-	if err != nil {
-		return err
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
 	}
 
-	err = a.channel.QueueBind(
-		a.cmdQueues[0].Name, // queue name
-		"",                  // routing key
-		agentiface.ExchangeCommand, // exchange
-		false,
-		amqp.Table{
-			agentiface.AmqpHeaderSendTo: a.cmdQueues[0].Name,
-		},
-	)
+	// the subscriptions are dropped by the transport
+	m.subscriptionsCmd = nil
+	m.mutex.Unlock()
 
-	if err != nil {
-		return err
+	// the event callbacks are kept, to be subscribed again when connected
+	m.subscriptionsMutex.Lock()
+	for _, callback := range m.callbacksEvent {
+		callback.subscriptionID = ""
 	}
+	m.subscriptionsMutex.Unlock()
+}
 
-	err = a.channel.QueueBind(
-		a.cmdQueues[0].Name, // queue name
-		"",                  // routing key
-		agentiface.ExchangeCommand, // exchange
-		false,
-		amqp.Table{
-			agentiface.AmqpHeaderSendTo: "*",
-		},
-	)
+// State returns the state of the messaging.
+func (m *Messaging) State() agentiface.State {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	if err != nil {
-		return err
-	}
+	return m.state
+}
 
-	a.cmdQueues[1], err = a.channel.QueueDeclare(
-		fmt.Sprintf("%s@%s", a.agent.Manifest().Name(), util.Host()),
-		false, // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+// transition changes the state of the messaging once the state callbacks have been notified. The transitions to
+// StateConnecting, StateConnected and StateDraining are vetoed if a callback returns an error, which is returned.
+func (m *Messaging) transition(to agentiface.State, cause error) error {
+	m.mutex.RLock()
+	from := m.state
+	m.mutex.RUnlock()
 
-	if err != nil {
-		return err
+	if from == to {
+		return nil
 	}
 
-	err = a.channel.QueueBind(
-		a.cmdQueues[1].Name, // queue name
-		"",                  // routing key
-		agentiface.ExchangeCommand, // exchange
-		false,
-		amqp.Table{
-			agentiface.AmqpHeaderSendTo: a.cmdQueues[1].Name,
-		},
-	)
+	transition := agentiface.Transition{From: from, To: to, Cause: cause}
 
-	if err != nil {
-		return err
+	if err := m.notifyState(transition); err != nil {
+		switch to {
+		case agentiface.StateConnecting, agentiface.StateConnected, agentiface.StateDraining:
+			return errors.Wrapf(err, "Transition from %s to %s vetoed", from, to)
+		default:
+			m.agent.Warning("State callback failed on transition from %s to %s: %s", from, to, err.Error())
+		}
 	}
 
-	a.cmdQueues[2], err = a.channel.QueueDeclare(
-		a.agent.Manifest().Name(),
-		false, // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+	m.mutex.Lock()
+	m.state = to
+	m.mutex.Unlock()
 
-	if err != nil {
-		return err
+	return nil
+}
+
+// onTransportState follows the transitions of the transport.
+func (m *Messaging) onTransportState(transition agentiface.Transition) error {
+	if transition.To == agentiface.StateDisconnected || transition.To == agentiface.StateFailed {
+		m.release()
 	}
 
-	err = a.channel.QueueBind(
-		a.cmdQueues[2].Name, // queue name
-		"",                  // routing key
-		agentiface.ExchangeCommand, // exchange
-		false,
-		amqp.Table{
-			agentiface.AmqpHeaderSendTo: a.cmdQueues[2].Name,
-		},
-	)
+	if m.State() == agentiface.StateConnecting {
+		// the transitions are driven by Connect
+		return nil
+	}
 
-	if err != nil {
-		return err
+	switch transition.To {
+	case agentiface.StateConnected:
+		// reconnected
+		if err := m.transition(agentiface.StateConnected, nil); err != nil {
+			m.agent.Warning("%s", err.Error())
+			m.transport.Disconnect() // nolint: errcheck, silently disconnect and do not report any errors
+			return nil
+		}
+		m.connected()
+	default:
+		m.transition(transition.To, transition.Cause) // nolint: errcheck, cannot be vetoed
 	}
 
-	// - create channels on that queues
-	for i := 0; i < 3; i++ {
-		a.cmdChannels[i], err = a.channel.Consume(
-			a.cmdQueues[i].Name, // queue
-			"",                  // consumer
-			true,                // auto-ack
-			false,               // exclusive
-			false,               // no-local
-			false,               // no-wait
-			nil,                 // args
-		)
+	return nil
+}
 
-		if err != nil {
+// notifyState calls the state callbacks until one of them returns an error, which is returned.
+func (m *Messaging) notifyState(transition agentiface.Transition) error {
+	m.mutex.RLock()
+	callbacks := make([]agentiface.StateCallback, 0, len(m.callbacksState))
+	for _, f := range m.callbacksState {
+		callbacks = append(callbacks, f)
+	}
+	m.mutex.RUnlock()
+
+	for _, f := range callbacks {
+		if err := f(transition); err != nil {
 			return err
 		}
 	}
 
-	// ## declare queues for events
-	// done on demand
-
 	return nil
 }
 
-func (a *AMQP) getSchema(d amqp.Delivery) (agentiface.Schema, error) {
+func (m *Messaging) getSchema(e *agentiface.Envelope) (agentiface.Schema, agentiface.Codec, error) {
 	// check content type
-	if d.ContentType != agentiface.MimeTypeAvro {
-		return nil, fmt.Errorf("Not Acceptable: Content-type: %s", d.ContentType)
+	codec := m.codec(e.ContentType)
+	if codec == nil {
+		return nil, nil, fmt.Errorf("Not Acceptable: Content-type: %s", e.ContentType)
 	}
 
 	// check message type
-	messageType := strings.TrimSpace(d.Type)
+	messageType := strings.TrimSpace(e.Type)
 
 	if messageType == "" {
-		return nil, fmt.Errorf("Not Acceptable: No Message-type provided")
+		return nil, nil, fmt.Errorf("Not Acceptable: No Message-type provided")
 	}
 
-	s, err := a.agent.SchemaGetByID(messageType)
+	// the schemas of the unknown types are not discovered: their messages could not be decoded without a Go type
+	s, err := m.agent.SchemaGetByID(messageType)
 	if err != nil {
-		println(err.Error())
-		return nil, fmt.Errorf("Not Acceptable: Message-type '%s' is unknown", messageType)
+		return nil, nil, fmt.Errorf("Not Acceptable: Message-type '%s' is unknown", messageType)
 	}
 
-	return s, nil
+	if !codec.Supports(s) {
+		return nil, nil, fmt.Errorf("Not Acceptable: Message-type '%s' cannot be received as %s", messageType, e.ContentType)
+	}
+
+	return s, codec, nil
 }
 
-// decode decodes the given delivery and returns the Avro schema, a pointer to the decoded record and eventually
+// decode decodes the given envelope and returns the Avro schema, a pointer to the decoded record and eventually
 // the error if something went wrong
-func (a *AMQP) decode(d amqp.Delivery) (agentiface.Schema, interface{}, error) {
-	messageType := strings.TrimSpace(d.Type)
+func (m *Messaging) decode(e *agentiface.Envelope) (agentiface.Schema, interface{}, error) {
+	messageType := strings.TrimSpace(e.Type)
 
-	s, err := a.getSchema(d)
+	s, codec, err := m.getSchema(e)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	t, err := a.agent.TypeGetByName(messageType)
+	t, err := m.agent.TypeGetByName(messageType)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Not Acceptable: Message-type '%s' is unknown", messageType)
 	}
 
-	decodedRecord, err := s.Decode(d.Body, t)
+	decoder := s
+	if resolvesWriter(codec) {
+		decoder, err = m.resolveSchema(e, s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	decodedRecord, err := codec.Decode(decoder, e.Body, t)
 
 	if err != nil {
 		return nil, nil, err
@@ -509,134 +605,372 @@ func (a *AMQP) decode(d amqp.Delivery) (agentiface.Schema, interface{}, error) {
 	return s, decodedRecord, nil
 }
 
-func (a *AMQP) handleCommand(d amqp.Delivery) error {
-	s, decodedRecord, err := a.decode(d)
+// resolveSchema returns the schema decoding a message: the latest version of its schema, resolving the data written
+// by the sender with another revision of the schema (see writerSchema).
+func (m *Messaging) resolveSchema(e *agentiface.Envelope, s agentiface.Schema) (agentiface.Schema, error) {
+	writer, err := m.writerSchema(e, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if writer == s {
+		return s, nil
+	}
+
+	evolvable, ok := s.(agentiface.EvolvableSchema)
+	if !ok {
+		return writer, nil
+	}
+
+	resolving, err := evolvable.WithWriter(writer)
+	if err != nil {
+		return nil, fmt.Errorf("Not Acceptable: Message-type '%s' written with another revision cannot be read: %s", s.ID(), err.Error())
+	}
+
+	return resolving, nil
+}
+
+// writerSchema returns the schema a message has been written with: the revision given by its fingerprint (see
+// agentiface.AmqpHeaderSchemaFingerprint), fetched from the sender if unknown and the discovery is enabled. Without
+// fingerprint, the message is considered written with s: its agentiface.AmqpHeaderSchemaVersion is the version
+// numbered by the sender, which tells nothing about the versions registered by the receiver.
+func (m *Messaging) writerSchema(e *agentiface.Envelope, s agentiface.Schema) (agentiface.Schema, error) {
+	if fingerprint, _ := e.Headers[agentiface.AmqpHeaderSchemaFingerprint].(string); fingerprint != "" {
+		if f, ok := s.(agentiface.FingerprintedSchema); ok && f.Fingerprint() == fingerprint {
+			return s, nil
+		}
+
+		writer, err := m.agent.SchemaGetByFingerprint(fingerprint)
+		if err == nil && writer.ID() == s.ID() {
+			return writer, nil
+		}
+
+		if !m.discoveryEnabled(e) {
+			return nil, errors.Wrapf(agentiface.ErrUnknownSchemaRevision, "Not Acceptable: Message-type '%s' with fingerprint '%s'", s.ID(), fingerprint)
+		}
+
+		writer, err = m.fetchSchema(e, s.ID(), fingerprint)
+		if err != nil {
+			return nil, errors.Wrapf(agentiface.ErrUnknownSchemaRevision, "Not Acceptable: Message-type '%s' with fingerprint '%s' (%s)", s.ID(), fingerprint, err.Error())
+		}
+
+		return writer, nil
+	}
+
+	return s, nil
+}
+
+// connectionContext returns the context of the connection, which is cancelled when the transport gets disconnected.
+func (m *Messaging) connectionContext() context.Context {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.context == nil {
+		// never connected
+		return context.Background()
+	}
+
+	return m.context
+}
+
+// newContext returns the context of the processing of a received message: it is derived from the context of the
+// connection and, if the message has an expiration, has a deadline counted from its reception.
+func (m *Messaging) newContext(e *agentiface.Envelope) (context.Context, context.CancelFunc) {
+	parent := m.connectionContext()
+
+	if e.Expiration != "" {
+		if ttl, err := strconv.ParseInt(e.Expiration, 10, 64); err == nil {
+			return context.WithTimeout(parent, time.Duration(ttl)*time.Millisecond)
+		}
+	}
+
+	return context.WithCancel(parent)
+}
+
+func (m *Messaging) handleCommand(e *agentiface.Envelope) error {
+	s, decodedRecord, err := m.decode(e)
 
 	if err != nil {
 		return err
 	}
 
 	// Dispatch to the suitable callback
-	c, ok := a.callbacksCmd[agentiface.MessageName(s.ID())]
+	m.mutex.RLock()
+	c, ok := m.callbacksCmd[agentiface.MessageName(s.ID())]
+	m.mutex.RUnlock()
 
 	if !ok {
 		return fmt.Errorf("Not Acceptable: Message-type '%s' is not handled", s.ID())
 	}
 
-	// Invoke the callback
-	err = c(&Ctx{
-		amqp:   a,
-		data:   d,
-		schema: s,
-		msg:    decodedRecord,
-	})
-
-	return err
+	return m.process(e, s, decodedRecord, c)
 }
 
-func (a *AMQP) handleEvent(d amqp.Delivery, callback agentiface.EventCallback) error {
-	s, decodedRecord, err := a.decode(d)
+func (m *Messaging) handleEvent(e *agentiface.Envelope, handler agentiface.Handler) error {
+	s, decodedRecord, err := m.decode(e)
 
 	if err != nil {
 		return err
 	}
 
+	return m.process(e, s, decodedRecord, handler)
+}
+
+// process invokes the handler of a decoded message, wrapped by the global middlewares, and traces it.
+func (m *Messaging) process(e *agentiface.Envelope, s agentiface.Schema, decodedRecord interface{}, handler agentiface.Handler) error {
+	msgCtx, cancel := m.newContext(e)
+	defer cancel()
+
+	ctx := &Ctx{
+		messaging: m,
+		context:   msgCtx,
+		envelope:  e,
+		schema:    s,
+		msg:       decodedRecord,
+		spanID:    newSpanID(),
+	}
+
+	if traceID, _, ok := parseTraceParent(headerString(e.Headers, agentiface.AmqpHeaderTraceParent)); ok {
+		ctx.traceID = traceID
+	} else {
+		ctx.traceID = newTraceID()
+	}
+
+	span := m.processSpan(ctx)
+
 	// Invoke the callback
-	err = callback(&Ctx{
-		amqp:   a,
-		data:   d,
-		schema: s,
-		msg:    decodedRecord,
-	})
+	err := m.wrap(handler)(ctx)
+
+	span.Duration = time.Since(span.Start)
+	if err != nil {
+		span.Error = err.Error()
+	}
+	m.export(span)
 
 	return err
 }
 
 // RegisterStateCallback registers a callback triggered by state changes.
-func (a *AMQP) RegisterStateCallback(stateCallback agentiface.StateCallback) string {
+func (m *Messaging) RegisterStateCallback(stateCallback agentiface.StateCallback) string {
 	key := uuid.Must(uuid.NewV4()).String()
-	a.callbacksState[key] = stateCallback
+
+	m.mutex.Lock()
+	m.callbacksState[key] = stateCallback
+	m.mutex.Unlock()
 
 	return key
 }
 
-// RegisterCommandCallback registers a callback triggered by a command reception.
-func (a *AMQP) RegisterCommandCallback(commandName agentiface.MessageName, commandCallback agentiface.CommandCallback) (string, error) {
-	if a.State() != agentiface.StateConnected {
-		return "", fmt.Errorf("Cannot register command callback if not connected")
-	}
+// RegisterCommandCallback registers a callback triggered by a command reception, wrapped by the given middlewares.
+func (m *Messaging) RegisterCommandCallback(commandName agentiface.MessageName, commandCallback agentiface.CommandCallback, middlewares ...agentiface.Middleware) (string, error) {
+	handler := chain(func(ctx agentiface.Ctx) error {
+		// the middlewares may have wrapped the context
+		commandCtx, ok := ctx.(agentiface.CommandCtx)
+		if !ok {
+			return fmt.Errorf("Invalid context %T: the command callbacks need an agentiface.CommandCtx", ctx)
+		}
 
-	a.callbacksCmd[commandName] = commandCallback
+		return commandCallback(commandCtx)
+	}, middlewares)
+
+	m.mutex.Lock()
+	m.callbacksCmd[commandName] = handler
+	m.mutex.Unlock()
 
 	return string(commandName), nil
 }
 
-// RegisterEventCallback registers a callback triggered by an event reception.
-func (a *AMQP) RegisterEventCallback(filter agentiface.EventFilter, eventCallback agentiface.EventCallback) (string, error) {
-	if a.State() != agentiface.StateConnected {
-		return "", fmt.Errorf("Cannot register event callback if not connected")
-	}
+// RegisterEventCallback registers a callback triggered by an event reception, wrapped by the given middlewares.
+// The filter is given as raw binding arguments (see agentiface.FromEventFilter).
+func (m *Messaging) RegisterEventCallback(filter agentiface.EventFilter, eventCallback agentiface.EventCallback, middlewares ...agentiface.Middleware) (string, error) {
+	return m.RegisterFilteredEventCallback(agentiface.FromEventFilter(filter), eventCallback, middlewares...)
+}
+
+// eventRegistration is a callback on events with the subscription it requires.
+type eventRegistration struct {
+	subscription agentiface.Subscription
+	handler      agentiface.Handler
+
+	// id of the subscription to the transport, empty if not subscribed
+	subscriptionID string
 
-	// declare new queue (exclusive)
-	queue, err := a.channel.QueueDeclare(
-		"",    // FIXME: name - automatically generated
-		false, // durable
-		true,  // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+	// true if the reception of the events is paused
+	paused bool
+}
+
+// RegisterFilteredEventCallback registers a callback triggered by the reception of an event matching the filter,
+// wrapped by the given middlewares. The callback can be registered before connecting: its events are subscribed
+// to whenever the agent gets connected.
+func (m *Messaging) RegisterFilteredEventCallback(filter *agentiface.Filter, eventCallback agentiface.EventCallback, middlewares ...agentiface.Middleware) (string, error) {
+	bindings, err := filter.Bindings()
 
 	if err != nil {
 		return "", err
 	}
 
-	err = a.channel.QueueBind(
-		queue.Name, // queue name
-		"",         // routing key
-		agentiface.ExchangeEvent, // exchange
-		false, // no-Wait
-		amqp.Table(filter),
-	)
+	callback := &eventRegistration{
+		subscription: agentiface.Subscription{
+			Destination: agentiface.DestinationEvent,
+			Exclusive:   true,
+			Filters:     bindings,
+		},
+		handler: chain(func(ctx agentiface.Ctx) error {
+			// the middlewares may have wrapped the context
+			eventCtx, ok := ctx.(agentiface.EventCtx)
+			if !ok {
+				return fmt.Errorf("Invalid context %T: the event callbacks need an agentiface.EventCtx", ctx)
+			}
 
-	if err != nil {
-		return "", err
+			return eventCallback(eventCtx)
+		}, middlewares),
 	}
 
-	// listen to it:
-	channel, err := a.channel.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		true,       // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
+	m.subscriptionsMutex.Lock()
+	defer m.subscriptionsMutex.Unlock()
+
+	if m.State() == agentiface.StateConnected {
+		if err := m.subscribeEvents(callback); err != nil {
+			return "", err
+		}
+	}
+
+	id := uuid.Must(uuid.NewV4()).String()
+	m.callbacksEvent[id] = callback
+
+	return id, nil
+}
+
+// subscribeEvents subscribes an event callback to the transport. The subscriptions mutex must be held.
+func (m *Messaging) subscribeEvents(callback *eventRegistration) error {
+	subscription := callback.subscription
+	subscription.ManualAck = m.manualAck()
+
+	id, err := m.transport.Subscribe(subscription, m.receive(func(e *agentiface.Envelope) error {
+		return m.handleEvent(e, callback.handler)
+	}))
+
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	a.agent.Go(func(quit <-chan struct{}) error {
-		for {
-			select {
-			case d, ok := <-channel:
-				if !ok {
-					return nil
-				}
-				a.aggregationChannel <- func() error {
-					return a.handleEvent(d, eventCallback)
-				}
-			case <-quit:
-				return nil
-			}
+	callback.subscriptionID = id
+
+	if callback.paused {
+		return m.transport.Pause(id)
+	}
+
+	return nil
+}
+
+// UnregisterCallback unregisters a state, command or event callback given the id returned when registering it.
+// The subscription of an event callback is cancelled and its queue deleted.
+func (m *Messaging) UnregisterCallback(id string) error {
+	m.mutex.Lock()
+
+	if _, ok := m.callbacksState[id]; ok {
+		delete(m.callbacksState, id)
+		m.mutex.Unlock()
+		return nil
+	}
+
+	if _, ok := m.callbacksCmd[agentiface.MessageName(id)]; ok {
+		delete(m.callbacksCmd, agentiface.MessageName(id))
+		m.mutex.Unlock()
+		return nil
+	}
+
+	m.mutex.Unlock()
+
+	m.subscriptionsMutex.Lock()
+	defer m.subscriptionsMutex.Unlock()
+
+	callback, ok := m.callbacksEvent[id]
+	delete(m.callbacksEvent, id)
+
+	if !ok {
+		return fmt.Errorf("Unknown callback: %s", id)
+	}
+
+	if callback.subscriptionID == "" {
+		return nil
+	}
+
+	return m.transport.Unsubscribe(callback.subscriptionID)
+}
+
+// PauseEventCallback stops receiving the events of an event callback. The events are kept until it is resumed.
+func (m *Messaging) PauseEventCallback(id string) error {
+	return m.setEventCallbackPaused(id, true)
+}
+
+// ResumeEventCallback starts receiving again the events of a paused event callback.
+func (m *Messaging) ResumeEventCallback(id string) error {
+	return m.setEventCallbackPaused(id, false)
+}
+
+func (m *Messaging) setEventCallbackPaused(id string, paused bool) error {
+	m.subscriptionsMutex.Lock()
+	defer m.subscriptionsMutex.Unlock()
+
+	callback, ok := m.callbacksEvent[id]
+
+	if !ok {
+		return fmt.Errorf("Unknown event callback: %s", id)
+	}
+
+	callback.paused = paused
+
+	if callback.subscriptionID == "" {
+		// applied when subscribed
+		return nil
+	}
+
+	if paused {
+		return m.transport.Pause(callback.subscriptionID)
+	}
+
+	return m.transport.Resume(callback.subscriptionID)
+}
+
+// preparePublishing prepares the envelope of a message to send to an agent (to, empty for the events) through the
+// publish middlewares. If the message is sent as a consequence of a received message (parent), it is correlated to
+// it and its trace is continued.
+func (m *Messaging) preparePublishing(parent *Ctx, to string, msg interface{}) (*agentiface.Envelope, error) {
+	preferred := m.preferredContentType(parent, to)
+
+	m.mutex.RLock()
+	publisher := agentiface.Publisher(func(msg interface{}) (*agentiface.Envelope, error) {
+		envelope, err := m.encode(msg, preferred)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if parent != nil {
+			envelope.CorrelationID = parent.envelope.MessageID
+			envelope.Headers[agentiface.AmqpHeaderCorrelationID] = envelope.CorrelationID
 		}
+
+		m.trace(parent, envelope)
+
+		return envelope, nil
 	})
+	for i := len(m.publishMiddlewares) - 1; i >= 0; i-- {
+		publisher = m.publishMiddlewares[i](publisher)
+	}
+	m.mutex.RUnlock()
 
-	return queue.Name, nil
+	return publisher(msg)
 }
 
-func (a *AMQP) preparePublishing(msg interface{}) (*amqp.Publishing, error) {
+// encode serializes a message in a new envelope, in the content type requested for the message (see
+// agentiface.ContentTyped), else in the preferred one if supported (see encodingCodec).
+func (m *Messaging) encode(msg interface{}, preferred string) (*agentiface.Envelope, error) {
+	requested := ""
+	if typed, ok := msg.(*agentiface.ContentTyped); ok {
+		msg, requested = typed.Message, typed.ContentType
+	}
+
 	// find message name from type
 	atype, err := util.GetStructType(msg)
 
@@ -644,78 +978,187 @@ func (a *AMQP) preparePublishing(msg interface{}) (*amqp.Publishing, error) {
 		return nil, err
 	}
 
-	typeInfo, err := a.agent.TypeGetByType(atype)
+	typeInfo, err := m.agent.TypeGetByType(atype)
 
 	if err != nil {
 		return nil, fmt.Errorf("Not Acceptable: %s", err.Error())
 	}
 
 	// from message name get the schema:
-	schema, err := a.agent.SchemaGetByID(typeInfo.Name())
+	schema, err := m.agent.SchemaGetByID(typeInfo.Name())
 
 	if err != nil {
 		return nil, fmt.Errorf("Not Acceptable: Message-type '%s' is not handled", typeInfo.Name())
 	}
 
-	bytes, err := schema.Code(msg)
+	codec, err := m.encodingCodec(schema, requested, preferred)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// send command:
-	return &amqp.Publishing{
+	bytes, err := codec.Code(schema, msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the latest version, returned by SchemaGetByID
+	version := 0
+	if versions := m.agent.SchemaVersions(schema.ID()); len(versions) > 0 {
+		version = versions[len(versions)-1]
+	}
+
+	envelope := &agentiface.Envelope{
 		Timestamp:   time.Now(),
-		ContentType: agentiface.MimeTypeAvro,
-		MessageId:   uuid.Must(uuid.NewV4()).String(),
+		ContentType: codec.ContentType(),
+		MessageID:   uuid.Must(uuid.NewV4()).String(),
 		Type:        schema.ID(),
-		ReplyTo:     a.agent.ID(),
+		ReplyTo:     m.agent.ID(),
 
 		Headers: map[string]interface{}{
 			// used for headers routing
-			"type": schema.ID(),
+			agentiface.AmqpHeaderType:          schema.ID(),
+			agentiface.AmqpHeaderSchemaVersion: version,
+			agentiface.AmqpHeaderSenderID:      m.agent.ID(),
+			agentiface.AmqpHeaderSenderName:    m.agent.Manifest().Name(),
 		},
 
 		Body: bytes,
-	}, nil
-}
+	}
 
-func (a *AMQP) publishCommand(publishing *amqp.Publishing) error {
-	if a.State() != agentiface.StateConnected {
-		return errors.New("Not connected")
+	if f, ok := schema.(agentiface.FingerprintedSchema); ok {
+		envelope.Headers[agentiface.AmqpHeaderSchemaFingerprint] = f.Fingerprint()
 	}
 
-	return a.channel.Publish(
-		agentiface.ExchangeCommand,
-		"",
-		false, // mandatory
-		false, // immediate
-		*publishing)
+	return envelope, nil
 }
 
-func (a *AMQP) publishEvent(publishing *amqp.Publishing) error {
-	a.agent.Debug("Sending event")
-	if a.State() != agentiface.StateConnected {
-		return errors.New("Not connected")
-	}
+func (m *Messaging) publishCommand(envelope *agentiface.Envelope) error {
+	envelope.Mandatory = m.agent.GetConfigBool(configPublishMandatory)
+
+	return m.transport.Publish(agentiface.DestinationCommand, envelope)
+}
 
-	return a.channel.Publish(
-		agentiface.ExchangeEvent,
-		"",
-		false, // mandatory
-		false, // immediate
-		*publishing)
+func (m *Messaging) publishEvent(envelope *agentiface.Envelope) error {
+	m.agent.Debug("Sending event")
+
+	return m.transport.Publish(agentiface.DestinationEvent, envelope)
 }
 
 // SendCommand sends a command to a specific agent.
-func (a *AMQP) SendCommand(to string, command interface{}) error {
-	publishing, err := a.preparePublishing(command)
+func (m *Messaging) SendCommand(to string, command interface{}) error {
+	envelope, err := m.preparePublishing(nil, to, command)
 
 	if err != nil {
 		return err
 	}
 
-	publishing.Headers[agentiface.AmqpHeaderSendTo] = to
+	envelope.Headers[agentiface.AmqpHeaderSendTo] = to
+
+	return m.publishCommand(envelope)
+}
+
+// Request sends a command to a specific agent and waits for its reply.
+// If ctx has no deadline, the timeout defined in the configuration (request.timeout) is used.
+func (m *Messaging) Request(ctx context.Context, to string, command interface{}) (agentiface.Ctx, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.agent.GetConfigDuration(configRequestTimeout))
+		defer cancel()
+	}
+
+	envelope, err := m.preparePublishing(nil, to, command)
+
+	if err != nil {
+		return nil, err
+	}
+
+	envelope.Headers[agentiface.AmqpHeaderSendTo] = to
+	envelope.Headers[agentiface.AmqpHeaderReplyTo] = m.replyAddress()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// the broker drops the request if it cannot be delivered before the deadline
+		ttl := time.Until(deadline) / time.Millisecond
+		if ttl < 1 {
+			ttl = 1
+		}
+		envelope.Expiration = strconv.FormatInt(int64(ttl), 10)
+	}
+
+	reply := make(chan *Ctx, 1)
+
+	m.mutex.Lock()
+	m.pendingRequests[envelope.MessageID] = reply
+	stop := m.stop
+	m.mutex.Unlock()
+
+	defer func() {
+		m.mutex.Lock()
+		delete(m.pendingRequests, envelope.MessageID)
+		m.mutex.Unlock()
+	}()
+
+	if err = m.publishCommand(envelope); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-stop:
+		return nil, errors.New("Disconnected while waiting for a reply")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &agentiface.RequestTimeoutError{
+				To:        to,
+				MessageID: envelope.MessageID,
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// pendingReply returns the channel of the request waiting for the given envelope, if it is a reply.
+func (m *Messaging) pendingReply(e *agentiface.Envelope) (chan *Ctx, bool) {
+	if e.CorrelationID == "" || e.Destination != agentiface.DestinationCommand {
+		return nil, false
+	}
+
+	m.mutex.RLock()
+	reply, ok := m.pendingRequests[e.CorrelationID]
+	m.mutex.RUnlock()
+
+	return reply, ok
+}
 
-	return a.publishCommand(publishing)
+// deliverReply decodes the given reply and hands it to the request waiting for it (see pendingReply).
+func (m *Messaging) deliverReply(e *agentiface.Envelope, reply chan *Ctx) {
+	s, decodedRecord, err := m.decode(e)
+
+	if err != nil {
+		m.agent.Error("Invalid reply to request '%s': %s", e.CorrelationID, err.Error())
+		return
+	}
+
+	ctx := &Ctx{
+		messaging: m,
+		context:   m.connectionContext(),
+		envelope:  e,
+		schema:    s,
+		msg:       decodedRecord,
+	}
+
+	// the messages sent as a consequence of the reply continue the trace of the request
+	if traceID, spanID, ok := parseTraceParent(headerString(e.Headers, agentiface.AmqpHeaderTraceParent)); ok {
+		ctx.traceID, ctx.spanID = traceID, spanID
+	} else {
+		ctx.traceID, ctx.spanID = newTraceID(), newSpanID()
+	}
+
+	select {
+	case reply <- ctx:
+	default:
+		m.agent.Warning("Duplicated reply to request '%s' ignored", e.CorrelationID)
+	}
 }
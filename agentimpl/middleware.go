@@ -0,0 +1,96 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+)
+
+// Use adds middlewares wrapping the processing of all the received commands and events.
+// The first middleware is the outermost one. A RecoveryMiddleware is always used first.
+func (m *Messaging) Use(middlewares ...agentiface.Middleware) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+// UsePublish adds middlewares wrapping the preparation of all the sent commands and events.
+// The first middleware is the outermost one.
+func (m *Messaging) UsePublish(middlewares ...agentiface.PublishMiddleware) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.publishMiddlewares = append(m.publishMiddlewares, middlewares...)
+}
+
+// wrap wraps a handler with the middlewares registered with Use.
+func (m *Messaging) wrap(handler agentiface.Handler) agentiface.Handler {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return chain(handler, m.middlewares)
+}
+
+// chain wraps a handler with middlewares, the first one being the outermost one.
+func chain(handler agentiface.Handler, middlewares []agentiface.Middleware) agentiface.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// RecoveryMiddleware returns a middleware turning a panic raised while processing a message into an error.
+func RecoveryMiddleware() agentiface.Middleware {
+	return func(next agentiface.Handler) agentiface.Handler {
+		return func(ctx agentiface.Ctx) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = errors.Errorf("Panic while processing message '%s': %v", ctx.Properties()["MessageId"], r)
+				}
+			}()
+
+			return next(ctx)
+		}
+	}
+}
+
+// LoggingMiddleware returns a middleware logging the outcome of the processing of every message
+// as a list of key=value pairs.
+func LoggingMiddleware(logger agentiface.Logger) agentiface.Middleware {
+	return func(next agentiface.Handler) agentiface.Handler {
+		return func(ctx agentiface.Ctx) error {
+			start := time.Now()
+			err := next(ctx)
+			duration := time.Since(start)
+
+			p := ctx.Properties()
+
+			if err != nil {
+				logger.Warning("message type=%q id=%q correlation-id=%q reply-to=%q duration=%s status=failed error=%q",
+					p["Type"], p["MessageId"], p["CorrelationId"], p["ReplyTo"], duration, err.Error())
+			} else {
+				logger.Info("message type=%q id=%q correlation-id=%q reply-to=%q duration=%s status=ok",
+					p["Type"], p["MessageId"], p["CorrelationId"], p["ReplyTo"], duration)
+			}
+
+			return err
+		}
+	}
+}
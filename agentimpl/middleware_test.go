@@ -0,0 +1,284 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordingLogger is a logger keeping the logged messages.
+type recordingLogger struct {
+	mutex sync.Mutex
+	logs  []string
+}
+
+func (l *recordingLogger) log(level string, format string, a ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.logs = append(l.logs, level+" "+fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) Emergency(format string, a ...interface{}) {
+	l.log("emergency", format, a...)
+}
+
+func (l *recordingLogger) Alert(format string, a ...interface{}) {
+	l.log("alert", format, a...)
+}
+
+func (l *recordingLogger) Critical(format string, a ...interface{}) {
+	l.log("critical", format, a...)
+}
+
+func (l *recordingLogger) Error(format string, a ...interface{}) {
+	l.log("error", format, a...)
+}
+
+func (l *recordingLogger) Warning(format string, a ...interface{}) {
+	l.log("warning", format, a...)
+}
+
+func (l *recordingLogger) Info(format string, a ...interface{}) {
+	l.log("info", format, a...)
+}
+
+func (l *recordingLogger) Debug(format string, a ...interface{}) {
+	l.log("debug", format, a...)
+}
+
+// tracingMiddleware returns a middleware appending its name to trace before and after the processing.
+func tracingMiddleware(name string, trace *[]string) agentiface.Middleware {
+	return func(next agentiface.Handler) agentiface.Handler {
+		return func(ctx agentiface.Ctx) error {
+			*trace = append(*trace, ">"+name)
+			err := next(ctx)
+			*trace = append(*trace, "<"+name)
+			return err
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	ctx := &Ctx{
+		envelope: &agentiface.Envelope{MessageID: "42", Type: schemaID},
+	}
+
+	Convey("Given a chain of middlewares", t, func() {
+		var trace []string
+
+		handler := chain(func(ctx agentiface.Ctx) error {
+			trace = append(trace, "handler")
+			return nil
+		}, []agentiface.Middleware{tracingMiddleware("a", &trace), tracingMiddleware("b", &trace)})
+
+		Convey("The first middleware should be the outermost one", func() {
+			So(handler(ctx), ShouldBeNil)
+			So(trace, ShouldResemble, []string{">a", ">b", "handler", "<b", "<a"})
+		})
+	})
+
+	Convey("Given a handler which panics wrapped by the recovery middleware", t, func() {
+		handler := RecoveryMiddleware()(func(ctx agentiface.Ctx) error {
+			panic("boom")
+		})
+
+		Convey("The panic should be turned into an error", func() {
+			err := handler(ctx)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Panic while processing message '42': boom")
+		})
+	})
+
+	Convey("Given a handler wrapped by the logging middleware", t, func() {
+		logger := &recordingLogger{}
+
+		Convey("A successful processing should be logged as info", func() {
+			err := LoggingMiddleware(logger)(func(ctx agentiface.Ctx) error { return nil })(ctx)
+
+			So(err, ShouldBeNil)
+			So(len(logger.logs), ShouldEqual, 1)
+			So(logger.logs[0], ShouldStartWith, fmt.Sprintf(`info message type="%s" id="42"`, schemaID))
+			So(logger.logs[0], ShouldEndWith, "status=ok")
+		})
+
+		Convey("A failed processing should be logged as a warning", func() {
+			err := LoggingMiddleware(logger)(func(ctx agentiface.Ctx) error { return fmt.Errorf("failure") })(ctx)
+
+			So(err, ShouldNotBeNil)
+			So(len(logger.logs), ShouldEqual, 1)
+			So(logger.logs[0], ShouldStartWith, "warning message")
+			So(logger.logs[0], ShouldEndWith, `status=failed error="failure"`)
+		})
+	})
+}
+
+// tenantCommandCtx is a command context enriched by a middleware.
+type tenantCommandCtx struct {
+	agentiface.CommandCtx
+}
+
+func (ctx tenantCommandCtx) Tenant() string {
+	return "acme"
+}
+
+// tenantEventCtx is an event context enriched by a middleware.
+type tenantEventCtx struct {
+	agentiface.EventCtx
+}
+
+func (ctx tenantEventCtx) Tenant() string {
+	return "acme"
+}
+
+func TestMessagingMiddlewares(t *testing.T) {
+	Convey("Given two agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the receiver uses global and per-registration middlewares", func() {
+			var trace []string
+			done := make(chan []string, 1)
+
+			receiver.Use(tracingMiddleware("global", &trace))
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				trace = append(trace, "callback")
+				return nil
+			}, func(next agentiface.Handler) agentiface.Handler {
+				return func(ctx agentiface.Ctx) error {
+					err := next(ctx)
+					done <- append([]string(nil), trace...)
+					return err
+				}
+			}, tracingMiddleware("local", &trace))
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The global middlewares should wrap the per-registration ones", func() {
+				select {
+				case t := <-done:
+					So(t, ShouldResemble, []string{">global", ">local", "callback", "<local"})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the middlewares wrap the contexts handed to the callbacks", func() {
+			tenants := make(chan string, 2)
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				tenants <- ctx.(tenantCommandCtx).Tenant()
+				return ctx.SendEvent(&person{FirstName: "john", LastName: "doe", Age: 75})
+			}, func(next agentiface.Handler) agentiface.Handler {
+				return func(ctx agentiface.Ctx) error {
+					return next(tenantCommandCtx{ctx.(agentiface.CommandCtx)})
+				}
+			})
+			So(err, ShouldBeNil)
+
+			_, err = sender.RegisterFilteredEventCallback(agentiface.BySenderName("receiver"), func(ctx agentiface.EventCtx) error {
+				tenants <- ctx.(tenantEventCtx).Tenant()
+				return nil
+			}, func(next agentiface.Handler) agentiface.Handler {
+				return func(ctx agentiface.Ctx) error {
+					return next(tenantEventCtx{ctx.(agentiface.EventCtx)})
+				}
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The callbacks should receive the wrapped contexts", func() {
+				for i := 0; i < 2; i++ {
+					select {
+					case tenant := <-tenants:
+						So(tenant, ShouldEqual, "acme")
+					case <-time.After(receiveTimeout):
+						So("message not received", ShouldBeEmpty)
+					}
+				}
+			})
+		})
+
+		Convey("When a callback of the receiver panics", func() {
+			calls := make(chan struct{}, 2)
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				calls <- struct{}{}
+				panic("boom")
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+			So(sender.SendCommand("receiver", &person{FirstName: "jane", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The agent should keep processing messages", func() {
+				for i := 0; i < 2; i++ {
+					select {
+					case <-calls:
+					case <-time.After(receiveTimeout):
+						So("command not received", ShouldBeEmpty)
+					}
+				}
+			})
+		})
+
+		Convey("When the sender uses a publish middleware", func() {
+			received := make(chan agentiface.CommandCtx, 1)
+
+			sender.UsePublish(func(next agentiface.Publisher) agentiface.Publisher {
+				return func(msg interface{}) (*agentiface.Envelope, error) {
+					envelope, err := next(msg)
+					if err == nil {
+						envelope.AppID = "middleware"
+					}
+					return envelope, err
+				}
+			})
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				received <- ctx
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The sent messages should be altered", func() {
+				select {
+				case ctx := <-received:
+					So(ctx.Properties()["AppId"], ShouldEqual, "middleware")
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequest(t *testing.T) {
+	Convey("Given an agent answering the requests of another agent", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", map[string]interface{}{
+			configRequestTimeout: "50ms",
+		})
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			p := ctx.Message().(*person)
+			if p.Age < 0 {
+				// no answer
+				return nil
+			}
+			p.Age++
+			return ctx.SendCommand("", p)
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When several requests are sent concurrently", func() {
+			type result struct {
+				age int
+				err error
+			}
+			results := make(chan result, 5)
+
+			for i := 0; i < 5; i++ {
+				go func(age int) {
+					reply, err := sender.Request(context.Background(), "receiver", &person{FirstName: "john", Age: age})
+					if err != nil {
+						results <- result{err: err}
+						return
+					}
+					results <- result{age: reply.Message().(*person).Age}
+				}(i * 10)
+			}
+
+			Convey("Then each request receives its own reply", func() {
+				ages := make(map[int]bool)
+				for i := 0; i < 5; i++ {
+					r := <-results
+					So(r.err, ShouldBeNil)
+					ages[r.age] = true
+				}
+				So(ages, ShouldResemble, map[int]bool{1: true, 11: true, 21: true, 31: true, 41: true})
+			})
+		})
+
+		Convey("When a request is answered", func() {
+			reply, err := sender.Request(context.Background(), "receiver", &person{FirstName: "john", Age: 1})
+			So(err, ShouldBeNil)
+
+			Convey("Then the reply is correlated to the request", func() {
+				So(reply.Properties()["CorrelationId"], ShouldNotBeEmpty)
+				So(reply.Properties()["ReplyTo"], ShouldEqual, receiver.ID())
+			})
+
+			Convey("Then the request is not pending anymore", func() {
+				sender.Messaging.mutex.RLock()
+				defer sender.Messaging.mutex.RUnlock()
+
+				So(sender.pendingRequests, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a request without deadline is not answered", func() {
+			_, err := sender.Request(context.Background(), "receiver", &person{FirstName: "john", Age: -1})
+
+			Convey("Then it times out after the configured timeout", func() {
+				timeout, ok := err.(*agentiface.RequestTimeoutError)
+				So(ok, ShouldBeTrue)
+				So(timeout.To, ShouldEqual, "receiver")
+				So(timeout.MessageID, ShouldNotBeEmpty)
+				So(timeout.Timeout(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When a request is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			_, err := sender.Request(ctx, "receiver", &person{FirstName: "john", Age: -1})
+
+			Convey("Then the cancellation is returned", func() {
+				So(err, ShouldEqual, context.Canceled)
+			})
+		})
+
+		Convey("When the agent disconnects while waiting for a reply", func() {
+			time.AfterFunc(10*time.Millisecond, func() {
+				sender.Disconnect() // nolint: errcheck
+			})
+
+			_, err := sender.Request(context.Background(), "receiver", &person{FirstName: "john", Age: -1})
+
+			Convey("Then the request fails", func() {
+				So(err, ShouldNotBeNil)
+				So(fmt.Sprint(err), ShouldContainSubstring, "Disconnected")
+			})
+		})
+
+		Convey("When a request is sent with a deadline", func() {
+			envelopes := make(chan *agentiface.Envelope, 1)
+			sender.UsePublish(func(next agentiface.Publisher) agentiface.Publisher {
+				return func(msg interface{}) (*agentiface.Envelope, error) {
+					envelope, err := next(msg)
+					if err == nil {
+						envelopes <- envelope
+					}
+					return envelope, err
+				}
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+			defer cancel()
+
+			_, err := sender.Request(ctx, "receiver", &person{FirstName: "john", Age: 1})
+			So(err, ShouldBeNil)
+
+			Convey("Then the request expires with its deadline", func() {
+				So((<-envelopes).Expiration, ShouldNotBeEmpty)
+			})
+		})
+	})
+}
@@ -30,6 +30,12 @@ type AvroSchema struct {
 	title  string
 	raw    string
 	schema avro.Schema
+
+	// Parsing Canonical Form of the schema
+	canonicalForm string
+
+	// schema the decoded data has been written with, if not this one (see WithWriter)
+	writer avro.Schema
 }
 
 // ID returns the AvroSchema ID.
@@ -52,8 +58,13 @@ func (s *AvroSchema) Raw() string {
 	return s.raw
 }
 
-// Decode unserializes data using the AvroSchema registered.
+// Decode unserializes data using the AvroSchema registered. The data written with another schema (see WithWriter) is
+// resolved into this one.
 func (s *AvroSchema) Decode(o []byte, t agentiface.Type) (interface{}, error) {
+	if s.writer != nil {
+		return decodeResolved(o, s.schema, s.writer, t)
+	}
+
 	// Create a new Decoder with the data
 	decoder := avro.NewBinaryDecoder(o)
 
@@ -95,6 +106,8 @@ func LoadAvroSchema(rawSchema string, registry agentiface.SchemaRegistry) (agent
 		schema, ok := registry.SchemaGetByID(id)
 		if ok == nil && schema.MimeType() == MimeTypeAvroSchema {
 			schemas[schema.ID()] = schema.(*AvroSchema).schema
+			// references to named types are resolved by their full name (with namespace)
+			schemas[avro.GetFullName(schema.(*AvroSchema).schema)] = schema.(*AvroSchema).schema
 		}
 	}
 
@@ -104,15 +117,33 @@ func LoadAvroSchema(rawSchema string, registry agentiface.SchemaRegistry) (agent
 		return nil, err
 	}
 
+	// the aliases of the fields are needed to resolve the data written with other revisions
+	setAvroFieldAliases(rawSchema, avroSchema)
+
 	title := ""
 	if t, ok := avroSchema.Prop("title"); ok {
 		title, _ = t.(string)
 	}
 
 	return &AvroSchema{
-		id:     avroSchema.GetName(),
-		title:  title,
-		raw:    avroSchema.String(),
-		schema: avroSchema,
+		id:            avroSchema.GetName(),
+		title:         title,
+		raw:           avroSchema.String(),
+		schema:        avroSchema,
+		canonicalForm: avroCanonicalForm(avroSchema),
 	}, nil
 }
+
+// LoadAvroSchemaWithID loads the given raw Avro definition as LoadAvroSchema does, but identifies the schema by the
+// given id rather than by the name of its record. The canonical form and the fingerprint of the schema are still those
+// of the record.
+func LoadAvroSchemaWithID(id string, rawSchema string, registry agentiface.SchemaRegistry) (agentiface.Schema, error) {
+	schema, err := LoadAvroSchema(rawSchema, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	schema.(*AvroSchema).id = id
+
+	return schema, nil
+}
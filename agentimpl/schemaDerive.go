@@ -0,0 +1,209 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/crucibuild/sdk-agent-go/util"
+)
+
+// AvroDocumented is implemented by the structs documenting the Avro records derived from them.
+type AvroDocumented interface {
+	// AvroDoc returns the doc of the record.
+	AvroDoc() string
+}
+
+var avroDocumentedType = reflect.TypeOf((*AvroDocumented)(nil)).Elem()
+
+// avroDeriver derives the definition of an Avro schema from Go types.
+type avroDeriver struct {
+	// records already defined in the schema, by name: the following occurrences are references
+	records map[string]reflect.Type
+}
+
+// DeriveAvroSchema derives an Avro schema from a struct (or a pointer to a struct), ready to be registered.
+// The struct becomes a record named after its type, with a field per exported field:
+// - a field is named after its avro tag (`avro:"name"`) or its Go name, the tag "-" ignores it
+// - a field is documented by its doc tag (`doc:"..."`), a record by the AvroDoc method (see AvroDocumented)
+// - pointers become unions with null (defaulting to null), slices arrays and maps with string keys maps
+// - unsigned integers up to 32 bits become ints or longs, wider ones are not supported
+// - pointers to pointers and structs whose fields are all unexported (e.g. time.Time) are not supported
+// - nested structs become nested records, referenced by name when they appear again.
+func DeriveAvroSchema(i interface{}) (*AvroSchema, error) {
+	t, err := util.GetStructType(i)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &avroDeriver{
+		records: make(map[string]reflect.Type),
+	}
+
+	definition, err := d.derive(t)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := LoadAvroSchema(string(raw), NewSchemaRegistry(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.(*AvroSchema), nil
+}
+
+// derive returns the Avro definition of a Go type.
+func (d *avroDeriver) derive(t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "int", nil
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "long", nil
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return nil, fmt.Errorf("Cannot derive an Avro schema from %s: unsigned 64-bit integers do not fit in an Avro long", t)
+	case reflect.Float32:
+		return "float", nil
+	case reflect.Float64:
+		return "double", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Ptr:
+		elem, err := d.derive(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := elem.([]interface{}); ok {
+			// Avro does not allow a union to contain another union
+			return nil, fmt.Errorf("Cannot derive an Avro schema from %s: pointers to pointers are not supported", t)
+		}
+		return []interface{}{"null", elem}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+		items, err := d.derive(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("Cannot derive an Avro schema from %s: map keys must be strings", t)
+		}
+		values, err := d.derive(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "map", "values": values}, nil
+	case reflect.Struct:
+		return d.deriveRecord(t)
+	default:
+		return nil, fmt.Errorf("Cannot derive an Avro schema from %s: unsupported kind %s", t, t.Kind())
+	}
+}
+
+// deriveRecord returns the Avro definition of a struct.
+func (d *avroDeriver) deriveRecord(t reflect.Type) (interface{}, error) {
+	name := t.Name()
+	if name == "" {
+		return nil, fmt.Errorf("Cannot derive an Avro schema from %s: anonymous structs are not supported", t)
+	}
+
+	if defined, ok := d.records[name]; ok {
+		if defined != t {
+			return nil, fmt.Errorf("Cannot derive an Avro schema from %s: record %s is already defined by %s", t, name, defined)
+		}
+		return name, nil
+	}
+	d.records[name] = t
+
+	fields := make([]interface{}, 0, t.NumField())
+	exported := 0
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		exported++
+
+		fieldName := strings.Split(f.Tag.Get("avro"), ",")[0]
+		if fieldName == "-" {
+			continue
+		}
+		if fieldName == "" {
+			fieldName = f.Name
+		}
+
+		fieldType, err := d.derive(f.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		field := map[string]interface{}{
+			"name": fieldName,
+			"type": fieldType,
+		}
+		if doc := f.Tag.Get("doc"); doc != "" {
+			field["doc"] = doc
+		}
+		if f.Type.Kind() == reflect.Ptr {
+			field["default"] = nil
+		}
+
+		fields = append(fields, field)
+	}
+
+	if exported == 0 && t.NumField() > 0 {
+		// e.g. time.Time: its state cannot be encoded
+		return nil, fmt.Errorf("Cannot derive an Avro schema from %s: it has no exported fields", t)
+	}
+
+	record := map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	}
+
+	if doc := avroDoc(t); doc != "" {
+		record["doc"] = doc
+	}
+
+	return record, nil
+}
+
+// avroDoc returns the doc of a struct implementing AvroDocumented, by value or by pointer.
+func avroDoc(t reflect.Type) string {
+	if t.Implements(avroDocumentedType) {
+		return reflect.Zero(t).Interface().(AvroDocumented).AvroDoc()
+	}
+	if reflect.PtrTo(t).Implements(avroDocumentedType) {
+		return reflect.New(t).Interface().(AvroDocumented).AvroDoc()
+	}
+
+	return ""
+}
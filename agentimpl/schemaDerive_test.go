@@ -0,0 +1,202 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type derivedAddress struct {
+	Street string          `avro:"street" doc:"The street and the number."`
+	Next   *derivedAddress `avro:"next"`
+}
+
+type derivedCustomer struct {
+	Name     string            `avro:"name"`
+	Age      int32             `avro:"age"`
+	Address  *derivedAddress   `avro:"address"`
+	Previous []derivedAddress  `avro:"previous"`
+	Tags     map[string]string `avro:"tags"`
+	Avatar   []byte            `avro:"avatar"`
+	Score    float64
+	Ignored  string `avro:"-"`
+	internal string
+}
+
+type derivedCounters struct {
+	Small  uint8  `avro:"small"`
+	Medium uint16 `avro:"medium"`
+	Large  uint32 `avro:"large"`
+}
+
+type derivedPointers struct {
+	Addresses *[]*derivedAddress `avro:"addresses"`
+}
+
+type derivedUint struct {
+	Count uint `avro:"count"`
+}
+
+type derivedUint64 struct {
+	Count uint64 `avro:"count"`
+}
+
+type derivedPointerToPointer struct {
+	Address **derivedAddress `avro:"address"`
+}
+
+type derivedTimestamped struct {
+	At time.Time `avro:"at"`
+}
+
+func (*derivedCustomer) AvroDoc() string {
+	return "A customer of the shop."
+}
+
+func TestDeriveAvroSchema(t *testing.T) {
+	Convey("Given a struct", t, func() {
+		Convey("When an Avro schema is derived from it", func() {
+			schema, err := DeriveAvroSchema(&derivedCustomer{})
+
+			Convey("Then the schema is named after the struct", func() {
+				So(err, ShouldBeNil)
+				So(schema.ID(), ShouldEqual, "derivedCustomer")
+				So(schema.MimeType(), ShouldEqual, MimeTypeAvroSchema)
+			})
+
+			Convey("Then the fields are mapped to Avro", func() {
+				var definition struct {
+					Doc    string
+					Fields []struct {
+						Name    string
+						Type    interface{}
+						Doc     string
+						Default interface{}
+					}
+				}
+				So(json.Unmarshal([]byte(schema.Raw()), &definition), ShouldBeNil)
+
+				So(definition.Doc, ShouldEqual, "A customer of the shop.")
+
+				names := make([]string, len(definition.Fields))
+				for i, f := range definition.Fields {
+					names[i] = f.Name
+				}
+				So(names, ShouldResemble, []string{"name", "age", "address", "previous", "tags", "avatar", "Score"})
+
+				So(definition.Fields[0].Type, ShouldEqual, "string")
+				So(definition.Fields[1].Type, ShouldEqual, "int")
+				So(definition.Fields[2].Type.([]interface{})[0], ShouldEqual, "null")
+				So(definition.Fields[2].Default, ShouldBeNil)
+				So(definition.Fields[3].Type.(map[string]interface{})["type"], ShouldEqual, "array")
+				So(definition.Fields[4].Type.(map[string]interface{})["type"], ShouldEqual, "map")
+				So(definition.Fields[5].Type, ShouldEqual, "bytes")
+				So(definition.Fields[6].Type, ShouldEqual, "double")
+
+				address := definition.Fields[2].Type.([]interface{})[1].(map[string]interface{})
+				So(address["name"], ShouldEqual, "derivedAddress")
+				So(address["fields"].([]interface{})[0].(map[string]interface{})["doc"], ShouldEqual, "The street and the number.")
+			})
+
+			Convey("Then it can be registered and encode the struct", func() {
+				So(err, ShouldBeNil)
+
+				registry := NewSchemaRegistry(nil)
+				_, err := registry.SchemaRegister(schema)
+				So(err, ShouldBeNil)
+
+				customer := &derivedCustomer{
+					Name:     "Bob",
+					Age:      42,
+					Address:  &derivedAddress{Street: "1 Main Street", Next: &derivedAddress{Street: "2 Main Street"}},
+					Previous: []derivedAddress{{Street: "3 Main Street"}},
+					Tags:     map[string]string{"vip": "yes"},
+					Avatar:   []byte{1, 2, 3},
+					Score:    1.5,
+				}
+
+				data, err := schema.Code(customer)
+				So(err, ShouldBeNil)
+
+				typ, err := NewTypeFromInterface(schema.ID(), derivedCustomer{})
+				So(err, ShouldBeNil)
+
+				decoded, err := schema.Decode(data, typ)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, customer)
+			})
+		})
+
+		Convey("When an Avro schema is derived from an unsupported struct", func() {
+			_, errChan := DeriveAvroSchema(struct{ C chan int }{})
+			_, errKey := DeriveAvroSchema(struct{ M map[int]string }{})
+			_, errString := DeriveAvroSchema("not a struct")
+
+			Convey("Then an error is returned", func() {
+				So(errChan, ShouldNotBeNil)
+				So(errKey, ShouldNotBeNil)
+				So(errString, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When an Avro schema is derived from a struct with unsigned integers", func() {
+			schema, err := DeriveAvroSchema(&derivedCounters{})
+
+			Convey("Then the integers up to 32 bits are mapped to Avro", func() {
+				So(err, ShouldBeNil)
+
+				var definition struct {
+					Fields []struct {
+						Type interface{}
+					}
+				}
+				So(json.Unmarshal([]byte(schema.Raw()), &definition), ShouldBeNil)
+				So(definition.Fields[0].Type, ShouldEqual, "int")
+				So(definition.Fields[1].Type, ShouldEqual, "int")
+				So(definition.Fields[2].Type, ShouldEqual, "long")
+			})
+		})
+
+		Convey("When an Avro schema is derived from a struct with a pointer to a slice of pointers", func() {
+			_, err := DeriveAvroSchema(&derivedPointers{})
+
+			Convey("Then the union is not nested", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When an Avro schema is derived from a struct with fields which cannot be mapped to Avro", func() {
+			_, errUint := DeriveAvroSchema(&derivedUint{})
+			_, errUint64 := DeriveAvroSchema(&derivedUint64{})
+			_, errPointer := DeriveAvroSchema(&derivedPointerToPointer{})
+			_, errTime := DeriveAvroSchema(&derivedTimestamped{})
+
+			Convey("Then an error explains why", func() {
+				So(errUint, ShouldNotBeNil)
+				So(errUint.Error(), ShouldContainSubstring, "unsigned 64-bit integers")
+				So(errUint64, ShouldNotBeNil)
+				So(errUint64.Error(), ShouldContainSubstring, "unsigned 64-bit integers")
+				So(errPointer, ShouldNotBeNil)
+				So(errPointer.Error(), ShouldContainSubstring, "pointers to pointers")
+				So(errTime, ShouldNotBeNil)
+				So(errTime.Error(), ShouldContainSubstring, "no exported fields")
+			})
+		})
+	})
+}
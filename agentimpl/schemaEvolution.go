@@ -0,0 +1,677 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/elodina/go-avro"
+)
+
+// CheckSchemaCompatibility checks that the next version of a schema is compatible with the previous one:
+// - backward: the data written with the previous version can be read with the next one
+// - forward: the data written with the next version can be read with the previous one
+// - full: both.
+// The schemas which do not support evolution (see agentiface.EvolvableSchema) are not checked.
+func CheckSchemaCompatibility(previous agentiface.Schema, next agentiface.Schema, compatibility agentiface.Compatibility) error {
+	if compatibility == agentiface.CompatibilityNone {
+		return nil
+	}
+
+	if previous.MimeType() != next.MimeType() {
+		return fmt.Errorf("Cannot change the format of a schema from %s to %s", previous.MimeType(), next.MimeType())
+	}
+
+	p, ok := previous.(agentiface.EvolvableSchema)
+	if !ok {
+		return nil
+	}
+	n, ok := next.(agentiface.EvolvableSchema)
+	if !ok {
+		return nil
+	}
+
+	if compatibility == agentiface.CompatibilityBackward || compatibility == agentiface.CompatibilityFull {
+		if err := n.CanRead(previous); err != nil {
+			return fmt.Errorf("Data written with the previous version cannot be read: %s", err.Error())
+		}
+	}
+
+	if compatibility == agentiface.CompatibilityForward || compatibility == agentiface.CompatibilityFull {
+		if err := p.CanRead(next); err != nil {
+			return fmt.Errorf("Data written with the next version cannot be read by the previous one: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// CanRead returns nil if the data written with the writer schema can be read with this schema according to the
+// Avro schema resolution rules, or an error describing why it cannot.
+func (s *AvroSchema) CanRead(writer agentiface.Schema) error {
+	w, ok := writer.(*AvroSchema)
+	if !ok {
+		return fmt.Errorf("Schema '%s' is not an Avro schema", writer.ID())
+	}
+
+	return checkAvroReadable(s.schema, w.schema, s.id, make(map[string]bool))
+}
+
+// WithWriter returns a schema decoding the data written with the writer schema into the types of this schema.
+func (s *AvroSchema) WithWriter(writer agentiface.Schema) (agentiface.Schema, error) {
+	if err := s.CanRead(writer); err != nil {
+		return nil, err
+	}
+
+	resolving := *s
+	resolving.writer = writer.(*AvroSchema).schema
+
+	return &resolving, nil
+}
+
+// actualAvroSchema returns the record a recursive reference points to, or the schema itself.
+func actualAvroSchema(s avro.Schema) avro.Schema {
+	if r, ok := s.(*avro.RecursiveSchema); ok {
+		return r.Actual
+	}
+
+	return s
+}
+
+// avroNamesMatch returns true if the writer named type can be read as the reader named type: their unqualified names
+// are equal or the writer name is an alias of the reader.
+func avroNamesMatch(reader avro.Schema, writer avro.Schema, aliases []string) bool {
+	if reader.GetName() == writer.GetName() {
+		return true
+	}
+
+	for _, alias := range aliases {
+		if alias == writer.GetName() || alias == avro.GetFullName(writer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// avroPromotable returns true if a value of the writer primitive type can be promoted to the reader primitive type.
+func avroPromotable(reader int, writer int) bool {
+	switch writer {
+	case avro.Int:
+		return reader == avro.Long || reader == avro.Float || reader == avro.Double
+	case avro.Long:
+		return reader == avro.Float || reader == avro.Double
+	case avro.Float:
+		return reader == avro.Double
+	case avro.String:
+		return reader == avro.Bytes
+	case avro.Bytes:
+		return reader == avro.String
+	default:
+		return false
+	}
+}
+
+// avroHasDefault returns true if a field has a default value. A null default cannot be told apart from a missing one,
+// so it is only accepted for the types starting with null.
+func avroHasDefault(field *avro.SchemaField) bool {
+	if field.Default != nil {
+		return true
+	}
+
+	t := actualAvroSchema(field.Type)
+	if t.Type() == avro.Union {
+		types := t.(*avro.UnionSchema).Types
+		return len(types) > 0 && types[0].Type() == avro.Null
+	}
+
+	return t.Type() == avro.Null
+}
+
+// checkAvroReadable checks that the data written with the writer schema can be read with the reader schema. The path
+// locates the checked schemas in the error messages, visited holds the pairs of records being checked.
+func checkAvroReadable(reader avro.Schema, writer avro.Schema, path string, visited map[string]bool) error {
+	reader, writer = actualAvroSchema(reader), actualAvroSchema(writer)
+
+	if writer.Type() == avro.Union {
+		for _, t := range writer.(*avro.UnionSchema).Types {
+			if err := checkAvroReadable(reader, t, path, visited); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if reader.Type() == avro.Union {
+		for _, t := range reader.(*avro.UnionSchema).Types {
+			if checkAvroReadable(t, writer, path, visited) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: no type of the union can read %s", path, writer.GetName())
+	}
+
+	if reader.Type() != writer.Type() {
+		if avroPromotable(reader.Type(), writer.Type()) {
+			return nil
+		}
+		return fmt.Errorf("%s: %s cannot be read as %s", path, writer.GetName(), reader.GetName())
+	}
+
+	switch reader.Type() {
+	case avro.Array:
+		return checkAvroReadable(reader.(*avro.ArraySchema).Items, writer.(*avro.ArraySchema).Items, path+"[]", visited)
+	case avro.Map:
+		return checkAvroReadable(reader.(*avro.MapSchema).Values, writer.(*avro.MapSchema).Values, path+"{}", visited)
+	case avro.Enum:
+		r, w := reader.(*avro.EnumSchema), writer.(*avro.EnumSchema)
+		if !avroNamesMatch(r, w, r.Aliases) {
+			return fmt.Errorf("%s: enum %s cannot be read as %s", path, w.Name, r.Name)
+		}
+		symbols := make(map[string]bool, len(r.Symbols))
+		for _, symbol := range r.Symbols {
+			symbols[symbol] = true
+		}
+		for _, symbol := range w.Symbols {
+			if !symbols[symbol] {
+				return fmt.Errorf("%s: symbol %s of enum %s is unknown", path, symbol, r.Name)
+			}
+		}
+	case avro.Fixed:
+		r, w := reader.(*avro.FixedSchema), writer.(*avro.FixedSchema)
+		if !avroNamesMatch(r, w, nil) || r.Size != w.Size {
+			return fmt.Errorf("%s: fixed %s cannot be read as %s", path, w.Name, r.Name)
+		}
+	case avro.Record:
+		return checkAvroRecordReadable(reader.(*avro.RecordSchema), writer.(*avro.RecordSchema), path, visited)
+	}
+
+	return nil
+}
+
+// checkAvroRecordReadable checks that the records written with the writer schema can be read with the reader schema:
+// the fields of the reader missing from the writer must have a default value.
+func checkAvroRecordReadable(reader *avro.RecordSchema, writer *avro.RecordSchema, path string, visited map[string]bool) error {
+	if !avroNamesMatch(reader, writer, reader.Aliases) {
+		return fmt.Errorf("%s: record %s cannot be read as %s", path, writer.Name, reader.Name)
+	}
+
+	key := avro.GetFullName(reader) + "|" + avro.GetFullName(writer)
+	if visited[key] {
+		// recursive record, being checked
+		return nil
+	}
+	visited[key] = true
+
+	for _, field := range reader.Fields {
+		writerField := avroWriterField(writer, field)
+
+		if writerField == nil {
+			if !avroHasDefault(field) {
+				return fmt.Errorf("%s.%s: field missing from the written data has no default value", path, field.Name)
+			}
+			continue
+		}
+
+		if err := checkAvroReadable(field.Type, writerField.Type, path+"."+field.Name, visited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// avroWriterField returns the field of the writer record read as the given field of the reader, nil if none: the
+// field with the same name, or else the field named after one of the aliases of the reader field.
+func avroWriterField(writer *avro.RecordSchema, field *avro.SchemaField) *avro.SchemaField {
+	for _, f := range writer.Fields {
+		if f.Name == field.Name {
+			return f
+		}
+	}
+
+	aliases, _ := field.Properties[avroFieldAliases].([]string)
+	for _, alias := range aliases {
+		for _, f := range writer.Fields {
+			if f.Name == alias {
+				return f
+			}
+		}
+	}
+
+	return nil
+}
+
+// avroFieldAliases is the property of the parsed fields holding their aliases, which the avro package does not keep
+// (see setAvroFieldAliases).
+const avroFieldAliases = "aliases"
+
+// setAvroFieldAliases sets the aliases of the fields of the records defined by the raw definition of a schema on its
+// parsed fields.
+func setAvroFieldAliases(raw string, s avro.Schema) {
+	var definition interface{}
+	if err := json.Unmarshal([]byte(raw), &definition); err != nil {
+		return
+	}
+
+	// aliases of the fields, by full name of record then by name of field
+	aliases := make(map[string]map[string][]string)
+	collectAvroFieldAliases(definition, "", aliases)
+	if len(aliases) == 0 {
+		return
+	}
+
+	records := make(map[string]*avro.RecordSchema)
+	collectAvroRecords(s, records)
+
+	for name, fields := range aliases {
+		record, ok := records[name]
+		if !ok {
+			continue
+		}
+
+		for _, field := range record.Fields {
+			if a, ok := fields[field.Name]; ok {
+				if field.Properties == nil {
+					field.Properties = make(map[string]interface{})
+				}
+				field.Properties[avroFieldAliases] = a
+			}
+		}
+	}
+}
+
+// collectAvroFieldAliases collects the aliases of the fields of the records defined in a raw Avro definition.
+func collectAvroFieldAliases(v interface{}, namespace string, aliases map[string]map[string][]string) {
+	switch x := v.(type) {
+	case []interface{}:
+		for _, t := range x {
+			collectAvroFieldAliases(t, namespace, aliases)
+		}
+	case map[string]interface{}:
+		if ns, ok := x["namespace"].(string); ok {
+			namespace = ns
+		}
+
+		name, _ := x["name"].(string)
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			namespace = name[:i]
+		} else if namespace != "" && name != "" {
+			name = namespace + "." + name
+		}
+
+		fields, _ := x["fields"].([]interface{})
+		for _, f := range fields {
+			field, ok := f.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			fieldName, _ := field["name"].(string)
+			if a, ok := field["aliases"].([]interface{}); ok && name != "" {
+				if aliases[name] == nil {
+					aliases[name] = make(map[string][]string)
+				}
+				for _, alias := range a {
+					if str, ok := alias.(string); ok {
+						aliases[name][fieldName] = append(aliases[name][fieldName], str)
+					}
+				}
+			}
+
+			collectAvroFieldAliases(field["type"], namespace, aliases)
+		}
+
+		collectAvroFieldAliases(x["type"], namespace, aliases)
+		collectAvroFieldAliases(x["items"], namespace, aliases)
+		collectAvroFieldAliases(x["values"], namespace, aliases)
+	}
+}
+
+// collectAvroRecords collects the records of a parsed schema by full name.
+func collectAvroRecords(s avro.Schema, records map[string]*avro.RecordSchema) {
+	switch x := actualAvroSchema(s).(type) {
+	case *avro.RecordSchema:
+		name := avro.GetFullName(x)
+		if _, ok := records[name]; ok {
+			return
+		}
+		records[name] = x
+
+		for _, field := range x.Fields {
+			collectAvroRecords(field.Type, records)
+		}
+	case *avro.ArraySchema:
+		collectAvroRecords(x.Items, records)
+	case *avro.MapSchema:
+		collectAvroRecords(x.Values, records)
+	case *avro.UnionSchema:
+		for _, t := range x.Types {
+			collectAvroRecords(t, records)
+		}
+	}
+}
+
+// decodeResolved decodes the data written with the writer schema into a record of the type t, according to the
+// reader schema: the data is read into generic values matching the reader schema, which are then decoded as usual.
+func decodeResolved(o []byte, reader avro.Schema, writer avro.Schema, t agentiface.Type) (interface{}, error) {
+	value, err := readResolved(reader, writer, avro.NewBinaryDecoder(o))
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := avro.NewGenericDatumWriter().SetSchema(reader).Write(value, avro.NewBinaryEncoder(buffer)); err != nil {
+		return nil, err
+	}
+
+	return (&AvroSchema{schema: reader}).Decode(buffer.Bytes(), t)
+}
+
+// readResolved reads a value written with the writer schema and returns it as a generic value of the reader schema.
+func readResolved(reader avro.Schema, writer avro.Schema, dec avro.Decoder) (interface{}, error) {
+	reader, writer = actualAvroSchema(reader), actualAvroSchema(writer)
+
+	if writer.Type() == avro.Union {
+		i, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		types := writer.(*avro.UnionSchema).Types
+		if i < 0 || int(i) >= len(types) {
+			return nil, fmt.Errorf("Invalid union index %d", i)
+		}
+		return readResolved(reader, types[i], dec)
+	}
+
+	if reader.Type() == avro.Union {
+		for _, t := range reader.(*avro.UnionSchema).Types {
+			if checkAvroReadable(t, writer, "", make(map[string]bool)) == nil {
+				return readResolved(t, writer, dec)
+			}
+		}
+		return nil, fmt.Errorf("No type of the union can read %s", writer.GetName())
+	}
+
+	switch writer.Type() {
+	case avro.Null:
+		return nil, nil
+	case avro.Boolean:
+		return dec.ReadBoolean()
+	case avro.Int:
+		v, err := dec.ReadInt()
+		return promoteAvroValue(v, reader.Type()), err
+	case avro.Long:
+		v, err := dec.ReadLong()
+		return promoteAvroValue(v, reader.Type()), err
+	case avro.Float:
+		v, err := dec.ReadFloat()
+		return promoteAvroValue(v, reader.Type()), err
+	case avro.Double:
+		return dec.ReadDouble()
+	case avro.Bytes:
+		v, err := dec.ReadBytes()
+		return promoteAvroValue(v, reader.Type()), err
+	case avro.String:
+		v, err := dec.ReadString()
+		return promoteAvroValue(v, reader.Type()), err
+	case avro.Enum:
+		i, err := dec.ReadEnum()
+		if err != nil {
+			return nil, err
+		}
+		symbols := writer.(*avro.EnumSchema).Symbols
+		if i < 0 || int(i) >= len(symbols) {
+			return nil, fmt.Errorf("Invalid enum index %d", i)
+		}
+		return newAvroEnum(reader.(*avro.EnumSchema), symbols[i])
+	case avro.Fixed:
+		v := make([]byte, writer.(*avro.FixedSchema).Size)
+		return v, dec.ReadFixed(v)
+	case avro.Array:
+		var values []interface{}
+		n, err := dec.ReadArrayStart()
+		for ; n != 0 && err == nil; n, err = dec.ArrayNext() {
+			for j := int64(0); j < n; j++ {
+				v, err := readResolved(reader.(*avro.ArraySchema).Items, writer.(*avro.ArraySchema).Items, dec)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		}
+		return values, err
+	case avro.Map:
+		values := make(map[string]interface{})
+		n, err := dec.ReadMapStart()
+		for ; n != 0 && err == nil; n, err = dec.MapNext() {
+			for j := int64(0); j < n; j++ {
+				k, err := dec.ReadString()
+				if err != nil {
+					return nil, err
+				}
+				v, err := readResolved(reader.(*avro.MapSchema).Values, writer.(*avro.MapSchema).Values, dec)
+				if err != nil {
+					return nil, err
+				}
+				values[k] = v
+			}
+		}
+		return values, err
+	case avro.Record:
+		return readResolvedRecord(reader.(*avro.RecordSchema), writer.(*avro.RecordSchema), dec)
+	default:
+		return nil, fmt.Errorf("Unsupported Avro type %s", writer.GetName())
+	}
+}
+
+// readResolvedRecord reads a record written with the writer schema: the fields unknown to the reader are skipped and
+// the fields missing from the writer get their default value.
+func readResolvedRecord(reader *avro.RecordSchema, writer *avro.RecordSchema, dec avro.Decoder) (interface{}, error) {
+	record := avro.NewGenericRecord(reader)
+	read := make(map[string]bool, len(reader.Fields))
+
+	for _, writerField := range writer.Fields {
+		var field *avro.SchemaField
+		for _, f := range reader.Fields {
+			if avroWriterField(writer, f) == writerField {
+				field = f
+				break
+			}
+		}
+
+		if field == nil {
+			// skipped
+			if _, err := readResolved(writerField.Type, writerField.Type, dec); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		v, err := readResolved(field.Type, writerField.Type, dec)
+		if err != nil {
+			return nil, err
+		}
+		record.Set(field.Name, v)
+		read[field.Name] = true
+	}
+
+	for _, field := range reader.Fields {
+		if read[field.Name] {
+			continue
+		}
+
+		v, err := avroDefaultValue(field.Type, field.Default)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid default value of field %s: %s", field.Name, err.Error())
+		}
+		record.Set(field.Name, v)
+	}
+
+	return record, nil
+}
+
+// promoteAvroValue converts a primitive value to the reader primitive type.
+func promoteAvroValue(v interface{}, reader int) interface{} {
+	switch x := v.(type) {
+	case int32:
+		switch reader {
+		case avro.Long:
+			return int64(x)
+		case avro.Float:
+			return float32(x)
+		case avro.Double:
+			return float64(x)
+		}
+	case int64:
+		switch reader {
+		case avro.Float:
+			return float32(x)
+		case avro.Double:
+			return float64(x)
+		}
+	case float32:
+		if reader == avro.Double {
+			return float64(x)
+		}
+	case string:
+		if reader == avro.Bytes {
+			// a string promoted to bytes is read as its UTF-8 encoding (unlike the default values of bytes)
+			return []byte(x)
+		}
+	case []byte:
+		if reader == avro.String {
+			return string(x)
+		}
+	}
+
+	return v
+}
+
+// avroDefaultBytes converts the default value of a bytes or fixed field into bytes: each character of the JSON string
+// is a byte, its code point ranging from 0 to 255 (ISO-8859-1).
+func avroDefaultBytes(str string) ([]byte, error) {
+	b := make([]byte, 0, len(str))
+
+	for _, r := range str {
+		if r > 0xff {
+			return nil, fmt.Errorf("Invalid character %q in a default value of bytes", r)
+		}
+		b = append(b, byte(r))
+	}
+
+	return b, nil
+}
+
+// newAvroEnum returns a generic enum of the reader schema set to a symbol.
+func newAvroEnum(reader *avro.EnumSchema, symbol string) (*avro.GenericEnum, error) {
+	for _, s := range reader.Symbols {
+		if s == symbol {
+			enum := avro.NewGenericEnum(reader.Symbols)
+			enum.Set(symbol)
+			return enum, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown symbol %s of enum %s", symbol, reader.Name)
+}
+
+// avroDefaultValue converts the default value of a field, as parsed from JSON, into a generic value of its schema.
+func avroDefaultValue(s avro.Schema, v interface{}) (interface{}, error) {
+	s = actualAvroSchema(s)
+
+	switch s.Type() {
+	case avro.Union:
+		// the default value of a union is of its first type
+		return avroDefaultValue(s.(*avro.UnionSchema).Types[0], v)
+	case avro.Null:
+		return nil, nil
+	case avro.Boolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case avro.Int, avro.Long, avro.Float, avro.Double:
+		if f, ok := v.(float64); ok {
+			switch s.Type() {
+			case avro.Int:
+				return int32(f), nil
+			case avro.Long:
+				return int64(f), nil
+			case avro.Float:
+				return float32(f), nil
+			default:
+				return f, nil
+			}
+		}
+	case avro.String:
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+	case avro.Bytes, avro.Fixed:
+		if str, ok := v.(string); ok {
+			return avroDefaultBytes(str)
+		}
+	case avro.Enum:
+		if str, ok := v.(string); ok {
+			return newAvroEnum(s.(*avro.EnumSchema), str)
+		}
+	case avro.Array:
+		if items, ok := v.([]interface{}); ok {
+			values := make([]interface{}, len(items))
+			for i, item := range items {
+				value, err := avroDefaultValue(s.(*avro.ArraySchema).Items, item)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = value
+			}
+			return values, nil
+		}
+	case avro.Map:
+		if items, ok := v.(map[string]interface{}); ok {
+			values := make(map[string]interface{}, len(items))
+			for k, item := range items {
+				value, err := avroDefaultValue(s.(*avro.MapSchema).Values, item)
+				if err != nil {
+					return nil, err
+				}
+				values[k] = value
+			}
+			return values, nil
+		}
+	case avro.Record:
+		if fields, ok := v.(map[string]interface{}); ok {
+			record := avro.NewGenericRecord(s)
+			for _, field := range s.(*avro.RecordSchema).Fields {
+				fieldValue, ok := fields[field.Name]
+				if !ok {
+					fieldValue = field.Default
+				}
+				value, err := avroDefaultValue(field.Type, fieldValue)
+				if err != nil {
+					return nil, err
+				}
+				record.Set(field.Name, value)
+			}
+			return record, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%v is not a valid %s", v, s.GetName())
+}
@@ -0,0 +1,410 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// versions of the schema of a customer
+const (
+	customerSchemaV1 = `{
+		"type": "record",
+		"name": "Customer",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "int"},
+			{"name": "nickname", "type": ["null", "string"], "default": null}
+		]
+	}`
+	// the age is promoted to long, an email with a default value is added, the nickname is removed
+	customerSchemaV2 = `{
+		"type": "record",
+		"name": "Customer",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "long"},
+			{"name": "email", "type": "string", "default": "unknown"}
+		]
+	}`
+	// a field without default value is added
+	customerSchemaV3 = `{
+		"type": "record",
+		"name": "Customer",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "long"},
+			{"name": "email", "type": "string", "default": "unknown"},
+			{"name": "vip", "type": "boolean"}
+		]
+	}`
+)
+
+// the name is renamed, bytes with a default value are added
+const customerSchemaRenamed = `{
+	"type": "record",
+	"name": "Customer",
+	"fields": [
+		{"name": "fullName", "type": "string", "aliases": ["name"]},
+		{"name": "age", "type": "int"},
+		{"name": "avatar", "type": "bytes", "default": "\u00e9\u00ff"}
+	]
+}`
+
+type customerRenamed struct {
+	FullName string `avro:"fullName"`
+	Age      int32  `avro:"age"`
+	Avatar   []byte `avro:"avatar"`
+}
+
+type customerV1 struct {
+	Name     string  `avro:"name"`
+	Age      int32   `avro:"age"`
+	Nickname *string `avro:"nickname"`
+}
+
+type customerV2 struct {
+	Name  string `avro:"name"`
+	Age   int64  `avro:"age"`
+	Email string `avro:"email"`
+}
+
+// loadCustomerSchema loads a version of the schema of a customer, or any schema not referencing other schemas.
+func loadCustomerSchema(raw string) agentiface.Schema {
+	schema, err := LoadAvroSchema(raw, NewSchemaRegistry(nil))
+	So(err, ShouldBeNil)
+
+	return schema
+}
+
+// customerType returns the type of a customer given a version of its struct.
+func customerType(i interface{}) agentiface.Type {
+	t, err := NewTypeFromInterface("Customer", i)
+	So(err, ShouldBeNil)
+
+	return t
+}
+
+func TestCheckSchemaCompatibility(t *testing.T) {
+	Convey("Given versions of a schema", t, func() {
+		v1 := loadCustomerSchema(customerSchemaV1)
+		v2 := loadCustomerSchema(customerSchemaV2)
+		v3 := loadCustomerSchema(customerSchemaV3)
+
+		Convey("A version adding fields with default values and promoting types should be backward compatible", func() {
+			So(CheckSchemaCompatibility(v1, v2, agentiface.CompatibilityBackward), ShouldBeNil)
+		})
+
+		Convey("A version whose types cannot be read by the previous one should not be forward compatible", func() {
+			So(CheckSchemaCompatibility(v1, v2, agentiface.CompatibilityForward), ShouldNotBeNil)
+			So(CheckSchemaCompatibility(v1, v2, agentiface.CompatibilityFull), ShouldNotBeNil)
+		})
+
+		Convey("A version adding a field without default value should not be backward compatible", func() {
+			err := CheckSchemaCompatibility(v2, v3, agentiface.CompatibilityBackward)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Customer.vip")
+		})
+
+		Convey("A version removing a field should be forward compatible", func() {
+			So(CheckSchemaCompatibility(v2, v3, agentiface.CompatibilityForward), ShouldBeNil)
+		})
+
+		Convey("No compatibility should always be satisfied", func() {
+			So(CheckSchemaCompatibility(v2, v3, agentiface.CompatibilityNone), ShouldBeNil)
+		})
+
+		Convey("A version changing the format should not be compatible", func() {
+			json, err := LoadJSONSchema(personSchema)
+			So(err, ShouldBeNil)
+
+			So(CheckSchemaCompatibility(json, v1, agentiface.CompatibilityBackward), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSchemaVersions(t *testing.T) {
+	Convey("Given a registry holding the version 1 of a schema", t, func() {
+		registry := NewSchemaRegistry(nil)
+
+		_, err := registry.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+
+		Convey("When a compatible version 2 is registered", func() {
+			_, err := registry.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV2), 2)
+
+			Convey("Then both versions are registered and the latest one is the default", func() {
+				So(err, ShouldBeNil)
+				So(registry.SchemaVersions("Customer"), ShouldResemble, []int{1, 2})
+
+				latest, err := registry.SchemaGetByID("Customer")
+				So(err, ShouldBeNil)
+				So(latest.Raw(), ShouldEqual, loadCustomerSchema(customerSchemaV2).Raw())
+
+				v1, err := registry.SchemaGetVersion("Customer", 1)
+				So(err, ShouldBeNil)
+				So(v1.Raw(), ShouldEqual, loadCustomerSchema(customerSchemaV1).Raw())
+
+				_, err = registry.SchemaGetVersion("Customer", 3)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then an incompatible version 3 is refused", func() {
+				_, err := registry.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV3), 3)
+
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrIncompatibleSchema)
+				So(registry.SchemaVersions("Customer"), ShouldResemble, []int{1, 2})
+			})
+
+			Convey("Then another schema with the same version is refused", func() {
+				_, err := registry.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV3), 2)
+
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrAlreadyRegistered)
+			})
+
+			Convey("Then the schema is unregistered with all its versions", func() {
+				So(registry.SchemaUnregister("Customer"), ShouldBeNil)
+				So(registry.SchemaVersions("Customer"), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When an invalid version is registered", func() {
+			_, err := registry.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV2), 0)
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given an agent requiring no compatibility between versions", t, func() {
+		broker := NewLoopbackBroker()
+		agent := newDisconnectedTestAgent(broker, "agent", map[string]interface{}{configSchemaCompatibility: "none"})
+
+		_, err := agent.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+		So(err, ShouldBeNil)
+
+		Convey("An incompatible version should be registered", func() {
+			_, err := agent.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV3), 2)
+
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestSchemaResolution(t *testing.T) {
+	Convey("Given data written with the version 1 of a schema", t, func() {
+		v1 := loadCustomerSchema(customerSchemaV1)
+		v2 := loadCustomerSchema(customerSchemaV2)
+
+		nickname := "johnny"
+		data, err := v1.Code(&customerV1{Name: "john", Age: 42, Nickname: &nickname})
+		So(err, ShouldBeNil)
+
+		Convey("When it is decoded with the version 2 resolving the version 1", func() {
+			resolving, err := v2.(agentiface.EvolvableSchema).WithWriter(v1)
+			So(err, ShouldBeNil)
+
+			decoded, err := resolving.Decode(data, customerType(customerV2{}))
+
+			Convey("Then the data is projected into the version 2", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "unknown"})
+			})
+		})
+
+		Convey("When it is decoded with a version renaming a field with an alias and adding bytes", func() {
+			renamed := loadCustomerSchema(customerSchemaRenamed)
+
+			So(CheckSchemaCompatibility(v1, renamed, agentiface.CompatibilityBackward), ShouldBeNil)
+
+			resolving, err := renamed.(agentiface.EvolvableSchema).WithWriter(v1)
+			So(err, ShouldBeNil)
+
+			decoded, err := resolving.Decode(data, customerType(customerRenamed{}))
+
+			Convey("Then the renamed field is read from the aliased one and the bytes get their default", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, &customerRenamed{FullName: "john", Age: 42, Avatar: []byte{0xe9, 0xff}})
+			})
+		})
+
+		Convey("When a version which cannot read it resolves the version 1", func() {
+			_, err := v1.(agentiface.EvolvableSchema).WithWriter(loadCustomerSchema(customerSchemaV3))
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a sender knowing the version 1 of a schema and a receiver knowing the version 2", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := sender.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = sender.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		_, err = receiver.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = receiver.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV2), 2)
+		So(err, ShouldBeNil)
+		_, err = receiver.TypeRegister(customerType(customerV2{}))
+		So(err, ShouldBeNil)
+
+		Convey("When the sender sends a command to the receiver", func() {
+			customers := make(chan interface{}, 1)
+
+			_, err := receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+				customers <- ctx.Message()
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+
+			Convey("Then the receiver decodes it with the version 2", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "unknown"})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestSchemaVersionHeader(t *testing.T) {
+	Convey("Given a sender knowing the version 2 of a schema as its first version", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		_, err := sender.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+		So(err, ShouldBeNil)
+		_, err = sender.TypeRegister(customerType(customerV2{}))
+		So(err, ShouldBeNil)
+
+		_, err = receiver.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = receiver.SchemaRegisterVersion(loadCustomerSchema(customerSchemaV2), 2)
+		So(err, ShouldBeNil)
+		_, err = receiver.TypeRegister(customerType(customerV2{}))
+		So(err, ShouldBeNil)
+
+		Convey("When it sends a command without fingerprint to a receiver knowing it as its version 2", func() {
+			customers := make(chan interface{}, 1)
+
+			_, err := receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+				customers <- ctx.Message()
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			sender.UsePublish(func(next agentiface.Publisher) agentiface.Publisher {
+				return func(msg interface{}) (*agentiface.Envelope, error) {
+					envelope, err := next(msg)
+					if err == nil {
+						delete(envelope.Headers, agentiface.AmqpHeaderSchemaFingerprint)
+					}
+					return envelope, err
+				}
+			})
+
+			So(sender.SendCommand("receiver", &customerV2{Name: "john", Age: 42, Email: "john@doe.com"}), ShouldBeNil)
+
+			Convey("Then the version number of the sender is ignored", func() {
+				select {
+				case customer := <-customers:
+					So(customer, ShouldResemble, &customerV2{Name: "john", Age: 42, Email: "john@doe.com"})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestAvroDefaultBytes(t *testing.T) {
+	Convey("Given the default value of a bytes field", t, func() {
+		Convey("Each character should be a byte", func() {
+			b, err := avroDefaultBytes("a\u00e9\u00ff")
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte{'a', 0xe9, 0xff})
+		})
+
+		Convey("A character beyond ISO-8859-1 should be refused", func() {
+			_, err := avroDefaultBytes("\u20ac")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCmdSchemaCheck(t *testing.T) {
+	Convey("Given an agent knowing a schema and files holding its next versions", t, func() {
+		dir, err := ioutil.TempDir("", "schemas")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck, temporary directory
+
+		files := map[string]string{"v1.avsc": customerSchemaV1, "v2.avsc": customerSchemaV2, "v3.avsc": customerSchemaV3}
+		for name, content := range files {
+			So(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), ShouldBeNil)
+		}
+
+		agent := newDisconnectedTestAgent(NewLoopbackBroker(), "agent", nil)
+
+		_, err = agent.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+
+		check := func(args ...string) error {
+			agent.RootCommand().SetArgs(append([]string{"schema:check"}, args...))
+			return agent.RootCommand().Execute()
+		}
+
+		Convey("A compatible version should be accepted against the registered one", func() {
+			So(check(filepath.Join(dir, "v2.avsc")), ShouldBeNil)
+		})
+
+		Convey("A version should be checked at the requested level", func() {
+			So(check("--compatibility", "forward", filepath.Join(dir, "v2.avsc")), ShouldNotBeNil)
+		})
+
+		Convey("An incompatible version should be refused against the given previous one", func() {
+			So(check(filepath.Join(dir, "v3.avsc"), filepath.Join(dir, "v2.avsc")), ShouldNotBeNil)
+		})
+	})
+}
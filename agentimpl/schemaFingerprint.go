@@ -0,0 +1,165 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/elodina/go-avro"
+)
+
+// crc64AvroEmpty is the fingerprint of the empty string with CRC-64-AVRO.
+const crc64AvroEmpty uint64 = 0xc15d213aa4d7a795
+
+// crc64AvroTable is the lookup table of CRC-64-AVRO.
+var crc64AvroTable = func() [256]uint64 {
+	var table [256]uint64
+
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (crc64AvroEmpty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+
+	return table
+}()
+
+// crc64Avro returns the CRC-64-AVRO (Rabin) fingerprint of data, as defined by the Avro specification.
+func crc64Avro(data []byte) uint64 {
+	fp := crc64AvroEmpty
+
+	for _, b := range data {
+		fp = (fp >> 8) ^ crc64AvroTable[byte(fp)^b]
+	}
+
+	return fp
+}
+
+// CanonicalForm returns the Parsing Canonical Form of the schema: the schema stripped from everything which does
+// not change the way data is read (docs, aliases, defaults, etc...), with full names, without whitespaces and with
+// its attributes in a fixed order. Two schemas reading data the same way have the same canonical form.
+func (s *AvroSchema) CanonicalForm() string {
+	return s.canonicalForm
+}
+
+// Fingerprint64 returns the CRC-64-AVRO fingerprint of the canonical form of the schema.
+func (s *AvroSchema) Fingerprint64() uint64 {
+	return crc64Avro([]byte(s.canonicalForm))
+}
+
+// FingerprintSHA256 returns the SHA-256 fingerprint of the canonical form of the schema.
+func (s *AvroSchema) FingerprintSHA256() [sha256.Size]byte {
+	return sha256.Sum256([]byte(s.canonicalForm))
+}
+
+// Fingerprint returns the fingerprint identifying the exact revision of the schema: the SHA-256 fingerprint of its
+// canonical form, in hexadecimal.
+func (s *AvroSchema) Fingerprint() string {
+	fingerprint := s.FingerprintSHA256()
+
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// avroCanonicalForm returns the Parsing Canonical Form of a schema.
+func avroCanonicalForm(s avro.Schema) string {
+	var b bytes.Buffer
+
+	writeAvroCanonicalForm(&b, s, make(map[string]bool))
+
+	return b.String()
+}
+
+// writeAvroCanonicalForm writes the Parsing Canonical Form of a schema. The named types already defined are written
+// as a reference to their full name.
+func writeAvroCanonicalForm(b *bytes.Buffer, s avro.Schema, defined map[string]bool) {
+	switch s.Type() {
+	case avro.Recursive, avro.Record, avro.Enum, avro.Fixed:
+		name := avro.GetFullName(s)
+		if defined[name] {
+			writeJSONString(b, name)
+			return
+		}
+		defined[name] = true
+
+		b.WriteString(`{"name":`)
+		writeJSONString(b, name)
+
+		switch r := actualAvroSchema(s).(type) {
+		case *avro.RecordSchema:
+			b.WriteString(`,"type":"record","fields":[`)
+			for i, field := range r.Fields {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				b.WriteString(`{"name":`)
+				writeJSONString(b, field.Name)
+				b.WriteString(`,"type":`)
+				writeAvroCanonicalForm(b, field.Type, defined)
+				b.WriteString("}")
+			}
+			b.WriteString("]")
+		case *avro.EnumSchema:
+			b.WriteString(`,"type":"enum","symbols":[`)
+			for i, symbol := range r.Symbols {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				writeJSONString(b, symbol)
+			}
+			b.WriteString("]")
+		case *avro.FixedSchema:
+			b.WriteString(`,"type":"fixed","size":`)
+			b.WriteString(strconv.Itoa(r.Size))
+		}
+
+		b.WriteString("}")
+	case avro.Array:
+		b.WriteString(`{"type":"array","items":`)
+		writeAvroCanonicalForm(b, s.(*avro.ArraySchema).Items, defined)
+		b.WriteString("}")
+	case avro.Map:
+		b.WriteString(`{"type":"map","values":`)
+		writeAvroCanonicalForm(b, s.(*avro.MapSchema).Values, defined)
+		b.WriteString("}")
+	case avro.Union:
+		b.WriteString("[")
+		for i, t := range s.(*avro.UnionSchema).Types {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			writeAvroCanonicalForm(b, t, defined)
+		}
+		b.WriteString("]")
+	default:
+		// primitive
+		writeJSONString(b, s.GetName())
+	}
+}
+
+// writeJSONString writes a JSON string literal, without escaping the characters which do not need to be.
+func writeJSONString(b *bytes.Buffer, s string) {
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s) // nolint: errcheck, a string is always encoded
+
+	// the encoder terminates the value with a newline
+	b.Truncate(b.Len() - 1)
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const orderSchema = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "shop",
+	"doc": "An order",
+	"fields": [
+		{"name": "id", "type": {"type": "string"}, "doc": "The id of the order"},
+		{"name": "billing", "type": {"type": "record", "name": "Address", "fields": [{"name": "street", "type": "string"}]}},
+		{"name": "shipping", "type": ["null", "Address"], "default": null},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "DONE"]}},
+		{"name": "hash", "type": {"type": "fixed", "name": "Hash", "size": 4}},
+		{"name": "tags", "type": {"type": "map", "values": {"type": "array", "items": "long"}}}
+	]
+}`
+
+const orderCanonicalForm = `{"name":"shop.Order","type":"record","fields":[` +
+	`{"name":"id","type":"string"},` +
+	`{"name":"billing","type":{"name":"shop.Address","type":"record","fields":[{"name":"street","type":"string"}]}},` +
+	`{"name":"shipping","type":["null","shop.Address"]},` +
+	`{"name":"status","type":{"name":"shop.Status","type":"enum","symbols":["NEW","DONE"]}},` +
+	`{"name":"hash","type":{"name":"shop.Hash","type":"fixed","size":4}},` +
+	`{"name":"tags","type":{"type":"map","values":{"type":"array","items":"long"}}}]}`
+
+func TestFingerprint(t *testing.T) {
+	Convey("Given the test vectors of the Avro specification", t, func() {
+		Convey("The CRC-64-AVRO fingerprints should match", func() {
+			So(int64(crc64Avro([]byte(`"null"`))), ShouldEqual, int64(7195948357588979594))
+			So(int64(crc64Avro([]byte(`"int"`))), ShouldEqual, int64(8247732601305521295))
+		})
+	})
+
+	Convey("Given an Avro schema", t, func() {
+		schema := loadCustomerSchema(orderSchema).(*AvroSchema)
+
+		Convey("Its canonical form should be stripped, use full names and define named types once", func() {
+			So(schema.CanonicalForm(), ShouldEqual, orderCanonicalForm)
+		})
+
+		Convey("Its fingerprints should be computed from its canonical form", func() {
+			So(schema.Fingerprint64(), ShouldEqual, crc64Avro([]byte(orderCanonicalForm)))
+			So(schema.Fingerprint(), ShouldHaveLength, 64)
+		})
+
+		Convey("A revision only changing its docs should have the same fingerprint", func() {
+			undocumented := loadCustomerSchema(`{
+				"type": "record", "name": "Customer",
+				"fields": [
+					{"name": "name", "type": "string"},
+					{"name": "age", "type": "int"},
+					{"name": "nickname", "type": ["null", "string"]}
+				]
+			}`).(*AvroSchema)
+
+			So(undocumented.Fingerprint(), ShouldEqual, loadCustomerSchema(customerSchemaV1).(*AvroSchema).Fingerprint())
+			So(undocumented.Fingerprint(), ShouldNotEqual, loadCustomerSchema(customerSchemaV2).(*AvroSchema).Fingerprint())
+		})
+
+		Convey("Loaded with another id, it should keep the canonical form and the fingerprint of its record", func() {
+			identified, err := LoadAvroSchemaWithID("order:placed", orderSchema, NewSchemaRegistry(nil))
+			So(err, ShouldBeNil)
+
+			So(identified.ID(), ShouldEqual, "order:placed")
+			So(identified.(*AvroSchema).CanonicalForm(), ShouldEqual, orderCanonicalForm)
+			So(identified.(*AvroSchema).Fingerprint(), ShouldEqual, schema.Fingerprint())
+		})
+	})
+}
+
+func TestSchemaFingerprintOnTheWire(t *testing.T) {
+	Convey("Given a sender knowing the version 1 of a schema and a receiver only knowing the version 2", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+			configAckMode:          ackModeManual,
+			configRetryMaxAttempts: 0,
+		})
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		// observes the dead-letter exchange
+		observer := broker.NewTransport()
+		So(observer.Connect(nil), ShouldBeNil)
+
+		deadLetters := make(chan *agentiface.Envelope, 1)
+		_, err := observer.Subscribe(agentiface.Subscription{
+			Destination: agentiface.DestinationDeadLetter,
+			Exclusive:   true,
+			Filters:     []map[string]interface{}{{}},
+		}, func(e *agentiface.Envelope) {
+			deadLetters <- e
+		})
+		So(err, ShouldBeNil)
+
+		_, err = sender.SchemaRegister(loadCustomerSchema(customerSchemaV1))
+		So(err, ShouldBeNil)
+		_, err = sender.TypeRegister(customerType(customerV1{}))
+		So(err, ShouldBeNil)
+
+		_, err = receiver.SchemaRegister(loadCustomerSchema(customerSchemaV2))
+		So(err, ShouldBeNil)
+		_, err = receiver.TypeRegister(customerType(customerV2{}))
+		So(err, ShouldBeNil)
+
+		_, err = receiver.RegisterCommandCallback("Customer", func(ctx agentiface.CommandCtx) error {
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the sender sends a command to the receiver", func() {
+			So(sender.SendCommand("receiver", &customerV1{Name: "john", Age: 42}), ShouldBeNil)
+
+			Convey("Then the command is refused because its revision of the schema is unknown", func() {
+				select {
+				case e := <-deadLetters:
+					v1 := loadCustomerSchema(customerSchemaV1).(*AvroSchema)
+					So(e.Headers[agentiface.AmqpHeaderSchemaFingerprint], ShouldEqual, v1.Fingerprint())
+					So(e.Headers[agentiface.AmqpHeaderError], ShouldContainSubstring, agentiface.ErrUnknownSchemaRevision.Error())
+				case <-time.After(receiveTimeout):
+					So("command not dead-lettered", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
@@ -26,12 +26,16 @@ const MimeTypeJSONSchema = "application/schema+json"
 
 const jsonID = "id"
 const jsonTitle = "title"
+const jsonRequired = "required"
 
 // JSONSchema represents a JSON Schema with all its metadata.
 type JSONSchema struct {
 	id    string
 	title string
 	raw   string
+
+	// properties required in the objects described by the schema
+	required []string
 }
 
 // ID returns the JSONSchema ID.
@@ -70,6 +74,23 @@ func (s *JSONSchema) Code(o interface{}) ([]byte, error) {
 	return json.Marshal(o)
 }
 
+// checkRequired checks that the JSON object holds the properties required by the schema.
+func (s *JSONSchema) checkRequired(o []byte) error {
+	var object map[string]json.RawMessage
+
+	if err := json.Unmarshal(o, &object); err != nil {
+		return err
+	}
+
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("Property %s is missing", name)
+		}
+	}
+
+	return nil
+}
+
 // LoadJSONSchema loads the given Json Schema and returns a schema instance
 func LoadJSONSchema(rawSchema string) (agentiface.Schema, error) {
 	// The given json schema is a json, so load it
@@ -96,9 +117,19 @@ func LoadJSONSchema(rawSchema string) (agentiface.Schema, error) {
 		return nil, fmt.Errorf("id (key: %s) value must be a JSON string in schema", jsonID)
 	}
 
+	var required []string
+	if properties, ok := schema[jsonRequired].([]interface{}); ok {
+		for _, property := range properties {
+			if name, ok := property.(string); ok {
+				required = append(required, name)
+			}
+		}
+	}
+
 	return &JSONSchema{
-		id:    id.(string),
-		title: schema[jsonTitle].(string),
-		raw:   rawSchema,
+		id:       id.(string),
+		title:    schema[jsonTitle].(string),
+		raw:      rawSchema,
+		required: required,
 	}, nil
 }
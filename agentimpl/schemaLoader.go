@@ -0,0 +1,335 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+)
+
+// extensions of the schema files, by format
+const (
+	extensionAvroSchema = ".avsc"
+	extensionJSONSchema = ".json"
+)
+
+// SchemaLoadError is the error returned by the bulk loaders of schemas. It holds the error of each file which could
+// not be loaded.
+type SchemaLoadError struct {
+	// Errors holds the error of each file, by file name.
+	Errors map[string]error
+}
+
+// Error returns the description of the error.
+func (e *SchemaLoadError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("%s: %s", name, e.Errors[name].Error())
+	}
+
+	return fmt.Sprintf("Failed to load %d schema file(s): %s", len(names), strings.Join(messages, "; "))
+}
+
+// schemaFile is a file holding a schema.
+type schemaFile struct {
+	name    string
+	content string
+
+	// Avro named types defined and referenced by the schema
+	defines    []string
+	references []string
+}
+
+// LoadSchemasFromDir loads the schemas found in a directory and its sub-directories, and registers them.
+// See loadSchemas for the details.
+func LoadSchemasFromDir(dir string, registry agentiface.SchemaRegistry) ([]agentiface.Schema, error) {
+	var files []*schemaFile
+	failures := make(map[string]error)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !isSchemaFile(p) {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			failures[name] = err
+			return nil
+		}
+
+		files = append(files, &schemaFile{name: name, content: string(content)})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read schema directory '%s'", dir)
+	}
+
+	return loadSchemas(files, failures, registry)
+}
+
+// LoadSchemaFile loads the schema held by a file without registering it. Its format is detected by the extension of
+// the file, the registry resolves the named types referenced by an Avro schema.
+func LoadSchemaFile(file string, registry agentiface.SchemaRegistry) (agentiface.Schema, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case extensionAvroSchema:
+		return LoadAvroSchema(string(content), registry)
+	case extensionJSONSchema:
+		return LoadJSONSchema(string(content))
+	default:
+		return nil, fmt.Errorf("Unknown format of schema file '%s'", file)
+	}
+}
+
+// isSchemaFile returns true if the name of a file has the extension of a schema format.
+func isSchemaFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case extensionAvroSchema, extensionJSONSchema:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadSchemas loads the schemas held by files and registers them:
+// - the format of a schema is detected by the extension of its file: Avro (.avsc) or JSON schema (.json)
+// - an Avro schema is loaded after the schemas defining the named types it references, whatever the order of the
+// files
+// - a schema which cannot be loaded does not prevent the others from being loaded
+// The registered schemas are returned in their loading order, with a *SchemaLoadError holding the failures (if any).
+func loadSchemas(files []*schemaFile, failures map[string]error, registry agentiface.SchemaRegistry) ([]agentiface.Schema, error) {
+	var schemas []agentiface.Schema
+
+	load := func(f *schemaFile) {
+		var schema agentiface.Schema
+		var err error
+
+		if strings.ToLower(path.Ext(f.name)) == extensionAvroSchema {
+			schema, err = LoadAvroSchema(f.content, registry)
+		} else {
+			schema, err = LoadJSONSchema(f.content)
+		}
+
+		if err == nil {
+			_, err = registry.SchemaRegister(schema)
+		}
+
+		if err != nil {
+			failures[f.name] = err
+			return
+		}
+
+		schemas = append(schemas, schema)
+	}
+
+	var avroFiles []*schemaFile
+
+	for _, f := range files {
+		if strings.ToLower(path.Ext(f.name)) != extensionAvroSchema {
+			load(f)
+			continue
+		}
+
+		if err := f.parseAvroNames(); err != nil {
+			failures[f.name] = err
+			continue
+		}
+
+		avroFiles = append(avroFiles, f)
+	}
+
+	sorted, cyclic := sortAvroSchemaFiles(avroFiles)
+
+	for _, f := range sorted {
+		load(f)
+	}
+
+	for _, f := range cyclic {
+		failures[f.name] = fmt.Errorf("Cyclic dependency between Avro schemas")
+	}
+
+	if len(failures) > 0 {
+		return schemas, &SchemaLoadError{Errors: failures}
+	}
+
+	return schemas, nil
+}
+
+// sortAvroSchemaFiles sorts Avro schema files so that each file comes after the files defining the named types it
+// references. The files which could not be sorted because of a cyclic dependency are returned apart.
+func sortAvroSchemaFiles(files []*schemaFile) (sorted []*schemaFile, cyclic []*schemaFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+
+	// files defining the named types, by full and by short name
+	definedBy := make(map[string]*schemaFile)
+	for _, f := range files {
+		for _, name := range f.defines {
+			if _, ok := definedBy[name]; !ok {
+				definedBy[name] = f
+			}
+
+			short := name[strings.LastIndex(name, ".")+1:]
+			if _, ok := definedBy[short]; !ok {
+				definedBy[short] = f
+			}
+		}
+	}
+
+	dependents := make(map[*schemaFile][]*schemaFile)
+	pending := make(map[*schemaFile]int)
+
+	for _, f := range files {
+		dependencies := make(map[*schemaFile]bool)
+
+		for _, name := range f.references {
+			dependency, ok := definedBy[name]
+			if !ok {
+				dependency, ok = definedBy[name[strings.LastIndex(name, ".")+1:]]
+			}
+
+			if ok && dependency != f && !dependencies[dependency] {
+				dependencies[dependency] = true
+				dependents[dependency] = append(dependents[dependency], f)
+			}
+		}
+
+		pending[f] = len(dependencies)
+	}
+
+	// Kahn's algorithm, the files being taken in name order when possible
+	var ready []*schemaFile
+	for _, f := range files {
+		if pending[f] == 0 {
+			ready = append(ready, f)
+		}
+	}
+
+	for len(ready) > 0 {
+		f := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, f)
+
+		for _, dependent := range dependents[f] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for _, f := range files {
+		if pending[f] > 0 {
+			cyclic = append(cyclic, f)
+		}
+	}
+
+	return sorted, cyclic
+}
+
+// avroPrimitiveTypes are the Avro types which are not named types.
+var avroPrimitiveTypes = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true,
+	"string": true, "record": true, "error": true, "enum": true, "fixed": true, "array": true, "map": true,
+}
+
+// parseAvroNames reads the full names of the Avro named types defined and referenced by the schema of the file.
+func (f *schemaFile) parseAvroNames() error {
+	var definition interface{}
+
+	if err := json.Unmarshal([]byte(f.content), &definition); err != nil {
+		return err
+	}
+
+	f.collectAvroNames(definition, "")
+
+	return nil
+}
+
+func (f *schemaFile) collectAvroNames(definition interface{}, namespace string) {
+	switch d := definition.(type) {
+	case string:
+		if !avroPrimitiveTypes[d] {
+			f.references = append(f.references, avroFullName(d, namespace))
+		}
+	case []interface{}:
+		for _, t := range d {
+			f.collectAvroNames(t, namespace)
+		}
+	case map[string]interface{}:
+		switch d["type"] {
+		case "record", "error", "enum", "fixed":
+			name, _ := d["name"].(string)
+			if ns, ok := d["namespace"].(string); ok {
+				namespace = ns
+			}
+			f.defines = append(f.defines, avroFullName(name, namespace))
+
+			fields, _ := d["fields"].([]interface{})
+			for _, field := range fields {
+				if field, ok := field.(map[string]interface{}); ok {
+					f.collectAvroNames(field["type"], namespace)
+				}
+			}
+		case "array":
+			f.collectAvroNames(d["items"], namespace)
+		case "map":
+			f.collectAvroNames(d["values"], namespace)
+		default:
+			f.collectAvroNames(d["type"], namespace)
+		}
+	}
+}
+
+// avroFullName returns the full name of an Avro named type given the enclosing namespace.
+func avroFullName(name string, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+
+	return namespace + "." + name
+}
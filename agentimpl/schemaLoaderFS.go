@@ -0,0 +1,58 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.16
+// +build go1.16
+
+package agentimpl
+
+import (
+	"io/fs"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+)
+
+// LoadSchemasFromFS loads the schemas found in a file system (an embedded one for instance), and registers them.
+// See loadSchemas for the details.
+func LoadSchemasFromFS(fsys fs.FS, registry agentiface.SchemaRegistry) ([]agentiface.Schema, error) {
+	var files []*schemaFile
+	failures := make(map[string]error)
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !isSchemaFile(name) {
+			return nil
+		}
+
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			failures[name] = err
+			return nil
+		}
+
+		files = append(files, &schemaFile{name: name, content: string(content)})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read schema file system")
+	}
+
+	return loadSchemas(files, failures, registry)
+}
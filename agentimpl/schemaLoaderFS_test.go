@@ -0,0 +1,44 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.16
+// +build go1.16
+
+package agentimpl
+
+import (
+	"testing"
+	"testing/fstest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadSchemasFromFS(t *testing.T) {
+	Convey("Given a file system holding schema files", t, func() {
+		fsys := fstest.MapFS{}
+		for name, content := range schemaFiles {
+			fsys["schemas/"+name] = &fstest.MapFile{Data: []byte(content)}
+		}
+		registry := NewSchemaRegistry(nil)
+
+		Convey("When the schemas are loaded", func() {
+			schemas, err := LoadSchemasFromFS(fsys, registry)
+
+			Convey("They should be loaded after their dependencies and registered", func() {
+				So(err, ShouldBeNil)
+				So(schemaIDs(schemas), ShouldResemble, []string{schemaID, "Address", "Customer", "Order"})
+			})
+		})
+	})
+}
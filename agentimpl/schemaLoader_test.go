@@ -0,0 +1,130 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// schemaFiles are schema files whose names do not follow the order of their dependencies.
+var schemaFiles = map[string]string{
+	"a_order.avsc": `{
+		"type": "record",
+		"name": "Order",
+		"namespace": "shop",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "customer", "type": "Customer"}
+		]
+	}`,
+	"z_customer.avsc": `{
+		"type": "record",
+		"name": "Customer",
+		"namespace": "shop",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "address", "type": ["null", "shop.Address"]}
+		]
+	}`,
+	"common/address.avsc": `{
+		"type": "record",
+		"name": "Address",
+		"namespace": "shop",
+		"fields": [
+			{"name": "street", "type": "string"},
+			{"name": "next", "type": ["null", "Address"]}
+		]
+	}`,
+	"person.json": personSchema,
+	"README.md":   "not a schema",
+}
+
+// brokenSchemaFiles are schema files which cannot be loaded.
+var brokenSchemaFiles = map[string]string{
+	"broken.avsc":  `{"type": "record",`,
+	"cycle_1.avsc": `{"type": "record", "name": "Chicken", "fields": [{"name": "egg", "type": "Egg"}]}`,
+	"cycle_2.avsc": `{"type": "record", "name": "Egg", "fields": [{"name": "chicken", "type": "Chicken"}]}`,
+	"broken.json":  `[`,
+}
+
+// schemaIDs returns the ids of schemas.
+func schemaIDs(schemas []agentiface.Schema) []string {
+	ids := make([]string, len(schemas))
+	for i, schema := range schemas {
+		ids[i] = schema.ID()
+	}
+	return ids
+}
+
+func TestLoadSchemasFromDir(t *testing.T) {
+	Convey("Given a directory holding schema files", t, func() {
+		dir, err := ioutil.TempDir("", "schemas")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir) // nolint: errcheck
+		})
+
+		write := func(files map[string]string) {
+			for name, content := range files {
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				So(os.MkdirAll(filepath.Dir(p), 0755), ShouldBeNil)
+				So(ioutil.WriteFile(p, []byte(content), 0644), ShouldBeNil)
+			}
+		}
+
+		write(schemaFiles)
+		registry := NewSchemaRegistry(nil)
+
+		Convey("When the schemas are loaded", func() {
+			schemas, err := LoadSchemasFromDir(dir, registry)
+
+			Convey("They should be loaded after their dependencies and registered", func() {
+				So(err, ShouldBeNil)
+				So(schemaIDs(schemas), ShouldResemble, []string{schemaID, "Address", "Customer", "Order"})
+
+				for _, id := range []string{schemaID, "Address", "Customer", "Order"} {
+					So(registry.SchemaExist(id), ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("When some schemas cannot be loaded", func() {
+			write(brokenSchemaFiles)
+
+			schemas, err := LoadSchemasFromDir(dir, registry)
+
+			Convey("All the failures should be reported and the other schemas should be loaded", func() {
+				So(err, ShouldHaveSameTypeAs, &SchemaLoadError{})
+
+				failures := err.(*SchemaLoadError).Errors
+				So(len(failures), ShouldEqual, 4)
+				for name := range brokenSchemaFiles {
+					So(failures[name], ShouldNotBeNil)
+				}
+				So(err.Error(), ShouldContainSubstring, "cycle_1.avsc: Cyclic dependency")
+
+				So(len(schemas), ShouldEqual, 4)
+				So(registry.SchemaExist("Order"), ShouldBeTrue)
+			})
+		})
+	})
+}
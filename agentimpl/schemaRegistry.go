@@ -17,41 +17,238 @@ package agentimpl
 import (
 	"fmt"
 	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
 )
 
-// SchemaRegistry represents a registry for schemas.
+// configSchemaCompatibility is the configuration key of the compatibility level required between the versions of a
+// schema (none, backward, forward or full).
+const configSchemaCompatibility = "schema.compatibility"
+
+// SchemaRegistry represents a registry for schemas. It is safe for concurrent use.
 type SchemaRegistry struct {
-	schemas map[string]agentiface.Schema
+	agent   agentiface.Agent
+	mutex   sync.RWMutex
+	schemas map[string]*schemaVersions
+}
+
+// schemaVersions holds the registered versions of a schema.
+type schemaVersions struct {
+	versions map[int]agentiface.Schema
+	latest   int
+}
+
+// sorted returns the versions in ascending order.
+func (v *schemaVersions) sorted() []int {
+	versions := make([]int, 0, len(v.versions))
+	for version := range v.versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	return versions
 }
 
-// NewSchemaRegistry creates a new instance of SchemaRegistry.
-// nolint: unparam, parameter a is reserved for a future usage
+// NewSchemaRegistry creates a new instance of SchemaRegistry. The compatibility level between the versions of a
+// schema is read from the configuration of the agent; without agent, backward compatibility is required.
 func NewSchemaRegistry(a agentiface.Agent) *SchemaRegistry {
+	if a != nil {
+		a.SetDefaultConfigOption(configSchemaCompatibility, agentiface.CompatibilityBackward.String())
+	}
+
 	return &SchemaRegistry{
-		schemas: make(map[string]agentiface.Schema),
+		agent:   a,
+		schemas: make(map[string]*schemaVersions),
+	}
+}
+
+// compatibility returns the compatibility level required between the versions of a schema.
+func (s *SchemaRegistry) compatibility() (agentiface.Compatibility, error) {
+	if s.agent == nil {
+		return agentiface.CompatibilityBackward, nil
 	}
+
+	return agentiface.ParseCompatibility(s.agent.GetConfigString(configSchemaCompatibility))
 }
 
-// SchemaRegister registers a schema in the registry.
+// SchemaRegister registers a schema in the registry as its version 1, unless another schema is registered with the
+// same id.
 func (s *SchemaRegistry) SchemaRegister(schema agentiface.Schema) (string, error) {
-	s.schemas[schema.ID()] = schema
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if registered, ok := s.schemas[schema.ID()]; ok {
+		if registered.versions[registered.latest].Raw() == schema.Raw() {
+			return schema.ID(), nil
+		}
+
+		return "", errors.Wrapf(agentiface.ErrAlreadyRegistered, "Schema '%s'", schema.ID())
+	}
+
+	s.schemas[schema.ID()] = &schemaVersions{
+		versions: map[int]agentiface.Schema{1: schema},
+		latest:   1,
+	}
+
+	return schema.ID(), nil
+}
+
+// SchemaReplace registers a schema in the registry, replacing the latest version of the schema registered with the
+// same id if any.
+func (s *SchemaRegistry) SchemaReplace(schema agentiface.Schema) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if registered, ok := s.schemas[schema.ID()]; ok {
+		registered.versions[registered.latest] = schema
+		return schema.ID(), nil
+	}
+
+	s.schemas[schema.ID()] = &schemaVersions{
+		versions: map[int]agentiface.Schema{1: schema},
+		latest:   1,
+	}
+
+	return schema.ID(), nil
+}
+
+// SchemaRegisterVersion registers a version of a schema in the registry. The version is checked against the closest
+// registered versions (the previous one and the next one) with the compatibility level of the registry.
+func (s *SchemaRegistry) SchemaRegisterVersion(schema agentiface.Schema, version int) (string, error) {
+	if version < 1 {
+		return "", fmt.Errorf("Invalid version %d of schema '%s': versions start at 1", version, schema.ID())
+	}
+
+	compatibility, err := s.compatibility()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	registered, ok := s.schemas[schema.ID()]
+	if !ok {
+		s.schemas[schema.ID()] = &schemaVersions{
+			versions: map[int]agentiface.Schema{version: schema},
+			latest:   version,
+		}
+		return schema.ID(), nil
+	}
+
+	if existing, ok := registered.versions[version]; ok {
+		if existing.Raw() == schema.Raw() {
+			return schema.ID(), nil
+		}
+
+		return "", errors.Wrapf(agentiface.ErrAlreadyRegistered, "Schema '%s' version %d", schema.ID(), version)
+	}
+
+	previous, next := 0, 0
+	for _, v := range registered.sorted() {
+		if v < version {
+			previous = v
+		} else if next == 0 {
+			next = v
+		}
+	}
+
+	if previous != 0 {
+		if err := CheckSchemaCompatibility(registered.versions[previous], schema, compatibility); err != nil {
+			return "", errors.Wrapf(agentiface.ErrIncompatibleSchema, "Schema '%s' version %d is not %s compatible with version %d: %s", schema.ID(), version, compatibility, previous, err.Error())
+		}
+	}
+
+	if next != 0 {
+		if err := CheckSchemaCompatibility(schema, registered.versions[next], compatibility); err != nil {
+			return "", errors.Wrapf(agentiface.ErrIncompatibleSchema, "Schema '%s' version %d is not %s compatible with version %d: %s", schema.ID(), next, compatibility, version, err.Error())
+		}
+	}
+
+	registered.versions[version] = schema
+	if version > registered.latest {
+		registered.latest = version
+	}
 
 	return schema.ID(), nil
 }
 
-// SchemaGetByID returns a schema which id matches the one in parameter.
+// SchemaCheckCompatibility checks that the next version of a schema is compatible with the previous one (see
+// CheckSchemaCompatibility).
+func (s *SchemaRegistry) SchemaCheckCompatibility(previous agentiface.Schema, next agentiface.Schema, compatibility agentiface.Compatibility) error {
+	return CheckSchemaCompatibility(previous, next, compatibility)
+}
+
+// SchemaGetByID returns the latest version of the schema which id matches the one in parameter.
 func (s *SchemaRegistry) SchemaGetByID(id string) (agentiface.Schema, error) {
-	schema, ok := s.schemas[id]
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	registered, ok := s.schemas[id]
+
+	if !ok {
+		return nil, fmt.Errorf("No schema found in the registry with id '%s'", id)
+	}
+
+	return registered.versions[registered.latest], nil
+}
+
+// SchemaGetVersion returns a version of the schema which id matches the one in parameter.
+func (s *SchemaRegistry) SchemaGetVersion(id string, version int) (agentiface.Schema, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	registered, ok := s.schemas[id]
 
 	if !ok {
 		return nil, fmt.Errorf("No schema found in the registry with id '%s'", id)
 	}
 
+	schema, ok := registered.versions[version]
+
+	if !ok {
+		return nil, fmt.Errorf("No version %d of schema '%s' found in the registry", version, id)
+	}
+
 	return schema, nil
 }
 
+// SchemaGetByFingerprint returns the schema, whatever its version, which fingerprint matches the one in parameter.
+func (s *SchemaRegistry) SchemaGetByFingerprint(fingerprint string) (agentiface.Schema, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, registered := range s.schemas {
+		for _, schema := range registered.versions {
+			if f, ok := schema.(agentiface.FingerprintedSchema); ok && f.Fingerprint() == fingerprint {
+				return schema, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("No schema found in the registry with fingerprint '%s'", fingerprint)
+}
+
+// SchemaVersions returns the registered versions of a schema, in ascending order.
+func (s *SchemaRegistry) SchemaVersions(id string) []int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	registered, ok := s.schemas[id]
+
+	if !ok {
+		return nil
+	}
+
+	return registered.sorted()
+}
+
 // SchemaListIds returns a map of <id, schema> known by the registry.
 func (s *SchemaRegistry) SchemaListIds() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	values := make([]string, len(s.schemas))
 
 	i := 0
@@ -65,7 +262,10 @@ func (s *SchemaRegistry) SchemaListIds() []string {
 
 // SchemaUnregister remove a schema from the registry.
 func (s *SchemaRegistry) SchemaUnregister(id string) error {
-	if !s.SchemaExist(id) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.schemas[id]; !ok {
 		return fmt.Errorf("No schema found in the registry with id '%s'", id)
 	}
 
@@ -76,6 +276,9 @@ func (s *SchemaRegistry) SchemaUnregister(id string) error {
 
 // SchemaExist returns true if the key match a schema known by the registry.
 func (s *SchemaRegistry) SchemaExist(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	_, ok := s.schemas[key]
 
 	return ok
@@ -0,0 +1,136 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// rawSchema is a schema only made of an id and a definition.
+type rawSchema struct {
+	id  string
+	raw string
+}
+
+func (s *rawSchema) ID() string {
+	return s.id
+}
+
+func (s *rawSchema) Title() string {
+	return s.id
+}
+
+func (s *rawSchema) MimeType() string {
+	return agentiface.MimeTypeAvro
+}
+
+func (s *rawSchema) Raw() string {
+	return s.raw
+}
+
+func (s *rawSchema) Decode(o []byte, t agentiface.Type) (interface{}, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *rawSchema) Code(o interface{}) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	Convey("Given a registry containing the schema 'foo'", t, func() {
+		var agent agentiface.Agent // not used
+		registry := NewSchemaRegistry(agent)
+		foo := &rawSchema{id: "foo", raw: `{"type": "string"}`}
+
+		_, err := registry.SchemaRegister(foo)
+		So(err, ShouldBeNil)
+
+		Convey("When the same schema is registered again", func() {
+			_, err := registry.SchemaRegister(&rawSchema{id: "foo", raw: `{"type": "string"}`})
+
+			Convey("No error should occur", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When another schema is registered with the same id", func() {
+			_, err := registry.SchemaRegister(&rawSchema{id: "foo", raw: `{"type": "int"}`})
+
+			Convey("A conflict error should occur and the registered schema should be kept", func() {
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrAlreadyRegistered)
+
+				schema, err := registry.SchemaGetByID("foo")
+				So(err, ShouldBeNil)
+				So(schema, ShouldEqual, foo)
+			})
+		})
+
+		Convey("When the schema is replaced", func() {
+			replacement := &rawSchema{id: "foo", raw: `{"type": "int"}`}
+			_, err := registry.SchemaReplace(replacement)
+
+			Convey("The replacement should be registered", func() {
+				So(err, ShouldBeNil)
+
+				schema, err := registry.SchemaGetByID("foo")
+				So(err, ShouldBeNil)
+				So(schema, ShouldEqual, replacement)
+			})
+		})
+	})
+
+	Convey("Given a registry used concurrently", t, func() {
+		var agent agentiface.Agent // not used
+		registry := NewSchemaRegistry(agent)
+
+		const goroutines = 8
+		registered := make(chan string, goroutines)
+		var wg sync.WaitGroup
+
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				schema := &rawSchema{id: "foo", raw: fmt.Sprintf(`{"type": "string", "doc": "%d"}`, i)}
+				if _, err := registry.SchemaRegister(schema); err == nil {
+					registered <- schema.raw
+				}
+
+				for j := 0; j < 100; j++ {
+					registry.SchemaGetByID("foo") // nolint: errcheck
+					registry.SchemaExist("foo")
+					registry.SchemaListIds()
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(registered)
+
+		Convey("Exactly one of the conflicting schemas should be registered", func() {
+			So(len(registered), ShouldEqual, 1)
+
+			schema, err := registry.SchemaGetByID("foo")
+			So(err, ShouldBeNil)
+			So(schema.Raw(), ShouldEqual, <-registered)
+		})
+	})
+}
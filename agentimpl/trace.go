@@ -0,0 +1,193 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+)
+
+// WithSpanExporter makes the agent export the spans of the messages it sends and processes.
+func WithSpanExporter(exporter agentiface.SpanExporter) Option {
+	return func(agent *Agent) error {
+		agent.spanExporter = exporter
+		return nil
+	}
+}
+
+// newTraceID returns a random trace id (16 bytes in hexadecimal).
+func newTraceID() string {
+	return randomHex(16)
+}
+
+// newSpanID returns a random span id (8 bytes in hexadecimal).
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// formatTraceParent formats a trace context in the W3C traceparent format (version 00, sampled).
+func formatTraceParent(traceID string, spanID string) string {
+	return fmt.Sprintf("00-%s-%s-01", traceID, spanID)
+}
+
+// parseTraceParent extracts the trace id and the span id of a W3C traceparent header.
+func parseTraceParent(traceParent string) (traceID string, spanID string, ok bool) {
+	parts := strings.Split(traceParent, "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+
+	traceID, spanID = parts[1], parts[2]
+
+	if !isHexID(traceID, 32) || !isHexID(spanID, 16) {
+		return "", "", false
+	}
+
+	return traceID, spanID, true
+}
+
+// isHexID checks an id is made of n lowercase hexadecimal digits, not all zero.
+func isHexID(id string, n int) bool {
+	if len(id) != n || strings.Trim(id, "0") == "" {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerString returns the value of a string header, or an empty string.
+func headerString(headers map[string]interface{}, key string) string {
+	s, _ := headers[key].(string)
+	return s
+}
+
+// trace writes the trace context of a message to send in its headers. The trace is continued from the message
+// being processed (parent), if any, otherwise a new trace is started.
+func (m *Messaging) trace(parent *Ctx, e *agentiface.Envelope) {
+	span := &agentiface.Span{
+		TraceID:       newTraceID(),
+		SpanID:        newSpanID(),
+		Kind:          agentiface.SpanKindPublish,
+		Name:          e.Type,
+		Agent:         m.agent.ID(),
+		MessageID:     e.MessageID,
+		CorrelationID: e.CorrelationID,
+		Start:         e.Timestamp,
+	}
+
+	if parent != nil {
+		span.TraceID = parent.traceID
+		span.ParentSpanID = parent.spanID
+		span.CausationID = parent.envelope.MessageID
+
+		e.Headers[agentiface.AmqpHeaderCausationID] = span.CausationID
+	}
+
+	e.Headers[agentiface.AmqpHeaderTraceParent] = formatTraceParent(span.TraceID, span.SpanID)
+
+	m.export(span)
+}
+
+// export hands a span to the exporter of the agent, if any.
+func (m *Messaging) export(span *agentiface.Span) {
+	if m.agent.spanExporter == nil {
+		return
+	}
+
+	if err := m.agent.spanExporter.ExportSpan(span); err != nil {
+		m.agent.Warning("Failed to export span: %s", err.Error())
+	}
+}
+
+// JSONFileExporter is a SpanExporter appending the spans to a file, one JSON object per line,
+// for offline analysis.
+type JSONFileExporter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewJSONFileExporter creates an exporter appending the spans to the file at the given path.
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileExporter{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// ExportSpan appends a span to the file.
+func (e *JSONFileExporter) ExportSpan(span *agentiface.Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.encoder.Encode(span)
+}
+
+// Close closes the file.
+func (e *JSONFileExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.file.Close()
+}
+
+// processSpan returns the span of the processing of a received message, started now.
+func (m *Messaging) processSpan(ctx *Ctx) *agentiface.Span {
+	_, parentSpanID, _ := parseTraceParent(headerString(ctx.envelope.Headers, agentiface.AmqpHeaderTraceParent))
+
+	return &agentiface.Span{
+		TraceID:       ctx.traceID,
+		SpanID:        ctx.spanID,
+		ParentSpanID:  parentSpanID,
+		Kind:          agentiface.SpanKindProcess,
+		Name:          ctx.envelope.Type,
+		Agent:         m.agent.ID(),
+		MessageID:     ctx.envelope.MessageID,
+		CorrelationID: ctx.envelope.CorrelationID,
+		CausationID:   headerString(ctx.envelope.Headers, agentiface.AmqpHeaderCausationID),
+		Start:         time.Now(),
+	}
+}
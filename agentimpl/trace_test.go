@@ -0,0 +1,231 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordingExporter is an exporter keeping the exported spans.
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*agentiface.Span
+}
+
+func (e *recordingExporter) ExportSpan(span *agentiface.Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// find returns the span of the given kind and message, waiting for it to be exported.
+func (e *recordingExporter) find(kind agentiface.SpanKind, messageID string) *agentiface.Span {
+	deadline := time.Now().Add(receiveTimeout)
+
+	for time.Now().Before(deadline) {
+		e.mutex.Lock()
+		for _, span := range e.spans {
+			if span.Kind == kind && span.MessageID == messageID {
+				e.mutex.Unlock()
+				return span
+			}
+		}
+		e.mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return nil
+}
+
+func TestTraceParent(t *testing.T) {
+	Convey("Given traceparent headers", t, func() {
+		valid := formatTraceParent("4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7")
+
+		Convey("A valid header should be parsed", func() {
+			traceID, spanID, ok := parseTraceParent(valid)
+
+			So(valid, ShouldEqual, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			So(ok, ShouldBeTrue)
+			So(traceID, ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(spanID, ShouldEqual, "00f067aa0ba902b7")
+		})
+
+		Convey("Invalid headers should be rejected", func() {
+			for _, header := range []string{
+				"",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+				"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+				"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+			} {
+				_, _, ok := parseTraceParent(header)
+				So(ok, ShouldBeFalse)
+			}
+		})
+
+		Convey("Generated ids should be valid", func() {
+			_, _, ok := parseTraceParent(formatTraceParent(newTraceID(), newSpanID()))
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestJSONFileExporter(t *testing.T) {
+	Convey("Given a JSON file exporter", t, func() {
+		dir, err := ioutil.TempDir("", "spans")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir) // nolint: errcheck
+		})
+
+		path := filepath.Join(dir, "spans.json")
+		exporter, err := NewJSONFileExporter(path)
+		So(err, ShouldBeNil)
+
+		Convey("When two spans are exported", func() {
+			So(exporter.ExportSpan(&agentiface.Span{TraceID: "t", SpanID: "s1", Kind: agentiface.SpanKindPublish}), ShouldBeNil)
+			So(exporter.ExportSpan(&agentiface.Span{TraceID: "t", SpanID: "s2", ParentSpanID: "s1", Kind: agentiface.SpanKindProcess}), ShouldBeNil)
+			So(exporter.Close(), ShouldBeNil)
+
+			Convey("The file should contain one JSON span per line", func() {
+				file, err := os.Open(path)
+				So(err, ShouldBeNil)
+				defer file.Close() // nolint: errcheck
+
+				var spans []agentiface.Span
+				scanner := bufio.NewScanner(file)
+				for scanner.Scan() {
+					var span agentiface.Span
+					So(json.Unmarshal(scanner.Bytes(), &span), ShouldBeNil)
+					spans = append(spans, span)
+				}
+
+				So(len(spans), ShouldEqual, 2)
+				So(spans[1].SpanID, ShouldEqual, "s2")
+				So(spans[1].ParentSpanID, ShouldEqual, "s1")
+				So(spans[1].Kind, ShouldEqual, agentiface.SpanKindProcess)
+			})
+		})
+	})
+}
+
+func TestTracePropagation(t *testing.T) {
+	Convey("Given two agents exporting their spans", t, func() {
+		broker := NewLoopbackBroker()
+		exporter := &recordingExporter{}
+		sender := newTestAgent(broker, "sender", nil, WithSpanExporter(exporter))
+		receiver := newTestAgent(broker, "receiver", nil, WithSpanExporter(exporter))
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		commands := make(chan agentiface.CommandCtx, 1)
+		events := make(chan agentiface.EventCtx, 1)
+
+		_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+			commands <- ctx
+			return ctx.SendEvent(ctx.Message())
+		})
+		So(err, ShouldBeNil)
+
+		_, err = sender.RegisterEventCallback(agentiface.EventFilter{"type": schemaID}, func(ctx agentiface.EventCtx) error {
+			events <- ctx
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the sender sends a command answered by an event", func() {
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			var command agentiface.CommandCtx
+			var event agentiface.EventCtx
+
+			select {
+			case command = <-commands:
+			case <-time.After(receiveTimeout):
+			}
+			select {
+			case event = <-events:
+			case <-time.After(receiveTimeout):
+			}
+
+			So(command, ShouldNotBeNil)
+			So(event, ShouldNotBeNil)
+
+			commandID := command.Properties()["MessageId"]
+			eventID := event.Properties()["MessageId"]
+
+			Convey("The event should be caused by the command", func() {
+				So(command.Properties()["CausationId"], ShouldBeEmpty)
+				So(event.Properties()["CausationId"], ShouldEqual, commandID)
+				So(event.Properties()["CorrelationId"], ShouldEqual, commandID)
+			})
+
+			Convey("The event should continue the trace of the command", func() {
+				commandTraceID, _, ok := parseTraceParent(command.Properties()["TraceParent"])
+				So(ok, ShouldBeTrue)
+
+				eventTraceID, _, ok := parseTraceParent(event.Properties()["TraceParent"])
+				So(ok, ShouldBeTrue)
+
+				So(eventTraceID, ShouldEqual, commandTraceID)
+			})
+
+			Convey("The exported spans should form a chain", func() {
+				publishCommand := exporter.find(agentiface.SpanKindPublish, commandID)
+				processCommand := exporter.find(agentiface.SpanKindProcess, commandID)
+				publishEvent := exporter.find(agentiface.SpanKindPublish, eventID)
+				processEvent := exporter.find(agentiface.SpanKindProcess, eventID)
+
+				So(publishCommand, ShouldNotBeNil)
+				So(processCommand, ShouldNotBeNil)
+				So(publishEvent, ShouldNotBeNil)
+				So(processEvent, ShouldNotBeNil)
+
+				So(publishCommand.ParentSpanID, ShouldBeEmpty)
+				So(publishCommand.Agent, ShouldStartWith, "sender@")
+				So(processCommand.ParentSpanID, ShouldEqual, publishCommand.SpanID)
+				So(processCommand.Agent, ShouldStartWith, "receiver@")
+				So(publishEvent.ParentSpanID, ShouldEqual, processCommand.SpanID)
+				So(publishEvent.CausationID, ShouldEqual, commandID)
+				So(processEvent.ParentSpanID, ShouldEqual, publishEvent.SpanID)
+
+				for _, span := range []*agentiface.Span{processCommand, publishEvent, processEvent} {
+					So(span.TraceID, ShouldEqual, publishCommand.TraceID)
+				}
+
+				So(len(publishCommand.TraceID), ShouldEqual, 32)
+			})
+		})
+	})
+}
@@ -17,9 +17,11 @@ package agentimpl
 import (
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/crucibuild/sdk-agent-go/agentiface"
 	"github.com/crucibuild/sdk-agent-go/util"
+	"github.com/pkg/errors"
 )
 
 type typeStruct struct {
@@ -27,8 +29,9 @@ type typeStruct struct {
 	t    reflect.Type
 }
 
-// TypeRegistry is a registry referencing types.
+// TypeRegistry is a registry referencing types. It is safe for concurrent use.
 type TypeRegistry struct {
+	mutex       sync.RWMutex
 	typesByName map[string]agentiface.Type
 	typesByType map[reflect.Type]agentiface.Type
 }
@@ -71,8 +74,47 @@ func NewTypeFromType(name string, t reflect.Type) agentiface.Type {
 	}
 }
 
-// TypeRegister registers a Type into the registry.
+// TypeRegister registers a Type into the registry, unless its name or its reflection type is already registered
+// with another Type.
 func (s *TypeRegistry) TypeRegister(t agentiface.Type) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	byName, nameRegistered := s.typesByName[t.Name()]
+	byType, typeRegistered := s.typesByType[t.Type()]
+
+	if nameRegistered && typeRegistered && byName.Type() == t.Type() && byType.Name() == t.Name() {
+		return t.Name(), nil
+	}
+
+	if nameRegistered {
+		return "", errors.Wrapf(agentiface.ErrAlreadyRegistered, "Type '%s' (%s)", t.Name(), byName.Type())
+	}
+
+	if typeRegistered {
+		return "", errors.Wrapf(agentiface.ErrAlreadyRegistered, "Type '%s' (%s)", byType.Name(), t.Type())
+	}
+
+	s.typesByName[t.Name()] = t
+	s.typesByType[t.Type()] = t
+
+	return t.Name(), nil
+}
+
+// TypeReplace registers a Type into the registry, replacing the Types registered with the same name or the same
+// reflection type if any.
+func (s *TypeRegistry) TypeReplace(t agentiface.Type) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if byName, ok := s.typesByName[t.Name()]; ok {
+		delete(s.typesByType, byName.Type())
+	}
+
+	if byType, ok := s.typesByType[t.Type()]; ok {
+		delete(s.typesByName, byType.Name())
+	}
+
 	s.typesByName[t.Name()] = t
 	s.typesByType[t.Type()] = t
 
@@ -81,6 +123,9 @@ func (s *TypeRegistry) TypeRegister(t agentiface.Type) (string, error) {
 
 // TypeGetByName returns a Type which name's match key.
 func (s *TypeRegistry) TypeGetByName(key string) (agentiface.Type, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	t, ok := s.typesByName[key]
 
 	if !ok {
@@ -92,6 +137,9 @@ func (s *TypeRegistry) TypeGetByName(key string) (agentiface.Type, error) {
 
 // TypeGetByType returns a Type from a reflect.Type.
 func (s *TypeRegistry) TypeGetByType(v reflect.Type) (agentiface.Type, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	t, ok := s.typesByType[v]
 
 	if !ok {
@@ -103,6 +151,9 @@ func (s *TypeRegistry) TypeGetByType(v reflect.Type) (agentiface.Type, error) {
 
 // TypeListNames returns a map(<id, name>) of all the registered types.
 func (s *TypeRegistry) TypeListNames() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	values := make([]string, len(s.typesByName))
 
 	i := 0
@@ -116,10 +167,13 @@ func (s *TypeRegistry) TypeListNames() []string {
 
 // TypeUnregister unregister the Type key from the registry.
 func (s *TypeRegistry) TypeUnregister(key string) error {
-	t, err := s.TypeGetByName(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if err != nil {
-		return err
+	t, ok := s.typesByName[key]
+
+	if !ok {
+		return fmt.Errorf("No type found in the registry with key '%s'", key)
 	}
 
 	delete(s.typesByName, key)
@@ -130,6 +184,9 @@ func (s *TypeRegistry) TypeUnregister(key string) error {
 
 // TypeExist returns true if a type matching key is known to the registry.
 func (s *TypeRegistry) TypeExist(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	_, ok := s.typesByName[key]
 
 	return ok
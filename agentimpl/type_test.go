@@ -17,8 +17,10 @@ package agentimpl
 import (
 	"fmt"
 	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -173,3 +175,98 @@ func TestUnregisterAType(t *testing.T) {
 		})
 	})
 }
+
+func TestRegisterConflictingTypes(t *testing.T) {
+	Convey("Given a registry containing the type 'foo' (string)", t, func() {
+		var agent agentiface.Agent // not used
+		registry := NewTypeRegistry(agent)
+		foo := NewTypeFromType("foo", reflect.TypeOf(""))
+
+		_, err := registry.TypeRegister(foo)
+		So(err, ShouldBeNil)
+
+		Convey("When the same type is registered again", func() {
+			_, err := registry.TypeRegister(NewTypeFromType("foo", reflect.TypeOf("")))
+
+			Convey("No error should occur", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When another type is registered with the same name", func() {
+			_, err := registry.TypeRegister(NewTypeFromType("foo", reflect.TypeOf(0)))
+
+			Convey("A conflict error should occur and the registered type should be kept", func() {
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrAlreadyRegistered)
+
+				tpe, err := registry.TypeGetByName("foo")
+				So(err, ShouldBeNil)
+				So(tpe, ShouldEqual, foo)
+			})
+		})
+
+		Convey("When the same reflection type is registered with another name", func() {
+			_, err := registry.TypeRegister(NewTypeFromType("bar", reflect.TypeOf("")))
+
+			Convey("A conflict error should occur", func() {
+				So(errors.Cause(err), ShouldEqual, agentiface.ErrAlreadyRegistered)
+				So(registry.TypeExist("bar"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the type is replaced by a type with another reflection type", func() {
+			replacement := NewTypeFromType("foo", reflect.TypeOf(0))
+			_, err := registry.TypeReplace(replacement)
+
+			Convey("The replacement should be registered and the former reflection type forgotten", func() {
+				So(err, ShouldBeNil)
+
+				tpe, err := registry.TypeGetByName("foo")
+				So(err, ShouldBeNil)
+				So(tpe, ShouldEqual, replacement)
+
+				_, err = registry.TypeGetByType(reflect.TypeOf(""))
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestConcurrentTypeRegistry(t *testing.T) {
+	Convey("Given a registry used concurrently", t, func() {
+		var agent agentiface.Agent // not used
+		registry := NewTypeRegistry(agent)
+		tpe := NewTypeFromType("foo", reflect.TypeOf(""))
+
+		const goroutines = 8
+		failures := make(chan error, goroutines*100)
+		var wg sync.WaitGroup
+
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 100; j++ {
+					if _, err := registry.TypeRegister(tpe); err != nil {
+						failures <- err
+					}
+					registry.TypeGetByName("foo")              // nolint: errcheck
+					registry.TypeGetByType(reflect.TypeOf("")) // nolint: errcheck
+					registry.TypeListNames()
+					if i%2 == 0 {
+						registry.TypeUnregister("foo") // nolint: errcheck
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(failures)
+
+		Convey("Registering the same type should never conflict", func() {
+			for err := range failures {
+				So(err, ShouldBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package agentimpl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+)
+
+// messageNameOf returns the name of the messages decoded into the type T, as registered in the TypeRegistry of
+// the agent, and checks the schema of these messages is known.
+func messageNameOf[T any](agent agentiface.Agent) (agentiface.MessageName, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	typ, err := agent.TypeGetByType(t)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !agent.SchemaExist(typ.Name()) {
+		return "", fmt.Errorf("No schema found in the registry for type '%s' (%s)", t.Name(), typ.Name())
+	}
+
+	return agentiface.MessageName(typ.Name()), nil
+}
+
+// OnCommand registers a callback triggered by the reception of the commands decoded into the type T, wrapped by
+// the given middlewares. T must be registered in the TypeRegistry of the agent, with a name matching a schema.
+func OnCommand[T any](agent agentiface.Agent, callback func(ctx agentiface.CommandCtx, msg *T) error, middlewares ...agentiface.Middleware) (string, error) {
+	name, err := messageNameOf[T](agent)
+
+	if err != nil {
+		return "", err
+	}
+
+	return agent.RegisterCommandCallback(name, func(ctx agentiface.CommandCtx) error {
+		msg, ok := ctx.Message().(*T)
+
+		if !ok {
+			return fmt.Errorf("Not Acceptable: Message-type '%s' decoded as %T", name, ctx.Message())
+		}
+
+		return callback(ctx, msg)
+	}, middlewares...)
+}
+
+// OnEvent registers a callback triggered by the reception of the events decoded into the type T and matching
+// the filter (if not nil), wrapped by the given middlewares. T must be registered in the TypeRegistry of the agent,
+// with a name matching a schema.
+func OnEvent[T any](agent agentiface.Agent, filter *agentiface.Filter, callback func(ctx agentiface.EventCtx, msg *T) error, middlewares ...agentiface.Middleware) (string, error) {
+	name, err := messageNameOf[T](agent)
+
+	if err != nil {
+		return "", err
+	}
+
+	typeFilter := agentiface.ByMessageType(name)
+
+	if filter != nil {
+		typeFilter = agentiface.All(typeFilter, filter)
+	}
+
+	return agent.RegisterFilteredEventCallback(typeFilter, func(ctx agentiface.EventCtx) error {
+		msg, ok := ctx.Message().(*T)
+
+		if !ok {
+			return fmt.Errorf("Not Acceptable: Message-type '%s' decoded as %T", name, ctx.Message())
+		}
+
+		return callback(ctx, msg)
+	}, middlewares...)
+}
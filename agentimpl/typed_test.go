@@ -0,0 +1,100 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package agentimpl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type unknown struct{}
+
+func TestTypedCallbacks(t *testing.T) {
+	Convey("Given two agents connected to the same loopback broker", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", nil)
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the agents register typed callbacks", func() {
+			commands := make(chan *person, 1)
+			events := make(chan *person, 1)
+
+			_, err := OnCommand(receiver, func(ctx agentiface.CommandCtx, msg *person) error {
+				commands <- msg
+				return ctx.SendEvent(msg)
+			})
+			So(err, ShouldBeNil)
+
+			_, err = OnEvent(sender, agentiface.BySenderName("receiver"), func(ctx agentiface.EventCtx, msg *person) error {
+				events <- msg
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 74}), ShouldBeNil)
+
+			Convey("The callbacks should receive typed messages", func() {
+				select {
+				case msg := <-commands:
+					So(msg, ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 74})
+				case <-time.After(receiveTimeout):
+					So("command not received", ShouldBeEmpty)
+				}
+
+				select {
+				case msg := <-events:
+					So(msg, ShouldResemble, &person{FirstName: "john", LastName: "doe", Age: 74})
+				case <-time.After(receiveTimeout):
+					So("event not received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When a callback is registered for a type which is not registered", func() {
+			_, err := OnCommand(receiver, func(ctx agentiface.CommandCtx, msg *unknown) error {
+				return nil
+			})
+
+			Convey("An error should occur", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a callback is registered for a type without schema", func() {
+			_, err := receiver.TypeRegister(NewTypeFromType("unknown", reflect.TypeOf(unknown{})))
+			So(err, ShouldBeNil)
+
+			_, err = OnEvent(receiver, nil, func(ctx agentiface.EventCtx, msg *unknown) error {
+				return nil
+			})
+
+			Convey("An error should occur", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"context"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	"hash/fnv"
+	"sync"
+)
+
+// configuration keys of the worker pool
+const (
+	configWorkersSize     = "workers.size"
+	configWorkersOrdering = "workers.ordering"
+)
+
+// ordering guarantees of the worker pool
+const (
+	// messages are processed by any available worker
+	orderingNone = "none"
+	// messages sharing the same correlation id are processed in order
+	orderingCorrelationID = "correlation-id"
+)
+
+// workerPool dispatches the processing of the incoming messages to a fixed number of workers.
+// Messages without ordering key go through a channel shared by all the workers, while messages with an ordering
+// key always go to the same worker so that they are processed in the order they were received.
+type workerPool struct {
+	shared  chan func() error
+	workers []chan func() error
+}
+
+// newWorkerPool creates the channels of a pool of the given size (at least 1).
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &workerPool{
+		shared:  make(chan func() error),
+		workers: make([]chan func() error, size),
+	}
+
+	for i := range p.workers {
+		p.workers[i] = make(chan func() error)
+	}
+
+	return p
+}
+
+// channel returns the channel on which a message with the given ordering key must be sent.
+func (p *workerPool) channel(key string) chan<- func() error {
+	if key == "" {
+		return p.shared
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key)) // nolint: errcheck, never fails
+
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
+
+// WithOrderingKey makes the agent process in order the messages sharing the same key, as returned by the given
+// function. Messages with an empty key are not ordered. It takes precedence over the workers.ordering configuration.
+func WithOrderingKey(key agentiface.OrderingKey) Option {
+	return func(agent *Agent) error {
+		agent.orderingKey = key
+		return nil
+	}
+}
+
+// orderingKeyOf returns the ordering key of an envelope, following the configuration of the agent.
+func (m *Messaging) orderingKeyOf(e *agentiface.Envelope) string {
+	if m.agent.orderingKey != nil {
+		return m.agent.orderingKey(e)
+	}
+
+	if m.agent.GetConfigString(configWorkersOrdering) == orderingCorrelationID {
+		return e.CorrelationID
+	}
+
+	return ""
+}
+
+// startWorkers starts the workers of the pool, which run until the transport gets disconnected.
+func (m *Messaging) startWorkers(pool *workerPool, stop <-chan struct{}) {
+	for _, own := range pool.workers {
+		own := own
+
+		// the workers keep on processing the messages when the agent quits until the messaging is stopped, so that
+		// the messages in flight are drained (see Shutdown)
+		m.agent.Go(func(_ <-chan struct{}) error {
+			for {
+				var f func() error
+
+				select {
+				case f = <-own:
+				case f = <-pool.shared:
+				case <-stop:
+					return nil
+				}
+
+				// call process function
+				if err := f(); err != nil {
+					m.agent.Error("%s", err.Error())
+				}
+			}
+		})
+	}
+}
+
+// inflight counts the messages received and not processed yet.
+type inflight struct {
+	mutex sync.Mutex
+	count int
+	// closed when the count drops to zero
+	idle chan struct{}
+}
+
+func newInflight() *inflight {
+	idle := make(chan struct{})
+	close(idle)
+
+	return &inflight{idle: idle}
+}
+
+func (i *inflight) add() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.count == 0 {
+		i.idle = make(chan struct{})
+	}
+	i.count++
+}
+
+func (i *inflight) done() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.count--
+	if i.count == 0 {
+		close(i.idle)
+	}
+}
+
+// wait blocks until all the messages are processed or ctx is done. It returns the number of messages which are
+// still not processed.
+func (i *inflight) wait(ctx context.Context) int {
+	i.mutex.Lock()
+	idle := i.idle
+	i.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-ctx.Done():
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+
+		return i.count
+	}
+}
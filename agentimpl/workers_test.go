@@ -0,0 +1,92 @@
+// Copyright (C) 2016 Christophe Camel, Jonathan Pigrée
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentimpl
+
+import (
+	"fmt"
+	"github.com/crucibuild/sdk-agent-go/agentiface"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	Convey("Given a pool of 4 workers", t, func() {
+		pool := newWorkerPool(4)
+
+		Convey("Messages without key should go through the shared channel", func() {
+			So(pool.channel("") == (chan<- func() error)(pool.shared), ShouldBeTrue)
+		})
+
+		Convey("Messages with the same key should always go to the same worker", func() {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				So(pool.channel(key) == pool.channel(key), ShouldBeTrue)
+				So(pool.channel(key) == (chan<- func() error)(pool.shared), ShouldBeFalse)
+			}
+		})
+	})
+
+	Convey("Given a pool of invalid size", t, func() {
+		pool := newWorkerPool(0)
+
+		Convey("It should have one worker", func() {
+			So(len(pool.workers), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestConcurrentProcessing(t *testing.T) {
+	Convey("Given an agent processing messages with 2 workers", t, func() {
+		broker := NewLoopbackBroker()
+		sender := newTestAgent(broker, "sender", nil)
+		receiver := newTestAgent(broker, "receiver", map[string]interface{}{
+			configWorkersSize: 2,
+		})
+
+		Reset(func() {
+			sender.Disconnect()   // nolint: errcheck
+			receiver.Disconnect() // nolint: errcheck
+		})
+
+		Convey("When the first command blocks until the second one is processed", func() {
+			second := make(chan struct{})
+			unblocked := make(chan bool, 1)
+
+			_, err := receiver.RegisterCommandCallback(schemaID, func(ctx agentiface.CommandCtx) error {
+				if ctx.Message().(*person).Age == 1 {
+					select {
+					case <-second:
+						unblocked <- true
+					case <-time.After(receiveTimeout):
+						unblocked <- false
+					}
+					return nil
+				}
+
+				close(second)
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.SendCommand("receiver", &person{FirstName: "john", LastName: "doe", Age: 1}), ShouldBeNil)
+			So(sender.SendCommand("receiver", &person{FirstName: "jane", LastName: "doe", Age: 2}), ShouldBeNil)
+
+			Convey("Both commands should be processed concurrently", func() {
+				So(<-unblocked, ShouldBeTrue)
+			})
+		})
+	})
+}
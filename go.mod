@@ -0,0 +1,16 @@
+module github.com/crucibuild/sdk-agent-go
+
+go 1.18
+
+require (
+	github.com/cespare/wait v0.0.0-20150122072838-42494a45ed2f
+	github.com/elodina/go-avro v0.0.0-20160406082632-0c8185d9a3ba
+	github.com/magiconair/properties v1.7.6
+	github.com/pkg/errors v0.9.1
+	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
+	github.com/smartystreets/goconvey v1.6.4
+	github.com/spf13/cobra v0.0.2
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.0.2
+	github.com/streadway/amqp v1.1.0
+)
@@ -20,7 +20,12 @@ import (
 )
 
 // InitializeStruct initialize a Go struct from reflect type and value.
+// Pointers to structs are initialized, except the ones of recursive types which are left nil.
 func InitializeStruct(t reflect.Type, v reflect.Value) {
+	initializeStruct(t, v, map[reflect.Type]bool{t: true})
+}
+
+func initializeStruct(t reflect.Type, v reflect.Value, parents map[reflect.Type]bool) {
 	for i := 0; i < v.NumField(); i++ {
 		f := v.Field(i)
 		ft := t.Field(i)
@@ -32,10 +37,16 @@ func InitializeStruct(t reflect.Type, v reflect.Value) {
 		case reflect.Chan:
 			f.Set(reflect.MakeChan(ft.Type, 0))
 		case reflect.Struct:
-			InitializeStruct(ft.Type, f)
+			initializeStruct(ft.Type, f, parents)
 		case reflect.Ptr:
-			fv := reflect.New(ft.Type.Elem())
-			InitializeStruct(ft.Type.Elem(), fv.Elem())
+			elem := ft.Type.Elem()
+			if elem.Kind() != reflect.Struct || parents[elem] {
+				continue
+			}
+			fv := reflect.New(elem)
+			parents[elem] = true
+			initializeStruct(elem, fv.Elem(), parents)
+			delete(parents, elem)
 			f.Set(fv)
 		default:
 		}
@@ -26,6 +26,12 @@ type aStruct struct {
 	Value string
 }
 
+type aRecursiveStruct struct {
+	Value *string
+	Next  *aRecursiveStruct
+	Child *aStruct
+}
+
 func TestGetStructType(t *testing.T) {
 	Convey("Given a set of interfaces", t, func() {
 		var data = []struct {
@@ -101,3 +107,21 @@ func TestNew(t *testing.T) {
 		})
 	})
 }
+
+func TestNewRecursive(t *testing.T) {
+	Convey("Given a recursive struct with a pointer to a primitive type", t, func() {
+		tpe := reflect.TypeOf(aRecursiveStruct{})
+
+		Convey("When when we call the New() function", func() {
+			v := New(tpe)
+
+			Convey("Pointers to structs should be initialized, except the recursive ones", func() {
+				s := v.(*aRecursiveStruct)
+
+				So(s.Child, ShouldNotBeNil)
+				So(s.Next, ShouldBeNil)
+				So(s.Value, ShouldBeNil)
+			})
+		})
+	})
+}